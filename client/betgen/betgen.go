@@ -0,0 +1,285 @@
+// Package betgen generates synthetic agency files with the same layout of the
+// agency-N.csv files read by the client: one bet per row with first name,
+// last name, document, birthdate and number. Generation is deterministic for
+// a given seed, so any edge case found can be reproduced exactly.
+package betgen
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	// WINNER_NUMBER is the number the server draws as the winner
+	WINNER_NUMBER = 7574
+
+	MIN_DOCUMENT = 10000000
+	MAX_DOCUMENT = 49999999
+)
+
+var nameSyllables = []string{
+	"a", "na", "ma", "ri", "lo", "ca", "san", "tia", "go", "mi", "la", "gros",
+	"die", "ro", "va", "le", "ti", "na", "jo", "a", "quin", "bas", "so", "mar",
+}
+
+// delimiterCharacters are the characters a name is filled with when faults
+// with delimiters are injected. They are either CSV or protocol delimiters
+var delimiterCharacters = []string{",", ";", `"`, "[", "]", "{", "}"}
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// Options controls the content of the generated file
+type Options struct {
+	Seed int64
+	Rows int
+
+	// Name lengths follow a normal distribution clamped to [MinNameLength, MaxNameLength]
+	MinNameLength    int
+	MaxNameLength    int
+	MeanNameLength   float64
+	StdDevNameLength float64
+
+	BirthdateFrom time.Time
+	BirthdateTo   time.Time
+
+	MinNumber int
+	MaxNumber int
+
+	// WinnerFraction is the fraction of rows whose number is WINNER_NUMBER
+	WinnerFraction float64
+
+	// Fault injection: fraction of rows with a wrong amount of fields or
+	// non numeric values, with delimiter characters in their names and with
+	// fields too big for a bet to be encoded in MAX_BYTES_BET bytes
+	MalformedFraction      float64
+	DelimiterFraction      float64
+	OversizedFieldFraction float64
+}
+
+// Summary counts the rows written of each kind. A row may have several
+// faults, so Faulty counts the rows with at least one of them, which are the
+// ones the client rejects
+type Summary struct {
+	Rows           int
+	Winners        int
+	Malformed      int
+	WithDelimiters int
+	Oversized      int
+	Faulty         int
+}
+
+// Generator writes synthetic agency files
+type Generator struct {
+	options Options
+	random  *rand.Rand
+}
+
+// ============================== BUILDER ============================== //
+
+// DefaultOptions Returns options that produce files similar to the ones in
+// the dataset, without any fault
+func DefaultOptions() Options {
+	return Options{
+		Seed:             1,
+		Rows:             1000,
+		MinNameLength:    3,
+		MaxNameLength:    20,
+		MeanNameLength:   8,
+		StdDevNameLength: 3,
+		BirthdateFrom:    time.Date(1940, 1, 1, 0, 0, 0, 0, time.UTC),
+		BirthdateTo:      time.Date(2005, 12, 31, 0, 0, 0, 0, time.UTC),
+		MinNumber:        0,
+		MaxNumber:        9999,
+		WinnerFraction:   0.0001,
+	}
+}
+
+// NewGenerator Validates the options and returns a generator for them
+func NewGenerator(options Options) (*Generator, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	return &Generator{options: options, random: rand.New(rand.NewSource(options.Seed))}, nil
+}
+
+func (options Options) validate() error {
+	problems := []string{}
+	if options.Rows < 0 {
+		problems = append(problems, "rows must not be negative")
+	}
+	if options.MinNameLength < 1 || options.MaxNameLength < options.MinNameLength {
+		problems = append(problems, "name lengths must satisfy 1 <= min <= max")
+	}
+	if !options.BirthdateFrom.Before(options.BirthdateTo) {
+		problems = append(problems, "birthdate range must not be empty")
+	}
+	if options.MinNumber < 0 || options.MaxNumber < options.MinNumber {
+		problems = append(problems, "numbers must satisfy 0 <= min <= max")
+	}
+
+	fractions := map[string]float64{
+		"winner":    options.WinnerFraction,
+		"malformed": options.MalformedFraction,
+		"delimiter": options.DelimiterFraction,
+		"oversized": options.OversizedFieldFraction,
+	}
+	for name, fraction := range fractions {
+		if fraction < 0 || fraction > 1 {
+			problems = append(problems, fmt.Sprintf("%s fraction must be between 0 and 1", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ============================== PRIVATE - FIELDS ============================== //
+
+func (generator *Generator) happens(fraction float64) bool {
+	return fraction > 0 && generator.random.Float64() < fraction
+}
+
+func (generator *Generator) nameLength() int {
+	options := generator.options
+	length := int(math.Round(generator.random.NormFloat64()*options.StdDevNameLength + options.MeanNameLength))
+	if length < options.MinNameLength {
+		return options.MinNameLength
+	}
+	if length > options.MaxNameLength {
+		return options.MaxNameLength
+	}
+	return length
+}
+
+func (generator *Generator) name() string {
+	length := generator.nameLength()
+
+	var name strings.Builder
+	for name.Len() < length {
+		name.WriteString(nameSyllables[generator.random.Intn(len(nameSyllables))])
+	}
+	truncatedName := name.String()[:length]
+	return strings.ToUpper(truncatedName[:1]) + truncatedName[1:]
+}
+
+func (generator *Generator) document() string {
+	return strconv.Itoa(MIN_DOCUMENT + generator.random.Intn(MAX_DOCUMENT-MIN_DOCUMENT+1))
+}
+
+func (generator *Generator) birthdate() string {
+	options := generator.options
+	days := int(options.BirthdateTo.Sub(options.BirthdateFrom).Hours() / 24)
+	return options.BirthdateFrom.AddDate(0, 0, generator.random.Intn(days+1)).Format(common.BIRTHDATE_LAYOUT)
+}
+
+func (generator *Generator) number(winner bool) string {
+	if winner {
+		return strconv.Itoa(WINNER_NUMBER)
+	}
+
+	options := generator.options
+	for {
+		number := options.MinNumber + generator.random.Intn(options.MaxNumber-options.MinNumber+1)
+		if number != WINNER_NUMBER || options.MinNumber == options.MaxNumber {
+			return strconv.Itoa(number)
+		}
+	}
+}
+
+// ============================== PRIVATE - ROWS ============================== //
+
+// validRow Returns a row the client accepts. Its number is counted as a
+// winner whenever it is WINNER_NUMBER, even if it was not chosen to win,
+// as happens when the number range only holds it
+func (generator *Generator) validRow(summary *Summary) []string {
+	number := generator.number(generator.happens(generator.options.WinnerFraction))
+	if number == strconv.Itoa(WINNER_NUMBER) {
+		summary.Winners++
+	}
+	return []string{generator.name(), generator.name(), generator.document(), generator.birthdate(), number}
+}
+
+// malformedRow breaks a valid row in one of several ways the client must reject
+func (generator *Generator) malformedRow(row []string) []string {
+	switch generator.random.Intn(4) {
+	case 0:
+		return row[:len(row)-1]
+	case 1:
+		return append(row, "extra")
+	case 2:
+		row[2] = "DNI-" + row[2]
+	default:
+		row[3] = strings.Replace(row[3], "-", "/", -1)
+	}
+	return row
+}
+
+func (generator *Generator) withDelimiters(row []string) []string {
+	field := generator.random.Intn(2)
+	position := generator.random.Intn(len(row[field]) + 1)
+	delimiter := delimiterCharacters[generator.random.Intn(len(delimiterCharacters))]
+	row[field] = row[field][:position] + delimiter + row[field][position:]
+	return row
+}
+
+func (generator *Generator) withOversizedField(row []string) []string {
+	field := generator.random.Intn(2)
+	row[field] = strings.Repeat(row[field], common.MAX_BYTES_BET/len(row[field])+1)
+	return row
+}
+
+// ============================== PUBLIC ============================== //
+
+// Write Writes options.Rows rows to writer and returns how many of each kind were written
+func (generator *Generator) Write(writer io.Writer) (Summary, error) {
+	options := generator.options
+	summary := Summary{}
+
+	csvWriter := csv.NewWriter(writer)
+	csvWriter.Comma = common.CSV_FIELD_DELIMITER
+
+	for i := 0; i < options.Rows; i++ {
+		row := generator.validRow(&summary)
+
+		faulty := false
+		if generator.happens(options.DelimiterFraction) {
+			row = generator.withDelimiters(row)
+			summary.WithDelimiters++
+			faulty = true
+		}
+		if generator.happens(options.OversizedFieldFraction) {
+			row = generator.withOversizedField(row)
+			summary.Oversized++
+			faulty = true
+		}
+		if generator.happens(options.MalformedFraction) {
+			row = generator.malformedRow(row)
+			summary.Malformed++
+			faulty = true
+		}
+		if faulty {
+			summary.Faulty++
+		}
+
+		if err := csvWriter.Write(row); err != nil {
+			return summary, err
+		}
+		summary.Rows++
+	}
+
+	csvWriter.Flush()
+	return summary, csvWriter.Error()
+}
@@ -0,0 +1,140 @@
+package betgen
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+func generateForTest(t *testing.T, options Options) ([]byte, Summary) {
+	t.Helper()
+	generator, err := NewGenerator(options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var file bytes.Buffer
+	summary, err := generator.Write(&file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return file.Bytes(), summary
+}
+
+func TestGeneratorIsDeterministic(t *testing.T) {
+	options := DefaultOptions()
+	options.MalformedFraction = 0.1
+	options.DelimiterFraction = 0.1
+
+	first, _ := generateForTest(t, options)
+	second, _ := generateForTest(t, options)
+	if !bytes.Equal(first, second) {
+		t.Fatal("same seed produced different files")
+	}
+
+	options.Seed++
+	third, _ := generateForTest(t, options)
+	if bytes.Equal(first, third) {
+		t.Fatal("different seeds produced the same file")
+	}
+}
+
+func TestGeneratorWritesAgencyLayout(t *testing.T) {
+	options := DefaultOptions()
+	options.Rows = 500
+	options.WinnerFraction = 0.5
+
+	file, summary := generateForTest(t, options)
+	if summary.Rows != options.Rows || summary.Winners == 0 {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+
+	reader := csv.NewReader(bytes.NewReader(file))
+	reader.FieldsPerRecord = 5
+	records, err := reader.ReadAll()
+	if err != nil {
+		t.Fatalf("generated file does not follow the agency layout: %v", err)
+	}
+	if len(records) != options.Rows {
+		t.Fatalf("unexpected amount of rows: got %d, want %d", len(records), options.Rows)
+	}
+}
+
+func TestNewGeneratorRejectsInvalidOptions(t *testing.T) {
+	options := DefaultOptions()
+	options.MaxNameLength = 0
+	options.WinnerFraction = 2
+
+	if _, err := NewGenerator(options); err == nil {
+		t.Fatal("expected an error for invalid options")
+	}
+}
+
+// rejectedRows Reads file as the client does and returns how many rows it
+// has and how many of them are not valid bets, because they can not be read
+// or do not pass Bet.Validate
+func rejectedRows(t *testing.T, file []byte) (int, int) {
+	t.Helper()
+	reader := csv.NewReader(bytes.NewReader(file))
+	reader.Comma = common.CSV_FIELD_DELIMITER
+	reader.Comment = common.CSV_COMMENT
+	reader.FieldsPerRecord = common.CSV_FIELDS_PER_RECORD
+
+	rows, rejected := 0, 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, rejected
+		}
+		rows++
+		if errors.Is(err, csv.ErrFieldCount) {
+			rejected++
+			continue
+		} else if err != nil {
+			t.Fatalf("generated file cannot be read: %v", err)
+		}
+
+		bet := common.NewBet("1", record[0], record[1], record[2], record[3], record[4])
+		if bet.Validate() != nil {
+			rejected++
+		}
+	}
+}
+
+func TestGeneratorInjectsFaultsTheClientRejects(t *testing.T) {
+	options := DefaultOptions()
+	options.MalformedFraction = 0.1
+	options.DelimiterFraction = 0.1
+	options.OversizedFieldFraction = 0.1
+
+	file, summary := generateForTest(t, options)
+	if summary.Malformed == 0 || summary.WithDelimiters == 0 || summary.Oversized == 0 {
+		t.Fatalf("expected every kind of fault to be injected: %+v", summary)
+	}
+
+	rows, rejected := rejectedRows(t, file)
+	if rows != options.Rows || rejected != summary.Faulty {
+		t.Fatalf("expected %d of %d rows to be rejected, got %d of %d", summary.Faulty, options.Rows, rejected, rows)
+	}
+
+	clean, _ := generateForTest(t, DefaultOptions())
+	if _, rejected := rejectedRows(t, clean); rejected != 0 {
+		t.Fatalf("expected rows without faults to be accepted, got %d rejected", rejected)
+	}
+}
+
+func TestGeneratorCountsEveryWinningNumber(t *testing.T) {
+	options := DefaultOptions()
+	options.MinNumber = WINNER_NUMBER
+	options.MaxNumber = WINNER_NUMBER
+	options.WinnerFraction = 0
+
+	_, summary := generateForTest(t, options)
+	if summary.Winners != options.Rows {
+		t.Fatalf("expected every row to be a winner, got %d of %d", summary.Winners, options.Rows)
+	}
+}
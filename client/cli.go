@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/pflag"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/config"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/gologging"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	// DEFAULT_COMMAND runs when the client is started without a command, as
+	// the containers do
+	DEFAULT_COMMAND = "send"
+
+	// FORMAT_TABLE prints the configuration as a table of values and sources
+	FORMAT_TABLE = "table"
+)
+
+// version of the client, set when building with
+// -ldflags "-X main.version=<version>"
+var version = "dev"
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// command is a subcommand of the client
+type command struct {
+	name    string
+	args    string
+	summary string
+
+	// configured commands take a flag for every configuration key
+	configured bool
+
+	// flags adds the flags of the command, besides the configuration ones
+	flags func(flags *pflag.FlagSet)
+
+	// run executes the command with the flags already parsed
+	run func(v *config.Config, flags *pflag.FlagSet) error
+}
+
+// rejectionCounter counts the rows of the agency file rejected by the client
+type rejectionCounter struct {
+	common.NopObserver
+	rejected int
+}
+
+var commands = []command{
+	{name: "send", summary: "send every bet of the agency, then ask for its winners", configured: true, run: runSend},
+	{name: "winners", summary: "only ask for the winners of the agency, whose bets were already sent", configured: true, run: runWinners},
+	{name: "validate", summary: "check the configuration and the agency file without connecting to the server", configured: true, run: runValidate},
+	{name: "config", args: "[check]", summary: "print the effective configuration and where each value comes from, or only check it", configured: true, flags: configFlags, run: runConfig},
+	{name: "version", summary: "print the version of the client", run: runVersion},
+}
+
+// ============================== PRIVATE - COMMANDS ============================== //
+
+// usage Returns the command followed by the arguments it takes
+func (command *command) usage() string {
+	return strings.TrimSpace(command.name + " " + command.args)
+}
+
+func (counter *rejectionCounter) BetRejected(line int, reason error) {
+	counter.rejected++
+}
+
+// withClientDo Builds the client from the configuration, with its metrics
+// and report, and calls function with it. The report is written with the
+// error function returns, once it returns
+func withClientDo(v *config.Config, function func(client *common.Client) error) error {
+	if err := InitConfig(v); err != nil {
+		return err
+	}
+	if err := InitLogger(v.GetString("log.level"), v.GetString("log.format")); err != nil {
+		return err
+	}
+
+	PrintConfig(v)
+
+	piiPolicy, err := common.ParsePIIPolicy(v.GetString("log.pii"))
+	if err != nil {
+		return common.NewError(common.ErrConfig, err)
+	}
+
+	tlsConfig, err := InitTLSConfig(v)
+	if err != nil {
+		return err
+	}
+
+	metricsObserver, stopServingMetrics, err := InitMetrics(v)
+	if err != nil {
+		return err
+	}
+	defer stopServingMetrics()
+
+	observers := []common.Observer{metricsObserver}
+	recorder := InitReport(v)
+	if recorder != nil {
+		observers = append(observers, recorder)
+	}
+
+	// The limiter is built even without limits, so they can be set later by
+	// reloading the configuration
+	rateLimiter := common.NewRateLimiter(RateLimits(v))
+
+	client := common.NewClient(common.ClientConfig{
+		ServerAddress:              v.GetString("server.address"),
+		ID:                         v.GetString("id"),
+		MaxAmountOfBetsOnEachBatch: v.GetInt("batch.maxAmount"),
+		MaxKiBPerBatch:             v.GetInt("batch.maxKiB"),
+		AgencyFileName:             fmt.Sprintf("agency-%s.csv", v.GetString("id")),
+		PipelineWorkers:            v.GetInt("pipeline.workers"),
+		PipelineQueueSize:          v.GetInt("pipeline.queueSize"),
+		AckTimeout:                 v.GetDuration("server.ackTimeout"),
+		Connect:                    ConnectPolicy(v),
+		Winners:                    WinnersPolicy(v),
+		Heartbeat:                  HeartbeatPolicy(v),
+		AdaptiveBatching:           AdaptiveBatching(v),
+		TLS:                        tlsConfig,
+		RateLimiter:                rateLimiter,
+		Signer:                     InitMessageSigner(v),
+		PII:                        piiPolicy,
+		Logger:                     gologging.New("log"),
+		Observer:                   common.MultiObserver(observers...),
+	})
+
+	stopReloading := InitReloader(v, client, rateLimiter)
+	defer stopReloading()
+
+	err = function(client)
+	WriteReport(v, recorder, err)
+	return err
+}
+
+func runSend(v *config.Config, flags *pflag.FlagSet) error {
+	return withClientDo(v, func(client *common.Client) error {
+		if err := client.SendAllBetsToNationalLotteryHeadquartersThenAskForWinners(); err != nil {
+			return err
+		}
+
+		log.Infof("action: exit | result: success | client_id: %v", v.GetString("id"))
+		return nil
+	})
+}
+
+func runWinners(v *config.Config, flags *pflag.FlagSet) error {
+	return withClientDo(v, func(client *common.Client) error {
+		if _, err := client.AskNationalLotteryHeadquartersForWinners(); err != nil {
+			return err
+		}
+
+		log.Infof("action: exit | result: success | client_id: %v", v.GetString("id"))
+		return nil
+	})
+}
+
+func runValidate(v *config.Config, flags *pflag.FlagSet) error {
+	if err := InitConfig(v); err != nil {
+		return err
+	}
+	if err := InitLogger(v.GetString("log.level"), v.GetString("log.format")); err != nil {
+		return err
+	}
+
+	piiPolicy, err := common.ParsePIIPolicy(v.GetString("log.pii"))
+	if err != nil {
+		return common.NewError(common.ErrConfig, err)
+	}
+	if _, err := InitTLSConfig(v); err != nil {
+		return err
+	}
+
+	counter := &rejectionCounter{}
+	client := common.NewClient(common.ClientConfig{
+		ID:                         v.GetString("id"),
+		MaxAmountOfBetsOnEachBatch: v.GetInt("batch.maxAmount"),
+		MaxKiBPerBatch:             v.GetInt("batch.maxKiB"),
+		AgencyFileName:             fmt.Sprintf("agency-%s.csv", v.GetString("id")),
+		PipelineWorkers:            v.GetInt("pipeline.workers"),
+		PipelineQueueSize:          v.GetInt("pipeline.queueSize"),
+		PII:                        piiPolicy,
+		Logger:                     gologging.New("log"),
+		Observer:                   counter,
+	})
+
+	validBets, err := client.ValidateBets()
+	if err != nil {
+		return err
+	}
+	if counter.rejected > 0 {
+		return common.NewError(common.ErrInput, fmt.Errorf("%d rows of the agency file are not valid bets", counter.rejected))
+	}
+
+	log.Infof("action: validate | result: success | client_id: %v | bets: %v", v.GetString("id"), validBets)
+	return nil
+}
+
+func configFlags(flags *pflag.FlagSet) {
+	flags.String("format", FORMAT_TABLE, fmt.Sprintf("print the configuration as a %s of values and sources, or as a %s, %s or %s config file", FORMAT_TABLE, config.FORMAT_YAML, config.FORMAT_JSON, config.FORMAT_TOML))
+}
+
+func runConfig(v *config.Config, flags *pflag.FlagSet) error {
+	args := flags.Args()
+	if len(args) == 1 && args[0] == "check" {
+		return CheckConfig(v)
+	}
+	if len(args) > 0 {
+		return common.NewError(common.ErrConfig, fmt.Errorf("unknown config command %q, expected check", strings.Join(args, " ")))
+	}
+
+	// The configuration is printed even if it is not valid, since that is
+	// when knowing where each value comes from helps the most
+	err := InitConfig(v)
+	format, _ := flags.GetString("format")
+	if format == FORMAT_TABLE {
+		PrintEffectiveConfig(os.Stdout, v)
+		return err
+	}
+
+	content, marshalErr := v.Marshal(format)
+	if marshalErr != nil {
+		return common.NewError(common.ErrConfig, marshalErr)
+	}
+	os.Stdout.Write(content)
+	return err
+}
+
+func runVersion(v *config.Config, flags *pflag.FlagSet) error {
+	fmt.Printf("client %s (%s %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return nil
+}
+
+// PrintEffectiveConfig Writes the value of every key and where it comes
+// from as a table, naming the config file of the values taken from one.
+// Sensitive values are redacted
+func PrintEffectiveConfig(writer io.Writer, v *config.Config) {
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "KEY\tVALUE\tSOURCE")
+	for _, entry := range v.Entries() {
+		source := entry.Source
+		if entry.File != "" {
+			source = fmt.Sprintf("%s (%s)", entry.Source, entry.File)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\n", entry.Key, entry.Value, source)
+	}
+	table.Flush()
+}
+
+// ============================== PRIVATE - DISPATCH ============================== //
+
+// printUsage Writes the commands of the client to writer
+func printUsage(writer io.Writer) {
+	fmt.Fprintf(writer, "Usage: client [command] [flags]\n\nCommands:\n")
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	for i := range commands {
+		command := &commands[i]
+		name := command.usage()
+		if command.name == DEFAULT_COMMAND {
+			name += " (default)"
+		}
+		fmt.Fprintf(table, "  %s\t%s\n", name, command.summary)
+	}
+	table.Flush()
+	fmt.Fprintf(writer, "\nRun \"client <command> --help\" for the flags of each command.\n")
+}
+
+// findCommand Splits the command line into the command to run and its
+// arguments. Without a command, DEFAULT_COMMAND runs
+func findCommand(args []string) (*command, []string, error) {
+	name := DEFAULT_COMMAND
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i], args, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("unknown command %q", name)
+}
+
+// Run Runs the command given in args, without the program name, and returns
+// the exit code of the client
+func Run(args []string) int {
+	if len(args) > 0 && (args[0] == "help" || args[0] == "-h" || args[0] == "--help") {
+		printUsage(os.Stdout)
+		return common.EXIT_SUCCESS
+	}
+
+	command, args, err := findCommand(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n\n", err)
+		printUsage(os.Stderr)
+		return common.EXIT_CONFIG
+	}
+
+	flags := pflag.NewFlagSet(command.name, pflag.ContinueOnError)
+	flags.SortFlags = false
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: client %s [flags]\n\n%s\n", command.usage(), command.summary)
+		if command.configured {
+			fmt.Fprintf(os.Stderr, "\nFlags take precedence over environment variables and the config file:\n%s", flags.FlagUsages())
+		}
+	}
+
+	var v *config.Config
+	if command.configured {
+		v = NewConfig(flags)
+	}
+	if command.flags != nil {
+		command.flags(flags)
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return common.EXIT_SUCCESS
+		}
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return common.EXIT_CONFIG
+	}
+	if command.args == "" && flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments: %s\n", strings.Join(flags.Args(), " "))
+		return common.EXIT_CONFIG
+	}
+
+	if err := command.run(v, flags); err != nil {
+		exitCode := common.ExitCode(err)
+		log.Criticalf("action: %s | result: fail | error: %s | exit_code: %d", command.name, err, exitCode)
+		return exitCode
+	}
+	return common.EXIT_SUCCESS
+}
+
+func main() {
+	os.Exit(Run(os.Args[1:]))
+}
@@ -0,0 +1,122 @@
+// Command gen-bets writes synthetic agency files in the layout expected by
+// the client, optionally injecting faults to reproduce edge cases.
+//
+// Usage example:
+//
+//	gen-bets -agencies 5 -rows 20000 -output-dir .data -malformed 0.01
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/betgen"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+type genBetsConfig struct {
+	options   betgen.Options
+	agencies  int
+	outputDir string
+	stdout    bool
+}
+
+func parseDate(name string, value string) time.Time {
+	date, err := time.Parse(common.BIRTHDATE_LAYOUT, value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid %s %q: expected YYYY-MM-DD\n", name, value)
+		os.Exit(2)
+	}
+	return date
+}
+
+func parseFlags() genBetsConfig {
+	defaults := betgen.DefaultOptions()
+	config := genBetsConfig{options: defaults}
+	options := &config.options
+
+	var birthdateFrom, birthdateTo string
+	flag.Int64Var(&options.Seed, "seed", defaults.Seed, "seed of the generator, agency N uses seed+N-1")
+	flag.IntVar(&options.Rows, "rows", defaults.Rows, "amount of rows of each agency file")
+	flag.IntVar(&options.MinNameLength, "name-min", defaults.MinNameLength, "minimum length of names")
+	flag.IntVar(&options.MaxNameLength, "name-max", defaults.MaxNameLength, "maximum length of names")
+	flag.Float64Var(&options.MeanNameLength, "name-mean", defaults.MeanNameLength, "mean length of names")
+	flag.Float64Var(&options.StdDevNameLength, "name-stddev", defaults.StdDevNameLength, "standard deviation of the length of names")
+	flag.StringVar(&birthdateFrom, "birthdate-from", defaults.BirthdateFrom.Format(common.BIRTHDATE_LAYOUT), "earliest birthdate")
+	flag.StringVar(&birthdateTo, "birthdate-to", defaults.BirthdateTo.Format(common.BIRTHDATE_LAYOUT), "latest birthdate")
+	flag.IntVar(&options.MinNumber, "number-min", defaults.MinNumber, "smallest bet number")
+	flag.IntVar(&options.MaxNumber, "number-max", defaults.MaxNumber, "biggest bet number")
+	flag.Float64Var(&options.WinnerFraction, "winners", defaults.WinnerFraction, "fraction of bets with the winner number")
+	flag.Float64Var(&options.MalformedFraction, "malformed", 0, "fraction of malformed rows")
+	flag.Float64Var(&options.DelimiterFraction, "delimiters", 0, "fraction of rows with delimiter characters in names")
+	flag.Float64Var(&options.OversizedFieldFraction, "oversized", 0, "fraction of rows with oversized fields")
+	flag.IntVar(&config.agencies, "agencies", 1, "amount of agency files to write")
+	flag.StringVar(&config.outputDir, "output-dir", ".", "directory where agency-N.csv files are written")
+	flag.BoolVar(&config.stdout, "stdout", false, "write a single agency file to stdout")
+	flag.Parse()
+
+	options.BirthdateFrom = parseDate("birthdate-from", birthdateFrom)
+	options.BirthdateTo = parseDate("birthdate-to", birthdateTo)
+	return config
+}
+
+func generate(options betgen.Options, writer io.Writer) (betgen.Summary, error) {
+	generator, err := betgen.NewGenerator(options)
+	if err != nil {
+		return betgen.Summary{}, err
+	}
+	return generator.Write(writer)
+}
+
+func generateAgencyFile(options betgen.Options, fileName string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+
+	summary, err := generate(options, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: rows: %d | winners: %d | malformed: %d | with_delimiters: %d | oversized: %d | faulty: %d\n",
+		fileName,
+		summary.Rows,
+		summary.Winners,
+		summary.Malformed,
+		summary.WithDelimiters,
+		summary.Oversized,
+		summary.Faulty,
+	)
+	return nil
+}
+
+func main() {
+	config := parseFlags()
+
+	if config.stdout {
+		if _, err := generate(config.options, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "gen-bets: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	for agencyID := 1; agencyID <= config.agencies; agencyID++ {
+		options := config.options
+		options.Seed += int64(agencyID - 1)
+
+		fileName := filepath.Join(config.outputDir, fmt.Sprintf("agency-%d.csv", agencyID))
+		if err := generateAgencyFile(options, fileName); err != nil {
+			fmt.Fprintf(os.Stderr, "gen-bets: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
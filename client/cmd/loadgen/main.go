@@ -0,0 +1,340 @@
+// Command loadgen simulates many agencies sending their bets to the
+// headquarters at the same time, each one through its own connection, and
+// reports the throughput and acknowledgement latency observed. Rate limits
+// are shared by every agency, as if they were a single client.
+//
+// Usage example:
+//
+//	loadgen -server localhost:12345 -agencies 20 -bets 5000 -barrier
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/betgen"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/gologging"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/logformat"
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+type loadgenConfig struct {
+	serverAddress     string
+	agencies          int
+	firstAgencyID     int
+	betsPerAgency     int
+	agencyFilePattern string
+	maxAmount         int
+	maxKiB            int
+	adaptive          common.AdaptiveBatching
+	connect           common.ConnectPolicy
+	winners           common.WinnersPolicy
+	heartbeat         common.HeartbeatPolicy
+	workers           int
+	rateLimits        common.RateLimits
+	barrier           bool
+	seed              int64
+	logLevel          string
+	logFormat         string
+}
+
+// statsCollector aggregates the events of every simulated agency. It is
+// shared by all of them, so every access is synchronized
+type statsCollector struct {
+	common.NopObserver
+
+	lock          sync.Mutex
+	ackLatencies  []time.Duration
+	winnerWaits   []time.Duration
+	throttled     time.Duration
+	creditWait    time.Duration
+	batchesSent   int
+	betsSent      int
+	bytesSent     int
+	winners       int
+	errorsByStage map[string]int
+}
+
+func newStatsCollector() *statsCollector {
+	return &statsCollector{errorsByStage: map[string]int{}}
+}
+
+func (stats *statsCollector) BetBatchAcknowledged(batchSize int, batchBytes int, latency time.Duration) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.batchesSent++
+	stats.betsSent += batchSize
+	stats.bytesSent += batchBytes
+	stats.ackLatencies = append(stats.ackLatencies, latency)
+}
+
+func (stats *statsCollector) Throttled(waited time.Duration) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.throttled += waited
+}
+
+func (stats *statsCollector) WaitedForCredits(waited time.Duration) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.creditWait += waited
+}
+
+func (stats *statsCollector) WinnersReceived(amountOfWinners int, waited time.Duration) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.winners += amountOfWinners
+	stats.winnerWaits = append(stats.winnerWaits, waited)
+}
+
+func (stats *statsCollector) failed(stage string) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.errorsByStage[stage]++
+}
+
+// ============================== PRIVATE - BET SOURCES ============================== //
+
+// syntheticAgencyFile builds an in-memory agency file with the same layout
+// of the agency-N.csv files
+func syntheticAgencyFile(seed int64, bets int) ([]byte, error) {
+	options := betgen.DefaultOptions()
+	options.Seed = seed
+	options.Rows = bets
+
+	generator, err := betgen.NewGenerator(options)
+	if err != nil {
+		return nil, err
+	}
+
+	var file bytes.Buffer
+	if _, err := generator.Write(&file); err != nil {
+		return nil, err
+	}
+	return file.Bytes(), nil
+}
+
+func agencySource(config loadgenConfig, agencyID int) func() (io.ReadCloser, error) {
+	if config.agencyFilePattern != "" {
+		fileName := fmt.Sprintf(config.agencyFilePattern, agencyID)
+		return func() (io.ReadCloser, error) { return os.Open(fileName) }
+	}
+
+	file, err := syntheticAgencyFile(config.seed+int64(agencyID), config.betsPerAgency)
+	return func() (io.ReadCloser, error) {
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(file)), nil
+	}
+}
+
+// ============================== PRIVATE - RUN AGENCY ============================== //
+
+// runAgency drives one agency through the whole flow, sending its batches
+// as fast as rateLimiter allows. When barrier is not nil, the agency waits
+// for every other one to finish sending its bets before asking for the
+// winners, so all the queries reach the server at once
+func runAgency(config loadgenConfig, agencyID int, stats *statsCollector, rateLimiter *common.RateLimiter, barrier *sync.WaitGroup) {
+	client := common.NewClient(common.ClientConfig{
+		ID:                         strconv.Itoa(agencyID),
+		ServerAddress:              config.serverAddress,
+		MaxAmountOfBetsOnEachBatch: config.maxAmount,
+		MaxKiBPerBatch:             config.maxKiB,
+		AdaptiveBatching:           config.adaptive,
+		Connect:                    config.connect,
+		Winners:                    config.winners,
+		Heartbeat:                  config.heartbeat,
+		PipelineWorkers:            config.workers,
+		OpenAgencyFile:             agencySource(config, agencyID),
+		RateLimiter:                rateLimiter,
+		Observer:                   stats,
+		Logger:                     gologging.New("log"),
+	})
+
+	arrivedAtBarrier := false
+	arriveAtBarrier := func() {
+		if barrier != nil && !arrivedAtBarrier {
+			arrivedAtBarrier = true
+			barrier.Done()
+		}
+	}
+	defer arriveAtBarrier()
+
+	if err := client.Connect(); err != nil {
+		stats.failed("connect")
+		return
+	}
+	defer client.Disconnect()
+
+	if err := client.SendAllBets(); err != nil {
+		stats.failed("send_bets")
+		return
+	}
+	if err := client.NotifyNoMoreBets(); err != nil {
+		stats.failed("no_more_bets")
+		return
+	}
+
+	if barrier != nil {
+		arriveAtBarrier()
+		barrier.Wait()
+	}
+
+	if _, err := client.AskForWinners(); err != nil {
+		stats.failed("ask_for_winners")
+	}
+}
+
+// ============================== PRIVATE - REPORT ============================== //
+
+func percentile(sortedValues []time.Duration, p float64) time.Duration {
+	if len(sortedValues) == 0 {
+		return 0
+	}
+	index := int(p/100*float64(len(sortedValues))+0.5) - 1
+	if index < 0 {
+		index = 0
+	} else if index >= len(sortedValues) {
+		index = len(sortedValues) - 1
+	}
+	return sortedValues[index]
+}
+
+func printDistribution(name string, values []time.Duration) {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	fmt.Printf("%-22s count: %d | p50: %v | p90: %v | p99: %v | max: %v\n",
+		name,
+		len(values),
+		percentile(values, 50),
+		percentile(values, 90),
+		percentile(values, 99),
+		percentile(values, 100),
+	)
+}
+
+func printReport(config loadgenConfig, stats *statsCollector, elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+
+	fmt.Printf("agencies:              %d\n", config.agencies)
+	fmt.Printf("elapsed:               %v\n", elapsed)
+	fmt.Printf("bets sent:             %d (%.0f bets/s)\n", stats.betsSent, float64(stats.betsSent)/seconds)
+	fmt.Printf("batches sent:          %d (%.0f batches/s)\n", stats.batchesSent, float64(stats.batchesSent)/seconds)
+	fmt.Printf("bytes sent:            %d (%.2f MiB/s)\n", stats.bytesSent, float64(stats.bytesSent)/seconds/common.KiB/common.KiB)
+	fmt.Printf("throttled:             %v\n", stats.throttled)
+	fmt.Printf("waited for credits:    %v\n", stats.creditWait)
+	fmt.Printf("winners:               %d\n", stats.winners)
+	printDistribution("ack latency:", stats.ackLatencies)
+	printDistribution("winners wait:", stats.winnerWaits)
+
+	stages := make([]string, 0, len(stats.errorsByStage))
+	totalErrors := 0
+	for stage, count := range stats.errorsByStage {
+		stages = append(stages, stage)
+		totalErrors += count
+	}
+	sort.Strings(stages)
+
+	fmt.Printf("errors:                %d\n", totalErrors)
+	for _, stage := range stages {
+		fmt.Printf("  %-20s %d\n", stage+":", stats.errorsByStage[stage])
+	}
+}
+
+// ============================== MAIN ============================== //
+
+func parseFlags() loadgenConfig {
+	config := loadgenConfig{}
+	flag.StringVar(&config.serverAddress, "server", "localhost:12345", "headquarters address (host:port)")
+	flag.IntVar(&config.agencies, "agencies", 5, "amount of agencies to simulate")
+	flag.IntVar(&config.firstAgencyID, "first-id", 1, "id of the first simulated agency")
+	flag.IntVar(&config.betsPerAgency, "bets", 1000, "amount of synthetic bets per agency")
+	flag.StringVar(&config.agencyFilePattern, "agency-file", "", "read bets from files instead, e.g. .data/agency-%d.csv")
+	flag.IntVar(&config.maxAmount, "batch-max-amount", 100, "maximum amount of bets on each batch")
+	flag.IntVar(&config.maxKiB, "batch-max-kib", 8, "maximum size of each batch in KiB")
+	flag.DurationVar(&config.adaptive.TargetLatency, "batch-target-latency", 0, "size the batches for this ack latency, up to the batch limits, 0 disables it")
+	flag.IntVar(&config.workers, "workers", common.DEFAULT_PIPELINE_WORKERS, "validate/encode workers per agency")
+	flag.IntVar(&config.rateLimits.BetsPerSecond, "bets-per-second", 0, "maximum bets per second sent by all the agencies together, 0 is unlimited")
+	flag.IntVar(&config.rateLimits.BetsBurst, "bets-burst", 0, "bets that can be sent at once above bets-per-second, 0 is one second of it")
+	flag.IntVar(&config.rateLimits.BytesPerSecond, "bytes-per-second", 0, "maximum bytes per second sent by all the agencies together, 0 is unlimited")
+	flag.IntVar(&config.rateLimits.BytesBurst, "bytes-burst", 0, "bytes that can be sent at once above bytes-per-second, 0 is one second of it")
+	flag.DurationVar(&config.connect.Jitter, "connect-jitter", 0, "longest random wait of each agency before connecting, 0 connects at once")
+	flag.DurationVar(&config.connect.RetryMaxWait, "connect-retry-max-wait", 0, "total time each agency keeps retrying refused, reset or busy connections")
+	flag.BoolVar(&config.connect.Handshake, "handshake", false, "ask the server to admit each agency with the HLO handshake")
+	flag.BoolVar(&config.connect.Credits, "credits", false, "advertise credit flow control in the HLO handshake, so the server can slow agencies down")
+	flag.DurationVar(&config.connect.KeepAlive, "keepalive", 0, "TCP keepalive period of each connection, 0 uses the system default and a negative one disables it")
+	flag.DurationVar(&config.heartbeat.Interval, "heartbeat", 0, "time between the PNG heartbeats of each agency, 0 disables them")
+	flag.BoolVar(&config.barrier, "barrier", false, "make every agency ask for winners at the same time")
+	flag.StringVar((*string)(&config.winners.Mode), "winners-mode", string(common.DEFAULT_WINNERS_MODE), "how each agency waits for the draw: ask, polling while the server replies WIT, or subscribe")
+	flag.DurationVar(&config.winners.MaxWait, "winners-max-wait", 0, "total time each agency waits for the draw, 0 waits forever")
+	flag.Int64Var(&config.seed, "seed", 1, "seed used to generate the synthetic bets")
+	flag.StringVar(&config.logLevel, "log-level", "WARNING", "log level of the simulated clients")
+	flag.StringVar(&config.logFormat, "log-format", logformat.FORMAT_TEXT, "format of the logs of the simulated clients: text or json")
+	flag.Parse()
+	return config
+}
+
+func initLogger(logLevel string, logFormat string) error {
+	formatBackend, err := logformat.NewBackend(logFormat, os.Stderr)
+	if err != nil {
+		return err
+	}
+	backend := logging.AddModuleLevel(formatBackend)
+	level, err := logging.LogLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	backend.SetLevel(level, "")
+	logging.SetBackend(backend)
+	return nil
+}
+
+func main() {
+	config := parseFlags()
+	if err := initLogger(config.logLevel, config.logFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid log settings: %v\n", err)
+		os.Exit(2)
+	}
+
+	stats := newStatsCollector()
+	rateLimiter := common.NewRateLimiter(config.rateLimits)
+
+	var barrier *sync.WaitGroup
+	if config.barrier {
+		barrier = &sync.WaitGroup{}
+		barrier.Add(config.agencies)
+	}
+
+	var agencies sync.WaitGroup
+	startedAt := time.Now()
+	for i := 0; i < config.agencies; i++ {
+		agencies.Add(1)
+		go func(agencyID int) {
+			defer agencies.Done()
+			runAgency(config, agencyID, stats, rateLimiter, barrier)
+		}(config.firstAgencyID + i)
+	}
+	agencies.Wait()
+
+	printReport(config, stats, time.Since(startedAt))
+
+	if len(stats.errorsByStage) > 0 {
+		os.Exit(1)
+	}
+}
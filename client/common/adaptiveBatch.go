@@ -0,0 +1,150 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	DEFAULT_ADAPTIVE_BATCH_MIN_AMOUNT = 1
+	DEFAULT_ADAPTIVE_BATCH_STEP       = 5
+
+	// ADAPTIVE_BATCH_DECREASE multiplies the amount of bets on each batch
+	// when the server slows down or fails
+	ADAPTIVE_BATCH_DECREASE = 0.5
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// AdaptiveBatching sizes the batches by the latency of their ACKs, AIMD
+// style: the amount of bets on each batch grows by Step after every full
+// batch acknowledged within TargetLatency, and is halved when an ACK takes
+// longer or a batch fails. It never goes below MinAmount nor above
+// MaxAmountOfBetsOnEachBatch, and MaxKiBPerBatch still bounds every batch
+type AdaptiveBatching struct {
+	// TargetLatency is the ACK latency the batches are sized for. Zero
+	// disables adaptive batching, so every batch is as big as allowed
+	TargetLatency time.Duration
+
+	// MinAmount is the smallest amount of bets on each batch, and the one
+	// the first batch starts with. When zero, DEFAULT_ADAPTIVE_BATCH_MIN_AMOUNT
+	// is used
+	MinAmount int
+
+	// Step is the amount of bets added after each batch acknowledged in
+	// time. When zero, DEFAULT_ADAPTIVE_BATCH_STEP is used
+	Step int
+}
+
+// ============================== PRIVATE ============================== //
+
+func (adaptive AdaptiveBatching) enabled() bool {
+	return adaptive.TargetLatency > 0
+}
+
+func (adaptive AdaptiveBatching) minAmount(limits Limits) int {
+	minAmount := adaptive.MinAmount
+	if minAmount <= 0 {
+		minAmount = DEFAULT_ADAPTIVE_BATCH_MIN_AMOUNT
+	}
+	if minAmount > limits.MaxAmountOfBetsOnEachBatch {
+		minAmount = limits.MaxAmountOfBetsOnEachBatch
+	}
+	return minAmount
+}
+
+func (adaptive AdaptiveBatching) step() int {
+	if adaptive.Step <= 0 {
+		return DEFAULT_ADAPTIVE_BATCH_STEP
+	}
+	return adaptive.Step
+}
+
+// batchLimits Returns the limits of the next batch: the current ones, with
+// the amount of bets chosen by adaptive batching if it is enabled
+func (client *Client) batchLimits() Limits {
+	limits := client.currentLimits()
+	if limits.AdaptiveBatching.enabled() {
+		limits.MaxAmountOfBetsOnEachBatch = client.adaptiveBatchAmount(limits)
+	}
+	return limits
+}
+
+// adaptiveBatchAmount Returns the amount of bets of the next batch, keeping
+// it within the limits even if they changed since it was chosen
+func (client *Client) adaptiveBatchAmount(limits Limits) int {
+	minAmount := limits.AdaptiveBatching.minAmount(limits)
+	if client.batchAmount < minAmount {
+		return minAmount
+	}
+	if client.batchAmount > limits.MaxAmountOfBetsOnEachBatch {
+		return limits.MaxAmountOfBetsOnEachBatch
+	}
+	return client.batchAmount
+}
+
+// setBatchAmount Changes the amount of bets of the following batches from
+// previous to amount, logging why
+func (client *Client) setBatchAmount(previous int, amount int, reason string) {
+	client.batchAmount = amount
+	if amount == previous {
+		return
+	}
+	client.log.Infof("action: adapt_batch_size | result: success | client_id: %v | bet_batch_max_amount: %v | previous: %v | reason: %v",
+		client.config.ID,
+		amount,
+		previous,
+		reason,
+	)
+}
+
+// adaptBatchSize Grows the following batches if the one just acknowledged
+// was full and its ACK arrived within the target latency, or shrinks them if
+// it took longer
+func (client *Client) adaptBatchSize(batchSize int, latency time.Duration) {
+	limits := client.currentLimits()
+	adaptive := limits.AdaptiveBatching
+	if !adaptive.enabled() {
+		return
+	}
+
+	amount := client.adaptiveBatchAmount(limits)
+	if latency > adaptive.TargetLatency {
+		client.shrinkBatchSize(limits, fmt.Sprintf("ack latency %v over the target %v", latency, adaptive.TargetLatency))
+		return
+	}
+
+	// Only full batches tell whether a bigger one would still be fast
+	if batchSize < amount {
+		return
+	}
+	grown := amount + adaptive.step()
+	if grown > limits.MaxAmountOfBetsOnEachBatch {
+		grown = limits.MaxAmountOfBetsOnEachBatch
+	}
+	client.setBatchAmount(amount, grown, fmt.Sprintf("ack latency %v within the target %v", latency, adaptive.TargetLatency))
+}
+
+// shrinkBatchSize Multiplies the amount of bets of the following batches by
+// ADAPTIVE_BATCH_DECREASE, without going below the minimum
+func (client *Client) shrinkBatchSize(limits Limits, reason string) {
+	amount := client.adaptiveBatchAmount(limits)
+	shrunk := int(float64(amount) * ADAPTIVE_BATCH_DECREASE)
+	if minAmount := limits.AdaptiveBatching.minAmount(limits); shrunk < minAmount {
+		shrunk = minAmount
+	}
+	client.setBatchAmount(amount, shrunk, reason)
+}
+
+// adaptBatchSizeToError Shrinks the following batches after a batch failed.
+// Interruptions are not a sign of an overloaded server, so they are ignored
+func (client *Client) adaptBatchSizeToError(err error) {
+	limits := client.currentLimits()
+	if !limits.AdaptiveBatching.enabled() || errors.Is(err, ErrInterrupted) {
+		return
+	}
+	client.shrinkBatchSize(limits, fmt.Sprintf("batch failed: %v", err))
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveBatchingGrowsAdditivelyAndShrinksMultiplicatively(t *testing.T) {
+	client := NewClient(ClientConfig{
+		MaxAmountOfBetsOnEachBatch: 20,
+		MaxKiBPerBatch:             8,
+		AdaptiveBatching:           AdaptiveBatching{TargetLatency: 100 * time.Millisecond, MinAmount: 2, Step: 4},
+	})
+
+	steps := []struct {
+		batchSize int
+		latency   time.Duration
+		err       error
+		expected  int
+	}{
+		{batchSize: 2, latency: 10 * time.Millisecond, expected: 6},
+		{batchSize: 6, latency: 10 * time.Millisecond, expected: 10},
+		{batchSize: 3, latency: 10 * time.Millisecond, expected: 10},
+		{batchSize: 10, latency: 10 * time.Millisecond, expected: 14},
+		{batchSize: 14, latency: 10 * time.Millisecond, expected: 18},
+		{batchSize: 18, latency: 10 * time.Millisecond, expected: 20},
+		{batchSize: 20, latency: 10 * time.Millisecond, expected: 20},
+		{batchSize: 20, latency: 200 * time.Millisecond, expected: 10},
+		{err: ErrInterrupted, expected: 10},
+		{err: errors.New("connection reset"), expected: 5},
+		{batchSize: 5, latency: time.Second, expected: 2},
+		{batchSize: 2, latency: time.Second, expected: 2},
+	}
+	for i, step := range steps {
+		if step.err != nil {
+			client.adaptBatchSizeToError(step.err)
+		} else {
+			client.adaptBatchSize(step.batchSize, step.latency)
+		}
+		if amount := client.batchLimits().MaxAmountOfBetsOnEachBatch; amount != step.expected {
+			t.Fatalf("step %d: expected batches of %d bets, got %d", i, step.expected, amount)
+		}
+	}
+
+	limits := client.Limits()
+	limits.MaxAmountOfBetsOnEachBatch = 1
+	client.UpdateLimits(limits)
+	if amount := client.batchLimits().MaxAmountOfBetsOnEachBatch; amount != 1 {
+		t.Fatalf("expected the hard limit to bound the batches, got %d", amount)
+	}
+}
+
+func TestStaticBatchingUsesTheLimits(t *testing.T) {
+	client := NewClient(ClientConfig{MaxAmountOfBetsOnEachBatch: 20, MaxKiBPerBatch: 8})
+	client.adaptBatchSize(20, time.Hour)
+	client.adaptBatchSizeToError(errors.New("connection reset"))
+	if amount := client.batchLimits().MaxAmountOfBetsOnEachBatch; amount != 20 {
+		t.Fatalf("expected batches of 20 bets, got %d", amount)
+	}
+}
@@ -1,5 +1,11 @@
 package common
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 const (
 	KiB = 1024
 
@@ -21,8 +27,25 @@ const (
 	// Assumption: a new bet will only be read if there are at least
 	// MAX_BYTES_BET free bytes available in the buffer.
 	MAX_BYTES_BET = KiB / 4
+
+	BIRTHDATE_LAYOUT = "2006-01-02"
+
+	// PROTOCOL_RESERVED_CHARACTERS are the characters the communication protocol
+	// uses as delimiters. Since fields are not escaped when encoded, a bet
+	// containing any of them would corrupt the whole batch message
+	PROTOCOL_RESERVED_CHARACTERS = `"[]{};,`
 )
 
+// InvalidBetError describes why a bet is not valid
+type InvalidBetError struct {
+	Field  string
+	Reason string
+}
+
+func (e *InvalidBetError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
 type Bet struct {
 	Agency    string
 	Number    string
@@ -43,6 +66,57 @@ func NewBet(agency string, firstName string, lastName string, document string, b
 	}
 }
 
+// LengthWhenEncoded Returns the amount of bytes the bet takes once encoded,
+// computed from the length of its fields without encoding it
 func (bet *Bet) LengthWhenEncoded() int {
-	return len(EncodeBet(bet))
+	return EncodedBetLength(bet)
+}
+
+// Validate Checks that every field of the bet can be safely encoded and will
+// be accepted by the server. An *InvalidBetError is returned describing the
+// first invalid field found. Only the validate command checks it: bets are
+// sent as they are read, as they always were
+func (bet *Bet) Validate() error {
+	textFields := []struct {
+		name  string
+		value string
+	}{
+		{"first_name", bet.FirstName},
+		{"last_name", bet.LastName},
+	}
+	for _, field := range textFields {
+		if strings.TrimSpace(field.value) == "" {
+			return &InvalidBetError{Field: field.name, Reason: "empty value"}
+		}
+		if strings.ContainsAny(field.value, PROTOCOL_RESERVED_CHARACTERS) {
+			return &InvalidBetError{Field: field.name, Reason: "contains protocol reserved characters"}
+		}
+	}
+
+	if !isNumeric(bet.Document) {
+		return &InvalidBetError{Field: "document", Reason: "must be numeric"}
+	}
+	if !isNumeric(bet.Number) {
+		return &InvalidBetError{Field: "number", Reason: "must be numeric"}
+	}
+	if _, err := time.Parse(BIRTHDATE_LAYOUT, bet.Birthdate); err != nil {
+		return &InvalidBetError{Field: "birthdate", Reason: "must follow the YYYY-MM-DD format"}
+	}
+
+	if bet.LengthWhenEncoded() > MAX_BYTES_BET {
+		return &InvalidBetError{Field: "bet", Reason: fmt.Sprintf("encoded size exceeds %d bytes", MAX_BYTES_BET)}
+	}
+	return nil
+}
+
+func isNumeric(value string) bool {
+	if value == "" {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return false
+		}
+	}
+	return true
 }
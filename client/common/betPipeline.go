@@ -0,0 +1,345 @@
+package common
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	// PIPELINE_CHUNK_SIZE is the amount of CSV records the reader groups
+	// together before handing them to the workers. Moving chunks instead
+	// of single records keeps channel overhead negligible
+	PIPELINE_CHUNK_SIZE = 128
+
+	DEFAULT_PIPELINE_WORKERS    = 1
+	DEFAULT_PIPELINE_QUEUE_SIZE = 16
+
+	// MAX_KIB_PER_BATCH is the largest batch the server accepts, in KiB
+	MAX_KIB_PER_BATCH = 8
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// recordChunk is a group of consecutive CSV records produced by the reader stage
+type recordChunk struct {
+	sequence int
+	records  [][]string
+	lines    []int
+	err      error
+}
+
+// rejectedBet is a CSV row that is not a valid bet
+type rejectedBet struct {
+	line int
+	err  error
+}
+
+// betChunk is a recordChunk already validated and encoded by a worker. The
+// encoded bets are stored one after the other in encoded, and ends keeps the
+// offset where each of them finishes, so the sender can copy them into the
+// batch frame without encoding them again
+type betChunk struct {
+	sequence int
+	encoded  []byte
+	ends     []int
+	rejected []rejectedBet
+	err      error
+}
+
+func (chunk *betChunk) encodedBet(i int) []byte {
+	start := 0
+	if i > 0 {
+		start = chunk.ends[i-1]
+	}
+	return chunk.encoded[start:chunk.ends[i]]
+}
+
+// betBatchFrame is a BET message being built by the sender stage, along
+// with the limits it was started with, including the amount of bets chosen
+// by adaptive batching, and the bytes it may take, lowered to the credits
+// left when the server limits them
+type betBatchFrame struct {
+	frame    *[]byte
+	size     int
+	limits   Limits
+	maxBytes int
+}
+
+func (batch *betBatchFrame) appendEncodedBet(encodedBet []byte) {
+	if batch.size > 0 {
+		*batch.frame = append(*batch.frame, BET_BATCH_SEPARATOR...)
+	}
+	*batch.frame = append(*batch.frame, encodedBet...)
+	batch.size++
+}
+
+// ============================== PRIVATE - READER STAGE ============================== //
+
+func (client *Client) readRecordChunk(csvReader *csv.Reader, sequence int) (*recordChunk, error) {
+	chunk := &recordChunk{sequence: sequence}
+
+	for len(chunk.records) < PIPELINE_CHUNK_SIZE {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			return chunk, io.EOF
+		} else if err != nil {
+			client.log.Errorf("action: read_bet_from_csv | result: fail | client_id: %v | error: %v", client.config.ID, err)
+			return chunk, NewError(ErrInput, err)
+		}
+
+		line, _ := csvReader.FieldPos(0)
+		chunk.records = append(chunk.records, record)
+		chunk.lines = append(chunk.lines, line)
+	}
+	return chunk, nil
+}
+
+// readerStage reads the agency file and sends its records, grouped in
+// chunks, through recordChunks. Read errors are forwarded as the last chunk
+// so the sender reports them after every previous bet was sent
+func (client *Client) readerStage(csvReader *csv.Reader, recordChunks chan<- *recordChunk, done <-chan struct{}) {
+	defer close(recordChunks)
+
+	for sequence := 0; ; sequence++ {
+		chunk, err := client.readRecordChunk(csvReader, sequence)
+		if err != nil && err != io.EOF {
+			chunk.err = err
+		}
+
+		if len(chunk.records) > 0 || chunk.err != nil {
+			select {
+			case recordChunks <- chunk:
+			case <-done:
+				return
+			}
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				client.log.Debugf("action: no_more_bets_to_read_csv | result: success | client_id: %v", client.config.ID)
+			}
+			return
+		}
+	}
+}
+
+// ============================== PRIVATE - VALIDATE/ENCODE STAGE ============================== //
+
+// validateAndEncodeRecordChunk Builds and encodes the bets of chunk. Bets
+// are only checked with Bet.Validate when rejectInvalidBets is set, which
+// only the validate command does: the bets are sent as they are read
+func (client *Client) validateAndEncodeRecordChunk(chunk *recordChunk, rejectInvalidBets bool) *betChunk {
+	encodedChunk := &betChunk{
+		sequence: chunk.sequence,
+		encoded:  make([]byte, 0, len(chunk.records)*MAX_BYTES_BET/2),
+		ends:     make([]int, 0, len(chunk.records)),
+		err:      chunk.err,
+	}
+
+	for i, record := range chunk.records {
+		bet := NewBet(client.config.ID, record[0], record[1], record[2], record[3], record[4])
+		if rejectInvalidBets {
+			if err := bet.Validate(); err != nil {
+				client.log.Warningf("action: validate_bet | result: fail | client_id: %v | line: %v | error: %v", client.config.ID, chunk.lines[i], err)
+				encodedChunk.rejected = append(encodedChunk.rejected, rejectedBet{line: chunk.lines[i], err: err})
+				continue
+			}
+		}
+
+		client.log.Debugf("action: read_bet_from_csv | result: success | client_id: %v | bet: %v", client.config.ID, client.config.PII.Bet(bet))
+		encodedChunk.encoded = AppendBet(encodedChunk.encoded, bet)
+		encodedChunk.ends = append(encodedChunk.ends, len(encodedChunk.encoded))
+	}
+	return encodedChunk
+}
+
+func (client *Client) validateAndEncodeStage(recordChunks <-chan *recordChunk, betChunks chan<- *betChunk, rejectInvalidBets bool, done <-chan struct{}) {
+	for chunk := range recordChunks {
+		select {
+		case betChunks <- client.validateAndEncodeRecordChunk(chunk, rejectInvalidBets):
+		case <-done:
+			return
+		}
+	}
+}
+
+// ============================== PRIVATE - SENDER STAGE ============================== //
+
+// newBetBatchFrame Starts a batch in a pooled frame. It is returned by value
+// so the sender keeps it on its stack instead of allocating one per frame
+func (client *Client) newBetBatchFrame() betBatchFrame {
+	limits := client.batchLimits()
+	frame := getFrameBuffer(limits.MaxKiBPerBatch * KiB)
+	*frame = append(*frame, BET_MSG_TYPE...)
+	*frame = append(*frame, START_MSG_DELIMITER...)
+	return betBatchFrame{frame: frame, limits: limits, maxBytes: client.credits.Cap(limits.MaxKiBPerBatch * KiB)}
+}
+
+// canHoldAnotherBet keeps the same conservative criteria used since batches
+// were introduced: a new bet is only added if, even being as big as
+// MAX_BYTES_BET, the batch would still fit in MaxKiBPerBatch and in the
+// byte credits left
+func (client *Client) canHoldAnotherBet(batch *betBatchFrame) bool {
+	bytesOnBatch := len(*batch.frame) + len(END_MSG_DELIMITER)
+	return batch.size < batch.limits.MaxAmountOfBetsOnEachBatch &&
+		bytesOnBatch+MAX_BYTES_BET <= batch.maxBytes
+}
+
+// cannotHoldASingleBetError Tells why the empty batch can not hold a bet:
+// the server granted too few byte credits, or the limits are too small
+func (client *Client) cannotHoldASingleBetError(batch *betBatchFrame) error {
+	if batch.maxBytes < batch.limits.MaxKiBPerBatch*KiB {
+		return NewError(ErrProtocol, fmt.Errorf("the server granted %d bytes of credits, fewer than a batch of a single bet needs", batch.maxBytes))
+	}
+	return NewError(ErrConfig, fmt.Errorf("a batch of %d bets and %d KiB cannot hold a single bet", batch.limits.MaxAmountOfBetsOnEachBatch, batch.limits.MaxKiBPerBatch))
+}
+
+func (client *Client) flushBetBatchFrame(batch *betBatchFrame, function func([]byte, int) error) error {
+	defer putFrameBuffer(batch.frame)
+	if batch.size == 0 {
+		return nil
+	}
+
+	*batch.frame = append(*batch.frame, END_MSG_DELIMITER...)
+	if client.log.InfoEnabled() {
+		client.log.Infof("action: read_bet_batch_from_csv | result: success | client_id: %v | bet_batch_size: %v | bytes_on_batch: %v",
+			client.config.ID,
+			batch.size,
+			len(*batch.frame),
+		)
+	}
+
+	if !client.isRunning() {
+		return ErrInterrupted
+	}
+	return function(*batch.frame, batch.size)
+}
+
+// senderStage receives the encoded chunks, restores their original order and
+// packs their bets into batches that are handed to function as soon as they
+// are full. The last, possibly incomplete, batch is handed once every chunk
+// was received
+func (client *Client) senderStage(betChunks <-chan *betChunk, function func([]byte, int) error) error {
+	pendingChunks := map[int]*betChunk{}
+	nextSequence := 0
+
+	batch := client.newBetBatchFrame()
+	for chunk := range betChunks {
+		pendingChunks[chunk.sequence] = chunk
+
+		for {
+			nextChunk, found := pendingChunks[nextSequence]
+			if !found {
+				break
+			}
+			delete(pendingChunks, nextSequence)
+			nextSequence++
+
+			client.config.Observer.BetsRead(len(nextChunk.ends) + len(nextChunk.rejected))
+			for _, rejected := range nextChunk.rejected {
+				client.config.Observer.BetRejected(rejected.line, rejected.err)
+			}
+
+			for i := range nextChunk.ends {
+				if !client.canHoldAnotherBet(&batch) {
+					if batch.size == 0 {
+						putFrameBuffer(batch.frame)
+						return client.cannotHoldASingleBetError(&batch)
+					}
+					if err := client.flushBetBatchFrame(&batch, function); err != nil {
+						return err
+					}
+					batch = client.newBetBatchFrame()
+				}
+
+				batch.appendEncodedBet(nextChunk.encodedBet(i))
+			}
+
+			// The bets read before the error are still sent, as readerStage
+			// promises
+			if nextChunk.err != nil {
+				if err := client.flushBetBatchFrame(&batch, function); err != nil {
+					return err
+				}
+				return nextChunk.err
+			}
+		}
+
+		if !client.isRunning() {
+			putFrameBuffer(batch.frame)
+			return ErrInterrupted
+		}
+	}
+
+	return client.flushBetBatchFrame(&batch, function)
+}
+
+// ============================== PRIVATE - PIPELINE ============================== //
+
+// withEachBetBatchDo Reads the agency file through a staged pipeline: a reader
+// goroutine parses the CSV, a pool of workers builds and encodes the bets
+// and the calling goroutine packs them into batches, in the same order they
+// appear in the file, and hands each one to function. Stages are joined by
+// bounded channels, so a slow connection also slows down reading. Every row
+// read is sent, and the first row that can not be read fails the run once
+// the bets before it were handed to function
+func (client *Client) withEachBetBatchDo(function func([]byte, int) error) error {
+	return client.withEachEncodedBetBatchDo(false, function)
+}
+
+// withEachValidBetBatchDo Runs the pipeline of withEachBetBatchDo, but the
+// bets that do not pass Bet.Validate are reported as rejected instead of
+// being handed to function
+func (client *Client) withEachValidBetBatchDo(function func([]byte, int) error) error {
+	return client.withEachEncodedBetBatchDo(true, function)
+}
+
+func (client *Client) withEachEncodedBetBatchDo(rejectInvalidBets bool, function func([]byte, int) error) error {
+	return client.withCsvReaderDo(func(csvReader *csv.Reader) error {
+		workers := client.config.PipelineWorkers
+		if workers <= 0 {
+			workers = DEFAULT_PIPELINE_WORKERS
+		}
+		queueSize := client.config.PipelineQueueSize
+		if queueSize <= 0 {
+			queueSize = DEFAULT_PIPELINE_QUEUE_SIZE
+		}
+
+		done := make(chan struct{})
+		recordChunks := make(chan *recordChunk, queueSize)
+		betChunks := make(chan *betChunk, queueSize)
+
+		var workersGroup sync.WaitGroup
+		workersGroup.Add(workers)
+		for i := 0; i < workers; i++ {
+			go func() {
+				defer workersGroup.Done()
+				client.validateAndEncodeStage(recordChunks, betChunks, rejectInvalidBets, done)
+			}()
+		}
+
+		var readerGroup sync.WaitGroup
+		readerGroup.Add(1)
+		go func() {
+			defer readerGroup.Done()
+			client.readerStage(csvReader, recordChunks, done)
+		}()
+
+		go func() {
+			workersGroup.Wait()
+			close(betChunks)
+		}()
+
+		err := client.senderStage(betChunks, function)
+
+		// Unblock and wait for the reader before the agency file is closed
+		close(done)
+		readerGroup.Wait()
+		client.log.Debugf("action: bet_pipeline_stop | result: success | client_id: %v", client.config.ID)
+		return err
+	})
+}
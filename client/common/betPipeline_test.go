@@ -0,0 +1,211 @@
+package common
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestAgencyFile(t *testing.T, rows []string) string {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), "agency-1.csv")
+	if err := os.WriteFile(fileName, []byte(strings.Join(rows, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestBetPipelineKeepsFileOrder(t *testing.T) {
+	rows := []string{}
+	for i := 0; i < 10*PIPELINE_CHUNK_SIZE; i++ {
+		rows = append(rows, fmt.Sprintf("Ana,Gomez,%d,1999-03-17,%d", 10000000+i, i))
+	}
+
+	client := NewClient(ClientConfig{
+		ID:                         "1",
+		MaxAmountOfBetsOnEachBatch: 7,
+		MaxKiBPerBatch:             8,
+		AgencyFileName:             writeTestAgencyFile(t, rows),
+		PipelineWorkers:            4,
+		PipelineQueueSize:          2,
+	})
+
+	sentBets := 0
+	err := client.withEachBetBatchDo(func(frame []byte, batchSize int) error {
+		if batchSize > 7 {
+			t.Fatalf("batch of %d bets exceeds the configured limit", batchSize)
+		}
+		for _, encodedBet := range strings.Split(string(frame[len("BET["):len(frame)-1]), BET_BATCH_SEPARATOR) {
+			expected := fmt.Sprintf(`"document":"%d"`, 10000000+sentBets)
+			if !strings.Contains(encodedBet, expected) {
+				t.Fatalf("bet %d out of order: %s", sentBets, encodedBet)
+			}
+			sentBets++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sentBets != 10*PIPELINE_CHUNK_SIZE {
+		t.Fatalf("unexpected amount of sent bets: got %d, want %d", sentBets, 10*PIPELINE_CHUNK_SIZE)
+	}
+}
+
+func TestBetPipelineSendsTheBetsReadBeforeAnError(t *testing.T) {
+	rows := []string{}
+	for i := 0; i < 5; i++ {
+		rows = append(rows, fmt.Sprintf("Ana,Gomez,%d,1999-03-17,%d", 10000000+i, i))
+	}
+	rows = append(rows, `Ana,Go"mez,10000005,1999-03-17,5`)
+
+	client := NewClient(ClientConfig{
+		ID:                         "1",
+		MaxAmountOfBetsOnEachBatch: 20,
+		MaxKiBPerBatch:             8,
+		AgencyFileName:             writeTestAgencyFile(t, rows),
+	})
+
+	sentBets := 0
+	err := client.withEachBetBatchDo(func(frame []byte, batchSize int) error {
+		sentBets += batchSize
+		return nil
+	})
+	if !errors.Is(err, ErrInput) {
+		t.Fatalf("expected an input error, got %v", err)
+	}
+	if sentBets != 5 {
+		t.Fatalf("expected the 5 bets before the error to be sent, got %d", sentBets)
+	}
+}
+
+func TestBetPipelineSendsEveryRowItCanRead(t *testing.T) {
+	client := NewClient(ClientConfig{
+		ID:                         "1",
+		MaxAmountOfBetsOnEachBatch: 20,
+		MaxKiBPerBatch:             8,
+		AgencyFileName: writeTestAgencyFile(t, []string{
+			"Ana,Gomez,10000000,1999-03-17,1",
+			"Ana,Gomez,not-a-document,1999-03-17,2",
+			"Ana,Gomez,10000002",
+			"Ana,Gomez,10000003,1999-03-17,3",
+		}),
+	})
+
+	sentBets := 0
+	err := client.withEachBetBatchDo(func(frame []byte, batchSize int) error {
+		if !strings.Contains(string(frame), `"document":"not-a-document"`) {
+			t.Fatalf("expected the bet with an invalid document to be sent: %s", frame)
+		}
+		sentBets += batchSize
+		return nil
+	})
+	if !errors.Is(err, ErrInput) || !errors.Is(err, csv.ErrFieldCount) {
+		t.Fatalf("expected the row with missing fields to fail the run, got %v", err)
+	}
+	if sentBets != 2 {
+		t.Fatalf("expected the 2 bets before the failing row to be sent, got %d", sentBets)
+	}
+}
+
+func TestBetPipelineFailsWhenABatchCannotHoldABet(t *testing.T) {
+	client := NewClient(ClientConfig{
+		ID:                         "1",
+		MaxAmountOfBetsOnEachBatch: 0,
+		MaxKiBPerBatch:             8,
+		AgencyFileName:             writeTestAgencyFile(t, []string{"Ana,Gomez,10000000,1999-03-17,1"}),
+	})
+
+	err := client.withEachBetBatchDo(func(frame []byte, batchSize int) error {
+		t.Fatalf("unexpected batch of %d bets", batchSize)
+		return nil
+	})
+	if !errors.Is(err, ErrConfig) {
+		t.Fatalf("expected a config error, got %v", err)
+	}
+}
+
+func TestBetBatchFrame(t *testing.T) {
+	client := NewClient(ClientConfig{ID: "1", MaxAmountOfBetsOnEachBatch: 2, MaxKiBPerBatch: 8})
+	batch := client.newBetBatchFrame()
+	batch.appendEncodedBet(AppendBet(nil, NewBet("1", "Ana", "Gomez", "30904465", "1999-03-17", "7574")))
+	batch.appendEncodedBet(AppendBet(nil, NewBet("1", "Juan", "Perez", "12345678", "1980-01-01", "42")))
+
+	expected := `BET[` +
+		`{"agency":"1","first_name":"Ana","last_name":"Gomez","document":"30904465","birthdate":"1999-03-17","number":"7574"};` +
+		`{"agency":"1","first_name":"Juan","last_name":"Perez","document":"12345678","birthdate":"1980-01-01","number":"42"}` +
+		`]`
+	err := client.flushBetBatchFrame(&batch, func(frame []byte, batchSize int) error {
+		if string(frame) != expected || batchSize != 2 {
+			t.Fatalf("unexpected frame of %d bets:\n got: %s\nwant: %s", batchSize, frame, expected)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// BenchmarkAppendBet measures the encoding done by the workers, into a
+// buffer reused across chunks
+func BenchmarkAppendBet(b *testing.B) {
+	bet := newTestBetBatch(1)[0]
+	encoded := make([]byte, 0, MAX_BYTES_BET)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		encoded = AppendBet(encoded[:0], bet)
+	}
+}
+
+// BenchmarkSenderStage measures the path every bet takes once encoded:
+// senderStage packing 8 chunks of PIPELINE_CHUNK_SIZE bets into pooled
+// frames and writing each one with sendFrame, signed or not. Allocations
+// per op are per run, not per bet
+func BenchmarkSenderStage(b *testing.B) {
+	chunks := []*betChunk{}
+	for sequence := 0; sequence < 8; sequence++ {
+		chunk := &betChunk{sequence: sequence}
+		for _, bet := range newTestBetBatch(PIPELINE_CHUNK_SIZE) {
+			chunk.encoded = AppendBet(chunk.encoded, bet)
+			chunk.ends = append(chunk.ends, len(chunk.encoded))
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	for _, signed := range []bool{false, true} {
+		config := ClientConfig{ID: "1", MaxAmountOfBetsOnEachBatch: 64, MaxKiBPerBatch: MAX_KIB_PER_BATCH}
+		name := "unsigned"
+		if signed {
+			config.Signer = NewMessageSigner("1", []byte("secret"), 0)
+			name = "signed"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			client := NewClient(config)
+			client.writer = bufio.NewWriter(io.Discard)
+			send := func(frame []byte, batchSize int) error {
+				return client.sendFrame(frame)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				betChunks := make(chan *betChunk, len(chunks))
+				for _, chunk := range chunks {
+					betChunks <- chunk
+				}
+				close(betChunks)
+				if err := client.senderStage(betChunks, send); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package common
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/csv"
 	"errors"
 	"fmt"
@@ -9,13 +10,12 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
-
-	"github.com/op/go-logging"
+	"time"
 )
 
-var log = logging.MustGetLogger("log")
-
 // ============================== CONSTANTS ============================== //
 
 const (
@@ -32,129 +32,489 @@ type ClientConfig struct {
 	MaxAmountOfBetsOnEachBatch int
 	MaxKiBPerBatch             int
 	AgencyFileName             string
+	PipelineWorkers            int
+	PipelineQueueSize          int
+
+	// AckTimeout bounds how long the client waits for the acknowledgement
+	// of each message. Zero means waiting forever
+	AckTimeout time.Duration
+
+	// Connect tells how connections to the server are opened and retried
+	Connect ConnectPolicy
+
+	// Winners tells how the client waits for the draw to get its winners
+	Winners WinnersPolicy
+
+	// AdaptiveBatching sizes the batches by the latency of their ACKs,
+	// within MaxAmountOfBetsOnEachBatch and MaxKiBPerBatch. When its
+	// TargetLatency is zero, every batch is as big as those limits allow
+	AdaptiveBatching AdaptiveBatching
+
+	// Heartbeat tells how the client checks that the server is still there
+	// while the connection is idle
+	Heartbeat HeartbeatPolicy
+
+	// Dial opens the connection to ServerAddress. When nil, a net.Dialer
+	// with the TCP keepalive of the ConnectPolicy is used
+	Dial func(network string, address string) (net.Conn, error)
+
+	// TLS secures the connection to the server. When nil, plain TCP is used
+	TLS *tls.Config
+
+	// RateLimiter throttles the bet batches sent. It can be shared by many
+	// clients so they respect the same limits together. When nil, batches
+	// are sent as fast as the server acknowledges them
+	RateLimiter *RateLimiter
+
+	// Signer signs every message sent and verifies every message received.
+	// When nil, messages are neither signed nor verified
+	Signer *MessageSigner
+
+	// OpenAgencyFile opens the source of the bets to send. When nil, the
+	// file named AgencyFileName is opened
+	OpenAgencyFile func() (io.ReadCloser, error)
+
+	// PII tells how the personal data of bettors is shown in the logs.
+	// When empty, DEFAULT_PII_POLICY is used
+	PII PIIPolicy
+
+	// Logger receives the log events of the client. When nil, events are
+	// discarded
+	Logger Logger
+
+	// Observer is notified of the client events. When nil, events are ignored
+	Observer Observer
 }
 
 type Client struct {
-	config        ClientConfig
-	conn          net.Conn
-	clientRunning bool
+	config   ClientConfig
+	log      Logger
+	conn     net.Conn
+	writer   *bufio.Writer
+	reader   *bufio.Reader
+	connLock sync.Mutex
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	// writeLock serializes the frames written by the goroutine driving the
+	// client and by the one sending the heartbeats
+	writeLock sync.Mutex
+
+	// heartbeats sends the PNG messages of the current connection, if any.
+	// unansweredPings, lastPongAt and peerDead are shared with it, so they
+	// are only accessed atomically. lastPongAt is the UnixNano time of the
+	// last PON received, or of the start of the heartbeats
+	heartbeats      *heartbeats
+	unansweredPings int32
+	lastPongAt      int64
+	peerDead        int32
+
+	// readToken is held by whoever reads the connection: the goroutine
+	// driving the client or, while it is not reading, the heartbeats taking
+	// the PON messages that already arrived. It guards the reader,
+	// partialMessage and receivedMessages
+	readToken chan struct{}
+
+	// partialMessage is the start of a message cut by a read deadline, and
+	// receivedMessages the ones the heartbeats read for receiveMessage
+	partialMessage   string
+	receivedMessages []receivedMessage
+
+	// readDeadline is the deadline of the reads of the goroutine driving
+	// the client. Zero means waiting forever
+	readDeadline time.Time
+
+	// waitingWinnersSince is the UnixNano time the client subscribed to the
+	// draw, or zero if it is not subscribed. It is accessed atomically
+	waitingWinnersSince int64
+
+	// jitterOnce makes only the first connection wait the startup jitter
+	jitterOnce sync.Once
+
+	// limits holds the current Limits of the client
+	limits atomic.Value
+
+	// batchAmount is the amount of bets on each batch chosen by adaptive
+	// batching. Only the goroutine sending the batches uses it
+	batchAmount int
+
+	// credits are the credits the server granted on the current connection.
+	// Only the goroutine sending the messages uses them
+	credits CreditWindow
 }
 
 // ============================== BUILDER ============================== //
 
 func NewClient(config ClientConfig) *Client {
-	client := &Client{config: config, clientRunning: false}
+	if config.Observer == nil {
+		config.Observer = NopObserver{}
+	}
+	if config.PII == "" {
+		config.PII = DEFAULT_PII_POLICY
+	}
+	if config.Logger == nil {
+		config.Logger = NopLogger{}
+	}
+	client := &Client{config: config, log: config.Logger, stopped: make(chan struct{}), readToken: make(chan struct{}, 1)}
+	client.readToken <- struct{}{}
+	client.limits.Store(Limits{
+		MaxAmountOfBetsOnEachBatch: config.MaxAmountOfBetsOnEachBatch,
+		MaxKiBPerBatch:             config.MaxKiBPerBatch,
+		AckTimeout:                 config.AckTimeout,
+		AdaptiveBatching:           config.AdaptiveBatching,
+	})
 	return client
 }
 
-// ============================== PRIVATE - SIGNAL HANDLER ============================== //
+// ============================== PRIVATE - ACCESSING ============================== //
 
 func (client *Client) isRunning() bool {
-	return client.clientRunning
+	select {
+	case <-client.stopped:
+		return false
+	default:
+		return true
+	}
 }
 
 // ============================== PRIVATE - SIGNAL HANDLER ============================== //
 
+// stop Marks the client as stopped and closes its connection, so any read
+// or write blocked on it returns immediately
+func (client *Client) stop() {
+	client.stopOnce.Do(func() {
+		close(client.stopped)
+		client.config.Observer.Stopped()
+
+		client.connLock.Lock()
+		if client.conn != nil {
+			client.conn.Close()
+			client.log.Debugf("action: stop_client_connection_close | result: success | client_id: %v", client.config.ID)
+		}
+		client.connLock.Unlock()
+	})
+}
+
 func (client *Client) sigtermSignalHandler() {
-	log.Infof("action: sigterm_signal_handler | result: in_progress | client_id: %v", client.config.ID)
+	client.log.Infof("action: sigterm_signal_handler | result: in_progress | client_id: %v", client.config.ID)
 
-	client.clientRunning = false
+	client.stop()
 
-	if client.conn != nil {
-		client.conn.Close()
-		client.conn = nil
-		log.Debugf("action: sigterm_client_connection_close | result: success | client_id: %v", client.config.ID)
-	}
+	client.log.Infof("action: sigterm_signal_handler | result: success | client_id: %v", client.config.ID)
+}
+
+// listenForSigterm Runs sigtermSignalHandler on a background goroutine as soon
+// as a SIGTERM is received. The returned function stops listening
+func (client *Client) listenForSigterm() func() {
+	signalReceiver := make(chan os.Signal, 1)
+	signal.Notify(signalReceiver, syscall.SIGTERM)
+
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-signalReceiver:
+			client.sigtermSignalHandler()
+		case <-finished:
+		}
+	}()
 
-	log.Infof("action: sigterm_signal_handler | result: success | client_id: %v", client.config.ID)
+	return func() {
+		signal.Stop(signalReceiver)
+		close(finished)
+		client.log.Debugf("action: signal_channel_close | result: success | client_id: %v", client.config.ID)
+	}
 }
 
-func (client *Client) whenNoSigtermReceivedDo(signalReceiver chan os.Signal, function func() error) error {
+// whenNoSigtermReceivedDo Runs function only if the client was not stopped.
+// Errors caused by the connection being closed by the signal handler are
+// reported as ErrInterrupted, so a client stopped before finishing is not
+// mistaken for a successful one
+func (client *Client) whenNoSigtermReceivedDo(function func() error) error {
 	if !client.isRunning() {
-		return nil
+		return ErrInterrupted
 	}
 
-	select {
-	case <-signalReceiver:
-		client.sigtermSignalHandler()
-		return nil
-	default:
-		return function()
+	err := function()
+	if err != nil && !client.isRunning() {
+		client.log.Infof("action: interrupted_by_sigterm | result: success | client_id: %v | error: %v", client.config.ID, err)
+		if errors.Is(err, ErrInterrupted) {
+			return err
+		}
+		return &Error{Kind: ErrInterrupted, Err: err}
 	}
+	return err
 }
 
 // ============================== PRIVATE - CREATE CLIENT CONNECTION ============================== //
 
-// CreateClientSocket Initializes client socket. In case of
-// failure, error is printed in stdout/stderr and exit 1
-// is returned
-func (client *Client) createClientSocket() {
-	conn, err := net.Dial("tcp", client.config.ServerAddress)
+// openClientSocket Dials the server and, if configured, completes the TLS
+// handshake and the admission handshake
+func (client *Client) openClientSocket() error {
+	dial := client.config.Dial
+	if dial == nil {
+		dial = client.config.Connect.dialer().Dial
+	}
+
+	conn, err := dial("tcp", client.config.ServerAddress)
+	if err == nil && client.config.TLS != nil {
+		conn, err = tlsHandshake(conn, client.config.TLS, client.tlsHandshakeTimeout())
+	}
 	if err != nil {
-		log.Fatalf("action: connect | result: fail | client_id: %v | error: %v", client.config.ID, err)
+		return NewError(ErrConnect, err)
 	}
+	client.connLock.Lock()
 	client.conn = conn
-	log.Debugf("action: connect | result: success | client_id: %v | server_address: %v", client.config.ID, client.config.ServerAddress)
+	client.connLock.Unlock()
+	client.writer = bufio.NewWriterSize(conn, client.config.MaxKiBPerBatch*KiB)
+	client.reader = bufio.NewReader(conn)
+	client.credits = CreditWindow{}
+	client.partialMessage = ""
+	client.receivedMessages = nil
+	atomic.StoreInt32(&client.unansweredPings, 0)
+	atomic.StoreInt32(&client.peerDead, 0)
+
+	if client.config.Connect.Handshake || client.config.Connect.Credits {
+		if err := client.handshake(); err != nil {
+			client.closeClientSocket()
+			return err
+		}
+	}
+	client.startHeartbeats(client.config.Heartbeat.Interval)
+	return nil
 }
 
-func (client *Client) withNewClientSocketDo(function func() error) error {
-	client.createClientSocket()
-	defer func() {
+// CreateClientSocket Initializes client socket, after the startup jitter
+// and retrying as the ConnectPolicy allows. In case of failure, the error
+// is logged and returned
+func (client *Client) createClientSocket() error {
+	err := client.waitStartupJitter()
+	if err == nil {
+		err = client.connectWithRetries(client.openClientSocket)
+	}
+	if err != nil {
+		client.log.Errorf("action: connect | result: fail | client_id: %v | error: %v", client.config.ID, err)
+		return err
+	}
+	client.config.Observer.Connected()
+	client.log.Debugf("action: connect | result: success | client_id: %v | server_address: %v | tls: %v", client.config.ID, client.config.ServerAddress, client.config.TLS != nil)
+	return nil
+}
+
+// closeClientSocket Closes the connection, then waits for its heartbeats to
+// stop, which a blocked write can no longer delay
+func (client *Client) closeClientSocket() {
+	client.connLock.Lock()
+	if client.conn != nil {
 		client.conn.Close()
 		client.conn = nil
-		log.Debugf("action: client_connection_close | result: success | client_id: %v", client.config.ID)
-	}()
+		client.log.Debugf("action: client_connection_close | result: success | client_id: %v", client.config.ID)
+	}
+	client.connLock.Unlock()
+
+	client.stopHeartbeats()
+}
+
+func (client *Client) withNewClientSocketDo(function func() error) error {
+	if err := client.createClientSocket(); err != nil {
+		return err
+	}
+	defer client.closeClientSocket()
 	return function()
 }
 
 // ============================== PRIVATE - SEND/RECEIVE MESSAGES ============================== //
 
+// sendMessage Sends an encoded message, copied into a pooled frame so
+// sending it does not allocate
 func (client *Client) sendMessage(message string) error {
-	log.Debugf("action: send_message | result: in_progress | client_id: %v | msg: %v", client.config.ID, message)
+	frame := getFrameBuffer(len(message))
+	defer putFrameBuffer(frame)
+
+	*frame = append(*frame, message...)
+	return client.sendFrame(*frame)
+}
 
-	writer := bufio.NewWriter(client.conn)
-	_, err := writer.WriteString(message)
+// sendFrame Writes an already encoded frame to the connection writer and
+// flushes it, signing it first if a Signer is configured. The frame is only
+// converted to a string for logging when debug logging is enabled, so the
+// hot path does not allocate. Frames are signed and written one at a time,
+// so the heartbeats are never interleaved with them
+func (client *Client) sendFrame(frame []byte) error {
+	client.writeLock.Lock()
+	defer client.writeLock.Unlock()
+
+	if client.config.Signer != nil {
+		signedFrame := getFrameBuffer(len(frame) + KiB/4)
+		defer putFrameBuffer(signedFrame)
+
+		var err error
+		*signedFrame, err = client.config.Signer.AppendSigned(*signedFrame, frame)
+		if err != nil {
+			client.log.Errorf("action: sign_message | result: fail | client_id: %v | error: %v", client.config.ID, err)
+			return NewError(ErrProtocol, err)
+		}
+		frame = *signedFrame
+	}
+
+	debugEnabled := client.log.DebugEnabled()
+	if debugEnabled {
+		client.log.Debugf("action: send_message | result: in_progress | client_id: %v | msg: %v", client.config.ID, client.config.PII.Message(frame))
+	}
+
+	_, err := client.writer.Write(frame)
 	if err != nil {
-		log.Errorf("action: send_message | result: fail | client_id: %v | error: %v", client.config.ID, err)
-		return err
+		client.log.Errorf("action: send_message | result: fail | client_id: %v | error: %v", client.config.ID, err)
+		return client.connectionError(err)
 	}
 
-	err = writer.Flush()
+	err = client.writer.Flush()
 	if err != nil {
-		log.Errorf("action: flush_message | result: fail | client_id: %v | error: %v", client.config.ID, err)
+		client.log.Errorf("action: flush_message | result: fail | client_id: %v | error: %v", client.config.ID, err)
+		return client.connectionError(err)
 	}
 
-	log.Debugf("action: send_message | result: success | client_id: %v | msg: %v", client.config.ID, message)
+	if debugEnabled {
+		client.log.Debugf("action: send_message | result: success | client_id: %v | msg: %v", client.config.ID, client.config.PII.Message(frame))
+	}
 	return nil
 }
 
+// receiveMessage Receives the next message within the readDeadline. The
+// messages the heartbeats read while the client was not reading are
+// received first, in the order they arrived
 func (client *Client) receiveMessage() (string, error) {
-	log.Debugf("action: receive_message | result: in_progress | client_id: %v", client.config.ID)
+	client.log.Debugf("action: receive_message | result: in_progress | client_id: %v", client.config.ID)
 
-	reader := bufio.NewReader(client.conn)
-	msg, err := reader.ReadString(END_MSG_DELIMITER[0])
+	<-client.readToken
+	msg, err := client.nextMessage()
+	client.readToken <- struct{}{}
 	if err != nil {
-		log.Errorf("action: receive_message | result: fail | client_id: %v | error: %v", client.config.ID, err)
+		client.log.Errorf("action: receive_message | result: fail | client_id: %v | error: %v", client.config.ID, err)
 		return "", err
 	}
+	return msg, nil
+}
+
+// nextMessage Returns the first message the heartbeats read or, if there is
+// none, reads one. It must be called holding the readToken
+func (client *Client) nextMessage() (string, error) {
+	if len(client.receivedMessages) > 0 {
+		received := client.receivedMessages[0]
+		client.receivedMessages = client.receivedMessages[1:]
+		return received.message, received.err
+	}
+
+	if err := client.conn.SetReadDeadline(client.readDeadline); err != nil {
+		return "", client.connectionError(err)
+	}
+	return client.readMessage()
+}
+
+// readMessage Reads a message from the connection and verifies its
+// signature if a Signer is configured. A message cut by a read deadline is
+// kept, so the following read completes it. It must be called holding the
+// readToken
+func (client *Client) readMessage() (string, error) {
+	msg, err := client.reader.ReadString(END_MSG_DELIMITER[0])
+	msg = client.partialMessage + msg
+	client.partialMessage = ""
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			client.partialMessage = msg
+		}
+		return "", client.connectionError(err)
+	}
+
+	client.log.Debugf("action: receive_message | result: success | client_id: %v | msg: %v", client.config.ID, client.config.PII.Message([]byte(msg)))
 
-	log.Debugf("action: receive_message | result: success | client_id: %v | msg: %v", client.config.ID, msg)
+	if client.config.Signer != nil {
+		msg, err = client.config.Signer.Verify(msg)
+		if err != nil {
+			client.log.Errorf("action: verify_message_signature | result: fail | client_id: %v | error: %v", client.config.ID, err)
+			return "", NewError(ErrProtocol, err)
+		}
+	}
 	return msg, nil
 }
 
+// receiveReply Receives messages with receive until one that is not a
+// control message arrives. PON messages answer the heartbeats, and the
+// credits of every CRD, and of the reply itself if it is an ACK carrying
+// them, are granted. The reply is returned without the credits, so it can
+// be compared with the expected ACK
+func (client *Client) receiveReply(receive func() (string, error)) (string, error) {
+	for {
+		receivedMessage, err := receive()
+		if err != nil {
+			return "", err
+		}
+
+		messageType, _ := DecodeMessageType(receivedMessage)
+		switch {
+		case messageType == PONG_MSG_TYPE:
+			client.pongReceived()
+		case messageType == CREDIT_MSG_TYPE && client.credits.Limited():
+			credits, err := DecodeCreditMessage(receivedMessage)
+			if err != nil {
+				return "", NewError(ErrProtocol, err)
+			}
+			client.grantCredits(credits)
+		case messageType == ACK_MSG_TYPE && client.credits.Limited():
+			ackMessage, credits, granted, err := DecodeAckCredits(receivedMessage)
+			if err != nil {
+				return "", NewError(ErrProtocol, err)
+			}
+			if granted {
+				client.grantCredits(credits)
+			}
+			return ackMessage, nil
+		default:
+			return receivedMessage, nil
+		}
+	}
+}
+
+// receiveAckMessage Receives the reply to a message, failing if it does not
+// arrive within the current AckTimeout
+func (client *Client) receiveAckMessage() (string, error) {
+	return client.receiveReply(client.receiveMessageWithinAckTimeout)
+}
+
+// receiveMessageWithinAckTimeout Receives a message, failing if it does not
+// arrive within the current AckTimeout
+func (client *Client) receiveMessageWithinAckTimeout() (string, error) {
+	ackTimeout := client.currentLimits().AckTimeout
+	if ackTimeout <= 0 {
+		return client.receiveMessage()
+	}
+
+	client.readDeadline = time.Now().Add(ackTimeout)
+	defer func() { client.readDeadline = time.Time{} }()
+
+	return client.receiveMessage()
+}
+
 // ============================= PRIVATE - READ BETS FROM CSV ============================== //
 
+func (client *Client) openAgencyFile() (io.ReadCloser, error) {
+	if client.config.OpenAgencyFile != nil {
+		return client.config.OpenAgencyFile()
+	}
+	return os.Open(client.config.AgencyFileName)
+}
+
 func (client *Client) withCsvReaderDo(function func(*csv.Reader) error) error {
-	file, err := os.Open(client.config.AgencyFileName)
+	file, err := client.openAgencyFile()
 	if err != nil {
-		log.Errorf("action: agency_file_open | result: fail | client_id: %v | error: %v", client.config.ID, err)
-		return err
+		client.log.Errorf("action: agency_file_open | result: fail | client_id: %v | error: %v", client.config.ID, err)
+		return NewError(ErrInput, err)
 	}
 	defer func() {
 		file.Close()
-		log.Debugf("action: agency_file_close | result: success | client_id: %v", client.config.ID)
+		client.log.Debugf("action: agency_file_close | result: success | client_id: %v", client.config.ID)
 	}()
-	log.Debugf("action: agency_file_open | result: success | client_id: %v", client.config.ID)
+	client.log.Debugf("action: agency_file_open | result: success | client_id: %v", client.config.ID)
 
 	csvReader := csv.NewReader(file)
 	csvReader.Comma = CSV_FIELD_DELIMITER
@@ -163,133 +523,79 @@ func (client *Client) withCsvReaderDo(function func(*csv.Reader) error) error {
 	return function(csvReader)
 }
 
-func (client *Client) readBetFromCsvUsing(csvReader *csv.Reader) (*Bet, error) {
-	betRecord, err := csvReader.Read()
-	if err != nil && err != io.EOF {
-		log.Errorf("action: read_bet_from_csv | result: fail | client_id: %v | error: %v", client.config.ID, err)
-		return nil, err
-	} else if err == io.EOF {
-		log.Debugf("action: no_more_bets_to_read_csv | result: success | client_id: %v", client.config.ID)
-		return nil, err
-	}
-
-	agency := client.config.ID
-	firstName := betRecord[0]
-	lastName := betRecord[1]
-	document := betRecord[2]
-	birthdate := betRecord[3]
-	number := betRecord[4]
-
-	log.Debugf("action: read_bet_from_csv | result: success | client_id: %v | bet: %v", client.config.ID, betRecord)
-	return NewBet(
-		agency,
-		firstName,
-		lastName,
-		document,
-		birthdate,
-		number,
-	), nil
-}
-
-func (client *Client) readBetBatchFromCsvUsing(csvReader *csv.Reader) ([]*Bet, error) {
-	log.Infof("action: read_bet_batch_from_csv | result: in_progress | client_id: %v", client.config.ID)
-
-	betBatch := []*Bet{}
-	amountOfReadBytesOnBatch := 0
-	amountOfReadBytesOnBatch += len(BET_MSG_TYPE) + len(START_MSG_DELIMITER) + len(END_MSG_DELIMITER)
-
-	for len(betBatch) < client.config.MaxAmountOfBetsOnEachBatch && amountOfReadBytesOnBatch+MAX_BYTES_BET <= client.config.MaxKiBPerBatch*KiB {
-		bet, err := client.readBetFromCsvUsing(csvReader)
-		if err != nil && err != io.EOF {
-			log.Errorf("action: read_bet_batch_from_csv | result: fail | client_id: %v | error: %v", client.config.ID, err)
-			return nil, err
-		} else if err == io.EOF {
-			log.Infof("action: no_more_bet_batchs_to_read_csv | result: success | client_id: %v | bet_batch_size: %v | bytes_on_batch: %v",
-				client.config.ID,
-				len(betBatch),
-				amountOfReadBytesOnBatch,
-			)
-			return betBatch, err
-		}
-
-		betBatch = append(betBatch, bet)
-		amountOfReadBytesOnBatch += bet.LengthWhenEncoded() + 1
-	}
-
-	log.Infof("action: read_bet_batch_from_csv | result: success | client_id: %v | bet_batch_size: %v | bytes_on_batch: %v",
-		client.config.ID,
-		len(betBatch),
-		amountOfReadBytesOnBatch,
-	)
-	return betBatch, nil
-}
-
-func (client *Client) whileConditionWithEachBetBatchDo(condition func() bool, function func([]*Bet) error) error {
-	return client.withCsvReaderDo(func(csvReader *csv.Reader) error {
-		for condition() {
-			betBatch, err := client.readBetBatchFromCsvUsing(csvReader)
-			if err != nil && err != io.EOF {
-				return err
-			} else if err == io.EOF {
-				if len(betBatch) == 0 {
-					return nil
-				}
-				return function(betBatch)
-			}
-
-			if err = function(betBatch); err != nil {
-				return err
-			}
-		}
-		return nil
-	})
-}
-
 // ============================= PRIVATE - SEND BET BATCHS ============================== //
 
-func (client *Client) sendBetBatchMessage(betBatch []*Bet) error {
-	log.Debugf("action: send_bet_batch_message | result: in_progress | client_id: %v", client.config.ID)
+func (client *Client) sendBetBatchMessage(betBatchFrame []byte, batchSize int) error {
+	client.log.Debugf("action: send_bet_batch_message | result: in_progress | client_id: %v", client.config.ID)
 
-	messageToSend := EncodeBetBatchMessage(betBatch)
-	err := client.sendMessage(messageToSend)
+	sentAt := time.Now()
+	err := client.sendFrame(betBatchFrame)
 	if err != nil {
 		return err
 	}
 
-	receivedMessage, err := client.receiveMessage()
+	receivedMessage, err := client.receiveAckMessage()
 	if err != nil {
 		return err
 	}
+	latency := time.Since(sentAt)
 
-	batchSize := len(betBatch)
 	expectedMessage := EncodeAckMessage(fmt.Sprintf("%d", batchSize))
 	if receivedMessage != expectedMessage {
-		log.Errorf("action: ack_verification | result: fail | client_id: %v | expected: %v | received: %v",
+		client.log.Errorf("action: ack_verification | result: fail | client_id: %v | expected: %v | received: %v",
 			client.config.ID,
 			expectedMessage,
 			receivedMessage,
 		)
-		return errors.New("bad ack message, bet batch not correctly processed by server")
+		client.config.Observer.AckMismatch(expectedMessage, receivedMessage)
+		return &AckMismatchError{Expected: expectedMessage, Received: receivedMessage}
 	}
+	client.config.Observer.BetBatchAcknowledged(batchSize, len(betBatchFrame), latency)
+	client.adaptBatchSize(batchSize, latency)
 
-	log.Debugf("action: send_bet_batch_message | result: success | client_id: %v | bet_batch_size: %v", client.config.ID, batchSize)
+	client.log.Debugf("action: send_bet_batch_message | result: success | client_id: %v | bet_batch_size: %v", client.config.ID, batchSize)
 	return nil
 }
 
-func (client *Client) sendAllBetsUsingBetBatchs(signalReceiver chan os.Signal) error {
-	log.Infof("action: send_all_bets_using_bet_batchs | result: in_progress | client_id: %v", client.config.ID)
+// sendThrottledBetBatchMessage Waits until the server granted the credits
+// and the RateLimiter allows sending the batch, then sends it. Failed
+// batches shrink the following ones when adaptive batching is enabled
+func (client *Client) sendThrottledBetBatchMessage(betBatchFrame []byte, batchSize int) error {
+	if err := client.waitForCredits(len(betBatchFrame)); err != nil {
+		return err
+	}
+	if client.config.RateLimiter != nil {
+		waited, err := client.config.RateLimiter.Wait(batchSize, len(betBatchFrame), client.stopped)
+		if err != nil {
+			return err
+		}
+		if waited > 0 {
+			client.log.Debugf("action: rate_limit | result: success | client_id: %v | bet_batch_size: %v | waited: %v", client.config.ID, batchSize, waited)
+			client.config.Observer.Throttled(waited)
+		}
+	}
+	if err := client.sendBetBatchMessage(betBatchFrame, batchSize); err != nil {
+		client.adaptBatchSizeToError(err)
+		return err
+	}
+	return nil
+}
 
-	err := client.whileConditionWithEachBetBatchDo(
-		client.isRunning,
-		func(betBatch []*Bet) error {
-			return client.whenNoSigtermReceivedDo(signalReceiver, func() error { return client.sendBetBatchMessage(betBatch) })
-		})
+func (client *Client) sendAllBetsUsingBetBatchs() error {
+	client.log.Infof("action: send_all_bets_using_bet_batchs | result: in_progress | client_id: %v", client.config.ID)
+
+	client.config.Observer.StateChanged(STATE_SENDING)
+	defer client.config.Observer.StateChanged(STATE_IDLE)
+
+	err := client.whenNoSigtermReceivedDo(func() error {
+		return client.withEachBetBatchDo(client.sendThrottledBetBatchMessage)
+	})
 	if err != nil {
-		log.Errorf("action: send_all_bets_using_bet_batchs | result: fail | client_id: %v", client.config.ID)
+		client.log.Errorf("action: send_all_bets_using_bet_batchs | result: fail | client_id: %v", client.config.ID)
 		return err
 	}
 
-	log.Infof("action: send_all_bets_using_bet_batchs | result: success | client_id: %v", client.config.ID)
+	client.log.Infof("action: send_all_bets_using_bet_batchs | result: success | client_id: %v", client.config.ID)
 	return nil
 }
 
@@ -302,94 +608,159 @@ func (client *Client) sendNoMoreBetsMessage() error {
 		return err
 	}
 
-	receivedMessage, err := client.receiveMessage()
+	receivedMessage, err := client.receiveAckMessage()
 	if err != nil {
 		return err
 	}
 
 	expectedMessage := EncodeAckMessage(NO_MORE_BETS_MSG_TYPE)
 	if receivedMessage != expectedMessage {
-		log.Errorf("action: ack_verification | result: fail | client_id: %v | expected: %v | received: %v",
+		client.log.Errorf("action: ack_verification | result: fail | client_id: %v | expected: %v | received: %v",
 			client.config.ID,
 			expectedMessage,
 			receivedMessage,
 		)
-		return errors.New("bad ack message, no more bets message not correctly processed by server")
+		client.config.Observer.AckMismatch(expectedMessage, receivedMessage)
+		return &AckMismatchError{Expected: expectedMessage, Received: receivedMessage}
 	}
 	return nil
 }
 
-func (client *Client) notifyNoMoreBets(signalReceiver chan os.Signal) error {
-	return client.whenNoSigtermReceivedDo(signalReceiver, func() error {
-		log.Infof("action: send_no_more_bets_message | result: in_progress | client_id: %v", client.config.ID)
+func (client *Client) notifyNoMoreBets() error {
+	return client.whenNoSigtermReceivedDo(func() error {
+		client.log.Infof("action: send_no_more_bets_message | result: in_progress | client_id: %v", client.config.ID)
 
 		err := client.sendNoMoreBetsMessage()
 		if err != nil {
-			log.Errorf("action: send_no_more_bets_message | result: fail | client_id: %v", client.config.ID)
+			client.log.Errorf("action: send_no_more_bets_message | result: fail | client_id: %v", client.config.ID)
 			return err
 		}
 
-		log.Infof("action: send_no_more_bets_message | result: success | client_id: %v", client.config.ID)
+		client.log.Infof("action: send_no_more_bets_message | result: success | client_id: %v", client.config.ID)
 		return nil
 	})
 }
 
 // ============================= PRIVATE - QUERY FOR WINNERS ============================== //
 
-func (client *Client) sendAskForWinnersMessage() ([]string, error) {
+// sendAskForWinnersMessage Asks for the winners once and returns the reply,
+// either WIN or, if the draw was not held yet, WIT
+func (client *Client) sendAskForWinnersMessage() (string, error) {
 	messageToSend := EncodeAskForWinnersMessage(client.config.ID)
 	err := client.sendMessage(messageToSend)
 	if err != nil {
-		return nil, err
-	}
-
-	receivedMessage, err := client.receiveMessage()
-	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	return DecodeWinnersMessage(receivedMessage)
+	return client.receiveReply(client.receiveMessage)
 }
 
-func (client *Client) askForWinners(signalReceiver chan os.Signal) error {
-	return client.whenNoSigtermReceivedDo(signalReceiver, func() error {
-		log.Infof("action: ask_for_winners | result: in_progress | client_id: %v", client.config.ID)
+func (client *Client) askForWinners() ([]string, error) {
+	client.config.Observer.StateChanged(STATE_WAITING_WINNERS)
+	defer client.config.Observer.StateChanged(STATE_IDLE)
+
+	var winners []string
+	err := client.whenNoSigtermReceivedDo(func() error {
+		client.log.Infof("action: ask_for_winners | result: in_progress | client_id: %v", client.config.ID)
 
-		winners, err := client.sendAskForWinnersMessage()
+		askedAt := time.Now()
+		receivedWinners, err := client.waitForWinners()
 		if err != nil {
-			log.Errorf("action: ask_for_winners | result: fail | client_id: %v", client.config.ID)
+			client.log.Errorf("action: ask_for_winners | result: fail | client_id: %v", client.config.ID)
 			return err
 		}
-		log.Infof("action: consulta_ganadores | result: success | cant_ganadores: %v", len(winners))
+		winners = receivedWinners
+		client.config.Observer.WinnersReceived(len(winners), time.Since(askedAt))
+		client.log.Infof("action: consulta_ganadores | result: success | cant_ganadores: %v", len(winners))
 
-		log.Infof("action: ask_for_winners | result: success | client_id: %v", client.config.ID)
+		client.log.Infof("action: ask_for_winners | result: success | client_id: %v", client.config.ID)
 		return nil
 	})
+	return winners, err
 }
 
 // ============================== PUBLIC ============================== //
 
-func (client *Client) SendAllBetsToNationalLotteryHeadquartersThenAskForWinners() error {
-	client.clientRunning = true
+// Connect Opens the connection to the server used by every other step
+func (client *Client) Connect() error {
+	return client.createClientSocket()
+}
 
-	signalReceiver := make(chan os.Signal, 1)
-	defer func() {
-		close(signalReceiver)
-		log.Debugf("action: signal_channel_close | result: success | client_id: %v", client.config.ID)
-	}()
-	signal.Notify(signalReceiver, syscall.SIGTERM)
+// Disconnect Closes the connection to the server, if open
+func (client *Client) Disconnect() {
+	client.closeClientSocket()
+}
+
+// Stop Gracefully stops the client: the step in progress is interrupted and
+// the following ones are skipped. It is safe to call it from any goroutine
+func (client *Client) Stop() {
+	client.stop()
+}
+
+// SendAllBets Sends every bet of the agency file in batches, waiting for the
+// acknowledgement of each one before sending the next
+func (client *Client) SendAllBets() error {
+	return client.sendAllBetsUsingBetBatchs()
+}
+
+// NotifyNoMoreBets Tells the server that this agency has no more bets to send
+func (client *Client) NotifyNoMoreBets() error {
+	return client.notifyNoMoreBets()
+}
+
+// AskForWinners Asks the server for the documents of the agency winners. The
+// call blocks until every agency notified it has no more bets, or the
+// Winners MaxWait passed
+func (client *Client) AskForWinners() ([]string, error) {
+	return client.askForWinners()
+}
+
+// ValidateBets Reads the agency file through the same pipeline used to send
+// it, without connecting to the server, and returns the amount of valid
+// bets. The bets that do not pass Bet.Validate are reported to the Observer
+// as rejected. Sending does not check them, so they are still sent
+func (client *Client) ValidateBets() (int, error) {
+	validBets := 0
+	err := client.whenNoSigtermReceivedDo(func() error {
+		return client.withEachValidBetBatchDo(func(betBatchFrame []byte, batchSize int) error {
+			validBets += batchSize
+			return nil
+		})
+	})
+	return validBets, err
+}
+
+// AskNationalLotteryHeadquartersForWinners Connects to the server only to
+// ask for the winners of the agency, whose bets were already sent
+func (client *Client) AskNationalLotteryHeadquartersForWinners() ([]string, error) {
+	stopListeningForSigterm := client.listenForSigterm()
+	defer stopListeningForSigterm()
+
+	var winners []string
+	err := client.withNewClientSocketDo(func() error {
+		receivedWinners, err := client.askForWinners()
+		winners = receivedWinners
+		return err
+	})
+	return winners, err
+}
+
+func (client *Client) SendAllBetsToNationalLotteryHeadquartersThenAskForWinners() error {
+	stopListeningForSigterm := client.listenForSigterm()
+	defer stopListeningForSigterm()
 
 	return client.withNewClientSocketDo(func() error {
-		err := client.sendAllBetsUsingBetBatchs(signalReceiver)
+		err := client.sendAllBetsUsingBetBatchs()
 		if err != nil {
 			return err
 		}
 
-		err = client.notifyNoMoreBets(signalReceiver)
+		err = client.notifyNoMoreBets()
 		if err != nil {
 			return err
 		}
 
-		return client.askForWinners(signalReceiver)
+		_, err = client.askForWinners()
+		return err
 	})
 }
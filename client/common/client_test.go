@@ -0,0 +1,763 @@
+package common_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/betgen"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/fakehq"
+)
+
+const testAgencyBets = 250
+
+func testAgencyFile(t *testing.T) func() (io.ReadCloser, error) {
+	t.Helper()
+	options := betgen.DefaultOptions()
+	options.Rows = testAgencyBets
+	options.WinnerFraction = 0.1
+
+	generator, err := betgen.NewGenerator(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file bytes.Buffer
+	if _, err := generator.Write(&file); err != nil {
+		t.Fatal(err)
+	}
+	return func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(file.Bytes())), nil }
+}
+
+// startFakeServer serves a fake headquarters on an in-memory listener and
+// returns the client configuration needed to reach it
+func startFakeServer(t *testing.T, behaviour fakehq.Behaviour) (*fakehq.Server, common.ClientConfig) {
+	t.Helper()
+	return startFakeServerForAgencies(t, 1, behaviour)
+}
+
+// startFakeServerForAgencies is startFakeServer for a draw that waits for
+// the given amount of agencies
+func startFakeServerForAgencies(t *testing.T, agencies int, behaviour fakehq.Behaviour) (*fakehq.Server, common.ClientConfig) {
+	t.Helper()
+	server := fakehq.New(fakehq.Options{Agencies: agencies, Behaviour: behaviour})
+	listener := fakehq.NewPipeListener()
+	go server.Serve(listener)
+	t.Cleanup(server.Close)
+
+	return server, common.ClientConfig{
+		ID:                         "1",
+		ServerAddress:              "fakehq",
+		MaxAmountOfBetsOnEachBatch: 20,
+		MaxKiBPerBatch:             8,
+		PipelineWorkers:            2,
+		OpenAgencyFile:             testAgencyFile(t),
+		Dial:                       listener.Dial,
+	}
+}
+
+func runWholeFlow(client *common.Client) ([]string, error) {
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+	defer client.Disconnect()
+
+	if err := client.SendAllBets(); err != nil {
+		return nil, err
+	}
+	if err := client.NotifyNoMoreBets(); err != nil {
+		return nil, err
+	}
+	return client.AskForWinners()
+}
+
+func TestClientSendsAllBetsAndReceivesWinners(t *testing.T) {
+	server, config := startFakeServer(t, fakehq.Behaviour{})
+
+	winners, err := runWholeFlow(common.NewClient(config))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored := len(server.Bets()); stored != testAgencyBets {
+		t.Fatalf("unexpected amount of stored bets: got %d, want %d", stored, testAgencyBets)
+	}
+	if len(winners) == 0 || len(winners) != len(server.Winners("1")) {
+		t.Fatalf("unexpected winners: got %v, want %v", winners, server.Winners("1"))
+	}
+}
+
+func TestClientOverTCP(t *testing.T) {
+	server := fakehq.New(fakehq.Options{Agencies: 1})
+	address, err := server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client := common.NewClient(common.ClientConfig{
+		ID:                         "1",
+		ServerAddress:              address,
+		MaxAmountOfBetsOnEachBatch: 50,
+		MaxKiBPerBatch:             8,
+		OpenAgencyFile:             testAgencyFile(t),
+	})
+	if err := client.SendAllBetsToNationalLotteryHeadquartersThenAskForWinners(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored := len(server.Bets()); stored != testAgencyBets {
+		t.Fatalf("unexpected amount of stored bets: got %d, want %d", stored, testAgencyBets)
+	}
+}
+
+func TestClientFailsOnWrongAckCount(t *testing.T) {
+	_, config := startFakeServer(t, fakehq.Behaviour{AckCountOffset: -1})
+
+	_, err := runWholeFlow(common.NewClient(config))
+	var ackErr *common.AckMismatchError
+	if !errors.Is(err, common.ErrAckMismatch) || !errors.As(err, &ackErr) {
+		t.Fatalf("expected an ack mismatch, got: %v", err)
+	}
+	if common.ExitCode(err) != common.EXIT_ACK_MISMATCH {
+		t.Fatalf("unexpected exit code: %d", common.ExitCode(err))
+	}
+}
+
+func TestClientFailsWhenAckTakesTooLong(t *testing.T) {
+	_, config := startFakeServer(t, fakehq.Behaviour{AckDelay: time.Second})
+	config.AckTimeout = 50 * time.Millisecond
+
+	_, err := runWholeFlow(common.NewClient(config))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() || !errors.Is(err, common.ErrConnect) {
+		t.Fatalf("expected a timeout error, got: %v", err)
+	}
+}
+
+func TestClientFailsWhenConnectionIsDropped(t *testing.T) {
+	server, config := startFakeServer(t, fakehq.Behaviour{DropConnectionAfterBatches: 3})
+
+	if _, err := runWholeFlow(common.NewClient(config)); !errors.Is(err, common.ErrConnect) {
+		t.Fatalf("expected a connection error when the server drops the connection, got: %v", err)
+	}
+	if stored := len(server.Bets()); stored != 2*config.MaxAmountOfBetsOnEachBatch {
+		t.Fatalf("unexpected amount of stored bets: got %d, want %d", stored, 2*config.MaxAmountOfBetsOnEachBatch)
+	}
+}
+
+func TestClientStopsWhileWaitingForANeverEndingDraw(t *testing.T) {
+	_, config := startFakeServer(t, fakehq.Behaviour{NeverReleaseBarrier: true})
+	client := common.NewClient(config)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := runWholeFlow(client)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		t.Fatalf("winners query returned before the draw: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	client.Stop()
+	select {
+	case err := <-result:
+		if !errors.Is(err, common.ErrInterrupted) {
+			t.Fatalf("expected an interrupted error, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client did not stop")
+	}
+}
+
+func TestClientFailsWhenServerIsUnreachable(t *testing.T) {
+	listener := fakehq.NewPipeListener()
+	listener.Close()
+
+	client := common.NewClient(common.ClientConfig{ID: "1", ServerAddress: "fakehq", Dial: listener.Dial})
+	if err := client.Connect(); err == nil {
+		t.Fatal("expected an error when the server is unreachable")
+	}
+}
+
+// startSignedFakeServer serves a fake headquarters that requires messages
+// signed with serverKey and returns a client configuration signing with
+// clientKey
+func startSignedFakeServer(t *testing.T, serverKey []byte, clientKey []byte) (*fakehq.Server, common.ClientConfig) {
+	t.Helper()
+	server := fakehq.New(fakehq.Options{Agencies: 1, HMACKeys: map[string][]byte{"1": serverKey}})
+	listener := fakehq.NewPipeListener()
+	go server.Serve(listener)
+	t.Cleanup(server.Close)
+
+	return server, common.ClientConfig{
+		ID:                         "1",
+		ServerAddress:              "fakehq",
+		MaxAmountOfBetsOnEachBatch: 20,
+		MaxKiBPerBatch:             8,
+		OpenAgencyFile:             testAgencyFile(t),
+		Dial:                       listener.Dial,
+		Signer:                     common.NewMessageSigner("1", clientKey, 0),
+		AckTimeout:                 time.Second,
+	}
+}
+
+func TestClientSignsMessagesAndVerifiesReplies(t *testing.T) {
+	key := []byte("agency-1-secret")
+	server, config := startSignedFakeServer(t, key, key)
+
+	winners, err := runWholeFlow(common.NewClient(config))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored := len(server.Bets()); stored != testAgencyBets {
+		t.Fatalf("unexpected amount of stored bets: got %d, want %d", stored, testAgencyBets)
+	}
+	if len(winners) != len(server.Winners("1")) {
+		t.Fatalf("unexpected winners: got %v, want %v", winners, server.Winners("1"))
+	}
+}
+
+func TestServerRejectsMessagesSignedWithAnotherKey(t *testing.T) {
+	server, config := startSignedFakeServer(t, []byte("agency-1-secret"), []byte("forged"))
+
+	if _, err := runWholeFlow(common.NewClient(config)); err == nil {
+		t.Fatal("expected an error when signing with another key")
+	}
+	if stored := len(server.Bets()); stored != 0 {
+		t.Fatalf("server stored %d bets with a forged signature", stored)
+	}
+}
+
+func TestClientRejectsUnsignedReplies(t *testing.T) {
+	_, config := startFakeServer(t, fakehq.Behaviour{})
+	config.Signer = common.NewMessageSigner("1", []byte("agency-1-secret"), 0)
+
+	// The server does not verify signatures, so it fails decoding the
+	// signed batch and replies with an unsigned ACK
+	if _, err := runWholeFlow(common.NewClient(config)); err == nil {
+		t.Fatal("expected an error when receiving unsigned replies")
+	}
+}
+
+// recordingLogger keeps every event logged at info level or above
+type recordingLogger struct {
+	common.NopLogger
+	lock   sync.Mutex
+	events []string
+}
+
+func (logger *recordingLogger) record(format string, args ...interface{}) {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	logger.events = append(logger.events, fmt.Sprintf(format, args...))
+}
+
+func (logger *recordingLogger) Infof(format string, args ...interface{}) {
+	logger.record(format, args...)
+}
+func (logger *recordingLogger) Warningf(format string, args ...interface{}) {
+	logger.record(format, args...)
+}
+func (logger *recordingLogger) Errorf(format string, args ...interface{}) {
+	logger.record(format, args...)
+}
+
+func TestClientLogsThroughTheInjectedLogger(t *testing.T) {
+	_, config := startFakeServer(t, fakehq.Behaviour{})
+	logger := &recordingLogger{}
+	config.Logger = logger
+
+	if _, err := runWholeFlow(common.NewClient(config)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	logged := strings.Join(logger.events, "\n")
+	for _, event := range []string{
+		"action: send_all_bets_using_bet_batchs | result: success | client_id: 1",
+		"action: ask_for_winners | result: success | client_id: 1",
+	} {
+		if !strings.Contains(logged, event) {
+			t.Fatalf("event %q was not logged, got:\n%s", event, logged)
+		}
+	}
+}
+
+// countingObserver counts the rows reported by the client
+type countingObserver struct {
+	common.NopObserver
+	read          int
+	rejectedLines []int
+	states        []common.ClientState
+	retries       []int
+}
+
+func (observer *countingObserver) BetsRead(amount int) { observer.read += amount }
+
+func (observer *countingObserver) BetRejected(line int, reason error) {
+	observer.rejectedLines = append(observer.rejectedLines, line)
+}
+
+func (observer *countingObserver) StateChanged(state common.ClientState) {
+	observer.states = append(observer.states, state)
+}
+
+func (observer *countingObserver) ConnectRetried(attempt int, wait time.Duration, reason error) {
+	observer.retries = append(observer.retries, attempt)
+}
+
+func TestClientReportsReadRowsAndStates(t *testing.T) {
+	server, config := startFakeServer(t, fakehq.Behaviour{})
+	agencyFile := "Santiago,Lorca,30904465,1999-03-17,7574\n" +
+		"Ana,Perez,not-a-document,1990-01-01,1234\n" +
+		"Maria,Diaz,23456789,1985-12-31,4321\n"
+	config.OpenAgencyFile = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(agencyFile)), nil }
+	observer := &countingObserver{}
+	config.Observer = observer
+
+	if _, err := runWholeFlow(common.NewClient(config)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if observer.read != 3 || len(observer.rejectedLines) != 0 || len(server.Bets()) != 3 {
+		t.Fatalf("unexpected rows: read %d, rejected lines %v, stored %d", observer.read, observer.rejectedLines, len(server.Bets()))
+	}
+	expectedStates := []common.ClientState{common.STATE_SENDING, common.STATE_IDLE, common.STATE_WAITING_WINNERS, common.STATE_IDLE}
+	if fmt.Sprint(observer.states) != fmt.Sprint(expectedStates) {
+		t.Fatalf("unexpected states: got %v, want %v", observer.states, expectedStates)
+	}
+}
+
+func TestClientValidatesBetsWithoutConnecting(t *testing.T) {
+	server, config := startFakeServer(t, fakehq.Behaviour{})
+	agencyFile := "Santiago,Lorca,30904465,1999-03-17,7574\n" +
+		"Ana,Perez,not-a-document,1990-01-01,1234\n" +
+		"Maria,Diaz,23456789,1985-12-31,4321\n"
+	config.OpenAgencyFile = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(agencyFile)), nil }
+	config.Dial = func(network string, address string) (net.Conn, error) {
+		t.Fatal("validating bets must not connect to the server")
+		return nil, nil
+	}
+	observer := &countingObserver{}
+	config.Observer = observer
+
+	validBets, err := common.NewClient(config).ValidateBets()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if validBets != 2 || fmt.Sprint(observer.rejectedLines) != "[2]" {
+		t.Fatalf("unexpected validation: %d valid bets, rejected lines %v", validBets, observer.rejectedLines)
+	}
+	if stored := len(server.Bets()); stored != 0 {
+		t.Fatalf("unexpected stored bets: %d", stored)
+	}
+}
+
+// limitsObserver lowers the batch limits of its client once the first batch
+// is acknowledged, and keeps the size of every batch
+type limitsObserver struct {
+	common.NopObserver
+	client *common.Client
+	sizes  []int
+}
+
+func (observer *limitsObserver) BetBatchAcknowledged(batchSize int, batchBytes int, latency time.Duration) {
+	if len(observer.sizes) == 0 {
+		limits := observer.client.Limits()
+		limits.MaxAmountOfBetsOnEachBatch = 5
+		observer.client.UpdateLimits(limits)
+	}
+	observer.sizes = append(observer.sizes, batchSize)
+}
+
+func TestClientAppliesNewLimitsToTheFollowingBatches(t *testing.T) {
+	server, config := startFakeServer(t, fakehq.Behaviour{})
+	config.PipelineQueueSize = 1
+	observer := &limitsObserver{}
+	config.Observer = observer
+	client := common.NewClient(config)
+	observer.client = client
+
+	if _, err := runWholeFlow(client); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored := len(server.Bets()); stored != testAgencyBets {
+		t.Fatalf("unexpected amount of stored bets: got %d, want %d", stored, testAgencyBets)
+	}
+	if limits := client.Limits(); limits.MaxAmountOfBetsOnEachBatch != 5 || limits.MaxKiBPerBatch != 8 {
+		t.Fatalf("unexpected limits: %+v", limits)
+	}
+	for _, size := range observer.sizes {
+		if size > 20 {
+			t.Fatalf("batch of %d bets exceeds the limits: %v", size, observer.sizes)
+		}
+	}
+	if last := observer.sizes[len(observer.sizes)-1]; last > 5 {
+		t.Fatalf("expected the last batches to use the new limits: %v", observer.sizes)
+	}
+}
+
+// throttleObserver adds up the time its client waited for the rate limiter
+type throttleObserver struct {
+	common.NopObserver
+	throttled time.Duration
+}
+
+func (observer *throttleObserver) Throttled(waited time.Duration) {
+	observer.throttled += waited
+}
+
+func TestClientsShareTheRateLimiter(t *testing.T) {
+	server, config := startFakeServer(t, fakehq.Behaviour{})
+	config.RateLimiter = common.NewRateLimiter(common.RateLimits{BetsPerSecond: 2000, BetsBurst: 100})
+	observers := []*throttleObserver{{}, {}}
+
+	startedAt := time.Now()
+	var clients sync.WaitGroup
+	for _, observer := range observers {
+		config.Observer = observer
+		clients.Add(1)
+		go func(client *common.Client) {
+			defer clients.Done()
+			if err := client.Connect(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			defer client.Disconnect()
+			if err := client.SendAllBets(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(common.NewClient(config))
+	}
+	clients.Wait()
+
+	// 500 bets with a burst of 100 take at least 200ms at 2000 bets/s
+	if elapsed := time.Since(startedAt); elapsed < 200*time.Millisecond {
+		t.Fatalf("expected the clients to be throttled together, took %v", elapsed)
+	}
+	if stored := len(server.Bets()); stored != 2*testAgencyBets {
+		t.Fatalf("unexpected amount of stored bets: got %d, want %d", stored, 2*testAgencyBets)
+	}
+	if observers[0].throttled+observers[1].throttled == 0 {
+		t.Fatal("expected the time throttled to be reported")
+	}
+}
+
+// batchSizeObserver keeps the size of every batch acknowledged
+type batchSizeObserver struct {
+	common.NopObserver
+	sizes []int
+}
+
+func (observer *batchSizeObserver) BetBatchAcknowledged(batchSize int, batchBytes int, latency time.Duration) {
+	observer.sizes = append(observer.sizes, batchSize)
+}
+
+func TestClientGrowsBatchesWhileAcksAreFast(t *testing.T) {
+	server, config := startFakeServer(t, fakehq.Behaviour{})
+	config.AdaptiveBatching = common.AdaptiveBatching{TargetLatency: time.Minute, MinAmount: 1, Step: 5}
+	observer := &batchSizeObserver{}
+	config.Observer = observer
+
+	if _, err := runWholeFlow(common.NewClient(config)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored := len(server.Bets()); stored != testAgencyBets {
+		t.Fatalf("unexpected amount of stored bets: got %d, want %d", stored, testAgencyBets)
+	}
+	if fmt.Sprint(observer.sizes[:6]) != "[1 6 11 16 20 20]" {
+		t.Fatalf("unexpected batch sizes: %v", observer.sizes)
+	}
+}
+
+// refusingDial fails with connection refused the first refusals times it is
+// called, then dials through dial. It counts every attempt
+func refusingDial(refusals int, attempts *int, dial func(string, string) (net.Conn, error)) func(string, string) (net.Conn, error) {
+	return func(network string, address string) (net.Conn, error) {
+		*attempts++
+		if *attempts <= refusals {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+		}
+		return dial(network, address)
+	}
+}
+
+func TestClientRetriesRefusedConnections(t *testing.T) {
+	server, config := startFakeServer(t, fakehq.Behaviour{})
+	attempts := 0
+	config.Dial = refusingDial(2, &attempts, config.Dial)
+	config.Connect = common.ConnectPolicy{Jitter: 10 * time.Millisecond, RetryMaxWait: time.Second, RetryBackoff: 10 * time.Millisecond}
+	observer := &countingObserver{}
+	config.Observer = observer
+
+	if _, err := runWholeFlow(common.NewClient(config)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attempts != 3 || fmt.Sprint(observer.retries) != "[1 2]" {
+		t.Fatalf("expected 3 attempts to connect and 2 retries, got %d attempts and retries %v", attempts, observer.retries)
+	}
+	if stored := len(server.Bets()); stored != testAgencyBets {
+		t.Fatalf("unexpected amount of stored bets: got %d, want %d", stored, testAgencyBets)
+	}
+}
+
+func TestClientStopsRetryingAfterTheMaxWait(t *testing.T) {
+	_, config := startFakeServer(t, fakehq.Behaviour{})
+	attempts := 0
+	config.Dial = refusingDial(1000, &attempts, config.Dial)
+	config.Connect = common.ConnectPolicy{RetryMaxWait: 100 * time.Millisecond, RetryBackoff: 20 * time.Millisecond}
+
+	startedAt := time.Now()
+	err := common.NewClient(config).Connect()
+	if !errors.Is(err, common.ErrConnect) || !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected a connection refused error, got %v", err)
+	}
+	if elapsed := time.Since(startedAt); elapsed > time.Second || attempts < 2 || attempts > 5 {
+		t.Fatalf("unexpected retries: %d attempts in %v", attempts, elapsed)
+	}
+}
+
+func TestClientWaitsWhileTheServerIsBusy(t *testing.T) {
+	server, config := startFakeServer(t, fakehq.Behaviour{BusyHandshakes: 2, BusyRetryAfter: 20 * time.Millisecond})
+	config.Connect = common.ConnectPolicy{RetryMaxWait: time.Second, Handshake: true}
+
+	if _, err := runWholeFlow(common.NewClient(config)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if busyReplies := server.BusyReplies(); busyReplies != 2 {
+		t.Fatalf("expected 2 busy replies, got %d", busyReplies)
+	}
+	if stored := len(server.Bets()); stored != testAgencyBets {
+		t.Fatalf("unexpected amount of stored bets: got %d, want %d", stored, testAgencyBets)
+	}
+}
+
+func TestClientGivesUpWhenTheServerIsBusyForTooLong(t *testing.T) {
+	_, config := startFakeServer(t, fakehq.Behaviour{BusyHandshakes: 1, BusyRetryAfter: time.Minute})
+	config.Connect = common.ConnectPolicy{RetryMaxWait: time.Second, Handshake: true}
+
+	err := common.NewClient(config).Connect()
+	var busy *common.ServerBusyError
+	if !errors.As(err, &busy) || busy.RetryAfter != time.Minute || common.ExitCode(err) != common.EXIT_CONNECT {
+		t.Fatalf("expected the server to be busy, got %v", err)
+	}
+}
+
+// creditObserver counts the batches that waited for credits
+type creditObserver struct {
+	common.NopObserver
+	waits int
+}
+
+func (observer *creditObserver) WaitedForCredits(waited time.Duration) {
+	observer.waits++
+}
+
+func TestClientNeverSendsBeyondItsCredits(t *testing.T) {
+	for _, separateMessage := range []bool{false, true} {
+		server, config := startFakeServer(t, fakehq.Behaviour{
+			Credits:                  common.Credits{Batches: 1, Bytes: 8 * common.KiB},
+			CreditsPerBatch:          common.Credits{Batches: 1, Bytes: 4 * common.KiB},
+			CreditsInSeparateMessage: separateMessage,
+		})
+		config.Connect = common.ConnectPolicy{Credits: true}
+		observer := &creditObserver{}
+		config.Observer = observer
+
+		if _, err := runWholeFlow(common.NewClient(config)); err != nil {
+			t.Fatalf("unexpected error with credits in a separate message %v: %v", separateMessage, err)
+		}
+		if stored := len(server.Bets()); stored != testAgencyBets {
+			t.Fatalf("unexpected amount of stored bets: got %d, want %d", stored, testAgencyBets)
+		}
+		if separateMessage && observer.waits == 0 {
+			t.Fatal("expected the client to wait for the credits sent after each ACK")
+		}
+	}
+}
+
+func TestClientWithCreditsWorksWithServersWithoutThem(t *testing.T) {
+	server, config := startFakeServer(t, fakehq.Behaviour{})
+	config.Connect = common.ConnectPolicy{Credits: true}
+
+	if _, err := runWholeFlow(common.NewClient(config)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored := len(server.Bets()); stored != testAgencyBets {
+		t.Fatalf("unexpected amount of stored bets: got %d, want %d", stored, testAgencyBets)
+	}
+}
+
+func TestClientFailsWhenTheServerGrantsNoMoreCredits(t *testing.T) {
+	server, config := startFakeServer(t, fakehq.Behaviour{Credits: common.Credits{Batches: 2}})
+	config.Connect = common.ConnectPolicy{Credits: true}
+	config.AckTimeout = 50 * time.Millisecond
+
+	_, err := runWholeFlow(common.NewClient(config))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() || !errors.Is(err, common.ErrConnect) {
+		t.Fatalf("expected a timeout waiting for credits, got: %v", err)
+	}
+	if stored := len(server.Bets()); stored != 2*config.MaxAmountOfBetsOnEachBatch {
+		t.Fatalf("expected only the batches granted to be sent, got %d bets", stored)
+	}
+}
+
+func TestClientCutsTheBatchesToTheCreditsGranted(t *testing.T) {
+	server, config := startFakeServer(t, fakehq.Behaviour{
+		Credits:         common.Credits{Bytes: common.KiB},
+		CreditsPerBatch: common.Credits{Bytes: common.KiB},
+	})
+	config.Connect = common.ConnectPolicy{Credits: true}
+
+	if _, err := runWholeFlow(common.NewClient(config)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored := len(server.Bets()); stored != testAgencyBets {
+		t.Fatalf("unexpected amount of stored bets: got %d, want %d", stored, testAgencyBets)
+	}
+}
+
+func TestClientFailsWhenTheCreditsCannotHoldASingleBet(t *testing.T) {
+	server, config := startFakeServer(t, fakehq.Behaviour{Credits: common.Credits{Bytes: common.MAX_BYTES_BET}})
+	config.Connect = common.ConnectPolicy{Credits: true}
+
+	_, err := runWholeFlow(common.NewClient(config))
+	if !errors.Is(err, common.ErrProtocol) {
+		t.Fatalf("expected a protocol error, got: %v", err)
+	}
+	if stored := len(server.Bets()); stored != 0 {
+		t.Fatalf("expected no bets to be sent, got %d", stored)
+	}
+}
+
+// askForWinnersLater makes agency 2 ask for its winners after delay, which
+// holds the draw of a server waiting for two agencies. The test waits for
+// agency 2 to get them before the server is closed
+func askForWinnersLater(t *testing.T, config common.ClientConfig, delay time.Duration) {
+	t.Helper()
+	config.ID = "2"
+	config.Winners = common.WinnersPolicy{}
+	config.Logger = nil
+
+	done := make(chan struct{})
+	t.Cleanup(func() { <-done })
+	go func() {
+		defer close(done)
+		time.Sleep(delay)
+		client := common.NewClient(config)
+		if err := client.Connect(); err != nil {
+			t.Errorf("unexpected error connecting agency 2: %v", err)
+			return
+		}
+		defer client.Disconnect()
+		if _, err := client.AskForWinners(); err != nil {
+			t.Errorf("unexpected error asking for the winners of agency 2: %v", err)
+		}
+	}()
+}
+
+func TestClientPollsWhileTheDrawIsNotHeld(t *testing.T) {
+	for _, mode := range []common.WinnersMode{common.WINNERS_MODE_ASK, common.WINNERS_MODE_SUBSCRIBE} {
+		server, config := startFakeServerForAgencies(t, 2, fakehq.Behaviour{PollWinners: true})
+		config.Winners = common.WinnersPolicy{Mode: mode, MaxWait: 5 * time.Second, PollBackoff: 10 * time.Millisecond, Heartbeat: 10 * time.Millisecond}
+		logger := &recordingLogger{}
+		config.Logger = logger
+		askForWinnersLater(t, config, 100*time.Millisecond)
+
+		winners, err := runWholeFlow(common.NewClient(config))
+		if err != nil {
+			t.Fatalf("unexpected error in %s mode: %v", mode, err)
+		}
+		if len(winners) == 0 || len(winners) != len(server.Winners("1")) {
+			t.Fatalf("unexpected winners in %s mode: got %v, want %v", mode, winners, server.Winners("1"))
+		}
+
+		progress := "action: ask_for_winners | result: in_progress"
+		if mode == common.WINNERS_MODE_SUBSCRIBE {
+			progress = "action: wait_winners | result: in_progress"
+		}
+		if logged := strings.Join(logger.events, "\n"); !strings.Contains(logged, progress) {
+			t.Fatalf("expected the wait to be logged in %s mode, got:\n%s", mode, logged)
+		}
+	}
+}
+
+func TestClientGivesUpWaitingForTheDraw(t *testing.T) {
+	for _, behaviour := range []fakehq.Behaviour{{PollWinners: true}, {}} {
+		for _, mode := range []common.WinnersMode{common.WINNERS_MODE_ASK, common.WINNERS_MODE_SUBSCRIBE} {
+			_, config := startFakeServerForAgencies(t, 2, behaviour)
+			config.Winners = common.WinnersPolicy{Mode: mode, MaxWait: 100 * time.Millisecond, PollBackoff: 10 * time.Millisecond, Heartbeat: 10 * time.Millisecond}
+
+			_, err := runWholeFlow(common.NewClient(config))
+			var notReady *common.DrawNotReadyError
+			if !errors.As(err, &notReady) || common.ExitCode(err) != common.EXIT_CONNECT {
+				t.Fatalf("expected the draw not to be ready in %s mode, polling %v, got %v", mode, behaviour.PollWinners, err)
+			}
+			if notReady.Waited > time.Second {
+				t.Fatalf("expected to give up after 100ms, waited %v", notReady.Waited)
+			}
+		}
+	}
+}
+
+func TestClientKeepsAnIdleConnectionAliveWithHeartbeats(t *testing.T) {
+	server, config := startFakeServerForAgencies(t, 2, fakehq.Behaviour{})
+	config.Heartbeat = common.HeartbeatPolicy{Interval: 10 * time.Millisecond, MaxMissedPongs: 2}
+	askForWinnersLater(t, config, 150*time.Millisecond)
+
+	winners, err := runWholeFlow(common.NewClient(config))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(winners) != len(server.Winners("1")) {
+		t.Fatalf("unexpected winners: got %v, want %v", winners, server.Winners("1"))
+	}
+	if server.Pings() == 0 {
+		t.Fatal("expected heartbeats while waiting for the draw")
+	}
+}
+
+func TestClientGivesUpOnADeadPeer(t *testing.T) {
+	_, config := startFakeServerForAgencies(t, 2, fakehq.Behaviour{IgnorePings: true})
+	config.Heartbeat = common.HeartbeatPolicy{Interval: 10 * time.Millisecond, MaxMissedPongs: 2}
+
+	_, err := runWholeFlow(common.NewClient(config))
+	var deadPeer *common.DeadPeerError
+	if !errors.As(err, &deadPeer) || common.ExitCode(err) != common.EXIT_CONNECT {
+		t.Fatalf("expected the server to be given up for dead, got %v", err)
+	}
+	if deadPeer.MissedPongs < 2 {
+		t.Fatalf("expected at least 2 heartbeats unanswered, got %d", deadPeer.MissedPongs)
+	}
+}
+
+func TestClientNoticesAPeerThatDiesWhileItIsIdle(t *testing.T) {
+	server, config := startFakeServer(t, fakehq.Behaviour{})
+	config.Heartbeat = common.HeartbeatPolicy{Interval: 10 * time.Millisecond, MaxMissedPongs: 2}
+	client := common.NewClient(config)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Disconnect()
+
+	time.Sleep(100 * time.Millisecond)
+	if err := client.SendAllBets(); err != nil {
+		t.Fatalf("expected the answered heartbeats to keep the idle connection alive, got %v", err)
+	}
+
+	server.StopAnsweringPings()
+	time.Sleep(200 * time.Millisecond)
+	err := client.NotifyNoMoreBets()
+	var deadPeer *common.DeadPeerError
+	if !errors.As(err, &deadPeer) || common.ExitCode(err) != common.EXIT_CONNECT {
+		t.Fatalf("expected the server to be given up for dead while idle, got %v", err)
+	}
+}
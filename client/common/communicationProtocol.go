@@ -2,7 +2,10 @@ package common
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -16,6 +19,22 @@ const (
 	ASK_FOR_WINNERS_MSG_TYPE = "ASK"
 	WINNERS_MSG_TYPE         = "WIN"
 
+	// HELLO_MSG_TYPE abre el handshake opcional de admisión, y BUSY_MSG_TYPE es la
+	// respuesta del servidor cuando no puede atender más conexiones por el momento.
+	HELLO_MSG_TYPE = "HLO"
+	BUSY_MSG_TYPE  = "BSY"
+
+	// CREDIT_MSG_TYPE otorga créditos de envío a un cliente que anunció soportarlos en su HLO.
+	CREDIT_MSG_TYPE = "CRD"
+
+	// WAIT_MSG_TYPE es la respuesta a un ASK cuando el sorteo todavía no se realizó.
+	// SUBSCRIBE_MSG_TYPE pide al servidor que envíe el WIN apenas se realice el sorteo,
+	// y mientras tanto PING_MSG_TYPE y PONG_MSG_TYPE mantienen viva la conexión.
+	WAIT_MSG_TYPE      = "WIT"
+	SUBSCRIBE_MSG_TYPE = "SUB"
+	PING_MSG_TYPE      = "PNG"
+	PONG_MSG_TYPE      = "PON"
+
 	// --- Delimitadores y Separadores del Protocolo ---
 	START_MSG_DELIMITER = "["
 	END_MSG_DELIMITER   = "]"
@@ -26,53 +45,129 @@ const (
 	BET_FIELDS_SEPARATOR = ","
 
 	WINNERS_SEPARATOR = ","
+
+	// ACK_CREDITS_SEPARATOR separa el payload de un ACK de los créditos otorgados junto a él,
+	// y CREDITS_SEPARATOR separa los batches de los bytes otorgados: ACK[50;2,16384]
+	ACK_CREDITS_SEPARATOR = ";"
+	CREDITS_SEPARATOR     = ","
 )
 
 // ============================= ENCODE ============================== //
 
+// Cantidad de bytes fijos que agrega cada parte del protocolo al ser codificada.
+// Permiten calcular el tamaño de un mensaje sin necesidad de codificarlo.
+const (
+	// encodedFieldOverhead corresponde a las comillas y los dos puntos de "clave":"valor".
+	encodedFieldOverhead = len(`"":""`)
+
+	// encodedMessageOverhead corresponde al tipo de mensaje y sus delimitadores: TIPO[...]
+	encodedMessageOverhead = MESSAGE_TYPE_LENGTH + len(START_MSG_DELIMITER) + len(END_MSG_DELIMITER)
+)
+
+// betFieldNames contiene los nombres de los campos de una apuesta, en el orden en que se codifican.
+var betFieldNames = [...]string{"agency", "first_name", "last_name", "document", "birthdate", "number"}
+
+// encodedBetOverhead es la cantidad de bytes que agrega la codificación de una apuesta
+// por sobre el largo de sus valores: nombres de campos, comillas, separadores y delimitadores.
+var encodedBetOverhead = func() int {
+	overhead := len(START_BET_DELIMITER) + len(END_BET_DELIMITER)
+	overhead += (len(betFieldNames) - 1) * len(BET_FIELDS_SEPARATOR)
+	for _, fieldName := range betFieldNames {
+		overhead += len(fieldName) + encodedFieldOverhead
+	}
+	return overhead
+}()
+
+// frameBufferPool mantiene buffers reutilizables para codificar mensajes completos
+// sin alocar memoria nueva en cada batch.
+var frameBufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, 0, 8*KiB)
+		return &buffer
+	},
+}
+
+// getFrameBuffer obtiene del pool un buffer vacío con al menos size bytes de capacidad.
+func getFrameBuffer(size int) *[]byte {
+	buffer := frameBufferPool.Get().(*[]byte)
+	if cap(*buffer) < size {
+		*buffer = make([]byte, 0, size)
+	}
+	*buffer = (*buffer)[:0]
+	return buffer
+}
+
+// putFrameBuffer devuelve un buffer al pool para que pueda ser reutilizado.
+func putFrameBuffer(buffer *[]byte) {
+	frameBufferPool.Put(buffer)
+}
+
+// appendMessage agrega al final de dst el mensaje TIPO[payload].
+func appendMessage(dst []byte, messageType string, encodedPayload string) []byte {
+	dst = append(dst, messageType...)
+	dst = append(dst, START_MSG_DELIMITER...)
+	dst = append(dst, encodedPayload...)
+	return append(dst, END_MSG_DELIMITER...)
+}
+
+// appendField agrega al final de dst un único par clave-valor en el formato del protocolo.
+// Formato de salida: "clave":"valor"
+func appendField(dst []byte, fieldName string, fieldValue string) []byte {
+	dst = append(dst, '"')
+	dst = append(dst, fieldName...)
+	dst = append(dst, '"', ':', '"')
+	dst = append(dst, fieldValue...)
+	return append(dst, '"')
+}
+
 // encodeMessage es el constructor base para todos los mensajes del protocolo.
 // Envuelve un payload (contenido) con su tipo y los delimitadores estándar.
 // Formato de salida: TIPO[payload]
 func encodeMessage(messageType string, encodedPayload string) string {
-	encodedMessage := messageType
-	encodedMessage += START_MSG_DELIMITER
-	encodedMessage += encodedPayload
-	encodedMessage += END_MSG_DELIMITER
-	return encodedMessage
+	encodedMessage := make([]byte, 0, encodedMessageOverhead+len(encodedPayload))
+	return string(appendMessage(encodedMessage, messageType, encodedPayload))
 }
 
 // encodeField formatea un único par clave-valor en el formato string personalizado del protocolo.
 // Formato de salida: "clave":"valor"
 func encodeField(fieldName string, fieldValue string) string {
-	return fmt.Sprintf(`"%s":"%s"`, fieldName, fieldValue)
+	encodedField := make([]byte, 0, encodedFieldOverhead+len(fieldName)+len(fieldValue))
+	return string(appendField(encodedField, fieldName, fieldValue))
+}
+
+// AppendBet agrega al final de dst la codificación de una única apuesta y devuelve el slice extendido.
+// Formato de salida: {"clave1":"valor1","clave2":"valor2",...}
+func AppendBet(dst []byte, bet *Bet) []byte {
+	dst = append(dst, START_BET_DELIMITER...)
+	dst = appendField(dst, "agency", bet.Agency)
+	dst = append(dst, BET_FIELDS_SEPARATOR...)
+	dst = appendField(dst, "first_name", bet.FirstName)
+	dst = append(dst, BET_FIELDS_SEPARATOR...)
+	dst = appendField(dst, "last_name", bet.LastName)
+	dst = append(dst, BET_FIELDS_SEPARATOR...)
+	dst = appendField(dst, "document", bet.Document)
+	dst = append(dst, BET_FIELDS_SEPARATOR...)
+	dst = appendField(dst, "birthdate", bet.Birthdate)
+	dst = append(dst, BET_FIELDS_SEPARATOR...)
+	dst = appendField(dst, "number", bet.Number)
+	return append(dst, END_BET_DELIMITER...)
+}
+
+// EncodedBetLength calcula la cantidad de bytes que ocupa una apuesta codificada, sin codificarla.
+func EncodedBetLength(bet *Bet) int {
+	return encodedBetOverhead +
+		len(bet.Agency) +
+		len(bet.FirstName) +
+		len(bet.LastName) +
+		len(bet.Document) +
+		len(bet.Birthdate) +
+		len(bet.Number)
 }
 
 // EncodeBet serializa una única estructura Bet al formato de payload de apuesta.
 // Formato de salida: {"clave1":"valor1","clave2":"valor2",...}
 func EncodeBet(bet *Bet) string {
-	encodedBet := START_BET_DELIMITER
-	encodedBet += encodeField("agency", bet.Agency) + BET_FIELDS_SEPARATOR
-	encodedBet += encodeField("first_name", bet.FirstName) + BET_FIELDS_SEPARATOR
-	encodedBet += encodeField("last_name", bet.LastName) + BET_FIELDS_SEPARATOR
-	encodedBet += encodeField("document", bet.Document) + BET_FIELDS_SEPARATOR
-	encodedBet += encodeField("birthdate", bet.Birthdate) + BET_FIELDS_SEPARATOR
-	encodedBet += encodeField("number", bet.Number)
-	encodedBet += END_BET_DELIMITER
-	return encodedBet
-}
-
-// EncodeBetBatchMessage serializa un slice de estructuras Bet en un único mensaje de tipo BET.
-// Las apuestas individuales dentro del payload se separan por BET_BATCH_SEPARATOR (punto y coma).
-// Formato de salida: BET[{"bet1"};{"bet2"};...]
-func EncodeBetBatchMessage(betBatch []*Bet) string {
-	encodedPayload := ""
-	for i, bet := range betBatch {
-		encodedPayload += EncodeBet(bet)
-		if i < len(betBatch)-1 {
-			encodedPayload += BET_BATCH_SEPARATOR
-		}
-	}
-	return encodeMessage(BET_MSG_TYPE, encodedPayload)
+	return string(AppendBet(make([]byte, 0, EncodedBetLength(bet)), bet))
 }
 
 // EncodeAckMessage crea un mensaje de confirmación (ACK) estándar con el payload provisto.
@@ -95,6 +190,83 @@ func EncodeAskForWinnersMessage(agency string) string {
 	return encodeMessage(ASK_FOR_WINNERS_MSG_TYPE, encodedPayload)
 }
 
+// EncodeWinnersMessage crea el mensaje de respuesta "Winners" (WIN) con los DNIs ganadores.
+// Ejemplo de salida: WIN["12135000","87654321"]
+func EncodeWinnersMessage(documents []string) string {
+	encodedPayload := make([]byte, 0, len(documents)*12)
+	for i, document := range documents {
+		if i > 0 {
+			encodedPayload = append(encodedPayload, WINNERS_SEPARATOR...)
+		}
+		encodedPayload = append(encodedPayload, '"')
+		encodedPayload = append(encodedPayload, document...)
+		encodedPayload = append(encodedPayload, '"')
+	}
+	return encodeMessage(WINNERS_MSG_TYPE, string(encodedPayload))
+}
+
+// EncodeHelloMessage crea el mensaje "Hello" (HLO) que abre el handshake de admisión.
+// El payload identifica a la agencia que se conecta y, si credits es true, anuncia
+// que el cliente soporta el control de flujo por créditos.
+// Ejemplos de salida: HLO["agency":"1"] o HLO["agency":"1","credits":"true"]
+func EncodeHelloMessage(agency string, credits bool) string {
+	encodedPayload := encodeField("agency", agency)
+	if credits {
+		encodedPayload += BET_FIELDS_SEPARATOR + encodeField("credits", strconv.FormatBool(credits))
+	}
+	return encodeMessage(HELLO_MSG_TYPE, encodedPayload)
+}
+
+// EncodeBusyMessage crea la respuesta "Busy" (BSY) con la cantidad de milisegundos
+// que el cliente debe esperar antes de volver a conectarse.
+// Ejemplo de salida: BSY[250]
+func EncodeBusyMessage(retryAfter time.Duration) string {
+	return encodeMessage(BUSY_MSG_TYPE, strconv.FormatInt(retryAfter.Milliseconds(), 10))
+}
+
+// EncodeWaitMessage crea la respuesta "Wait" (WIT) a un ASK recibido antes del sorteo.
+// Ejemplo de salida: WIT[]
+func EncodeWaitMessage() string {
+	return encodeMessage(WAIT_MSG_TYPE, "")
+}
+
+// EncodeSubscribeMessage crea el mensaje "Subscribe" (SUB) con el que una agencia pide
+// recibir sus ganadores apenas se realice el sorteo.
+// Ejemplo de salida: SUB["agency":"1"]
+func EncodeSubscribeMessage(agency string) string {
+	encodedPayload := encodeField("agency", agency)
+	return encodeMessage(SUBSCRIBE_MSG_TYPE, encodedPayload)
+}
+
+// EncodePingMessage crea el mensaje "Ping" (PNG), que el otro extremo responde con PON.
+// Ejemplo de salida: PNG[]
+func EncodePingMessage() string {
+	return encodeMessage(PING_MSG_TYPE, "")
+}
+
+// EncodePongMessage crea la respuesta "Pong" (PON) a un PNG.
+// Ejemplo de salida: PON[]
+func EncodePongMessage() string {
+	return encodeMessage(PONG_MSG_TYPE, "")
+}
+
+// encodeCredits formatea los créditos otorgados como batches,bytes.
+func encodeCredits(credits Credits) string {
+	return strconv.Itoa(credits.Batches) + CREDITS_SEPARATOR + strconv.Itoa(credits.Bytes)
+}
+
+// EncodeCreditMessage crea el mensaje "Credit" (CRD) que otorga créditos al cliente.
+// Ejemplo de salida: CRD[2,16384]
+func EncodeCreditMessage(credits Credits) string {
+	return encodeMessage(CREDIT_MSG_TYPE, encodeCredits(credits))
+}
+
+// EncodeAckWithCreditsMessage crea un ACK que además otorga créditos al cliente.
+// Ejemplo de salida: ACK[50;2,16384]
+func EncodeAckWithCreditsMessage(message string, credits Credits) string {
+	return encodeMessage(ACK_MSG_TYPE, message+ACK_CREDITS_SEPARATOR+encodeCredits(credits))
+}
+
 // ============================= DECODE ============================== //
 
 // DecodeMessageType extrae el prefijo de tipo de mensaje (los primeros 3 bytes) de un string de mensaje crudo.
@@ -154,4 +326,205 @@ func DecodeWinnersMessage(message string) ([]string, error) {
 	}
 
 	return winners, nil
-}
\ No newline at end of file
+}
+
+// decodeField decodifica un único par "clave":"valor".
+func decodeField(encodedField string) (string, string, error) {
+	fieldName, fieldValue, found := cutString(encodedField, ":")
+	if !found {
+		return "", "", fmt.Errorf("unexpected field format: %s", encodedField)
+	}
+	return strings.Trim(fieldName, `"`), strings.Trim(fieldValue, `"`), nil
+}
+
+// cutString divide value alrededor de la primera aparición de separator.
+func cutString(value string, separator string) (string, string, bool) {
+	if i := strings.Index(value, separator); i >= 0 {
+		return value[:i], value[i+len(separator):], true
+	}
+	return value, "", false
+}
+
+// decodeBet decodifica el payload de una única apuesta.
+// Ejemplo de entrada: {"agency":"1","first_name":"Ana",...}
+func decodeBet(encodedBet string) (*Bet, error) {
+	if !strings.HasPrefix(encodedBet, START_BET_DELIMITER) || !strings.HasSuffix(encodedBet, END_BET_DELIMITER) {
+		return nil, fmt.Errorf("unexpected bet format: %s", encodedBet)
+	}
+	encodedBet = encodedBet[len(START_BET_DELIMITER) : len(encodedBet)-len(END_BET_DELIMITER)]
+
+	fields := map[string]string{}
+	for _, encodedField := range strings.Split(encodedBet, BET_FIELDS_SEPARATOR) {
+		fieldName, fieldValue, err := decodeField(encodedField)
+		if err != nil {
+			return nil, err
+		}
+		fields[fieldName] = fieldValue
+	}
+
+	for _, fieldName := range betFieldNames {
+		if _, found := fields[fieldName]; !found {
+			return nil, fmt.Errorf("missing bet field: %s", fieldName)
+		}
+	}
+
+	return NewBet(
+		fields["agency"],
+		fields["first_name"],
+		fields["last_name"],
+		fields["document"],
+		fields["birthdate"],
+		fields["number"],
+	), nil
+}
+
+// DecodeBetBatchMessage parsea un mensaje de tipo BET y devuelve las apuestas que contiene.
+// Ejemplo de entrada: BET[{"agency":"1",...};{...}]
+func DecodeBetBatchMessage(message string) ([]*Bet, error) {
+	err := assertMessageFormat(message, BET_MSG_TYPE)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := getMessagePayload(message)
+	if payload == "" {
+		return []*Bet{}, nil
+	}
+
+	betBatch := []*Bet{}
+	for _, encodedBet := range strings.Split(payload, BET_BATCH_SEPARATOR) {
+		bet, err := decodeBet(encodedBet)
+		if err != nil {
+			return nil, err
+		}
+		betBatch = append(betBatch, bet)
+	}
+	return betBatch, nil
+}
+
+// decodeAgencyMessage parsea un mensaje cuyo payload identifica a una agencia y devuelve su ID.
+func decodeAgencyMessage(message string, expectedMessageType string) (string, error) {
+	err := assertMessageFormat(message, expectedMessageType)
+	if err != nil {
+		return "", err
+	}
+
+	fieldName, agency, err := decodeField(getMessagePayload(message))
+	if err != nil {
+		return "", err
+	}
+	if fieldName != "agency" {
+		return "", fmt.Errorf("unexpected field: expected agency but received %s", fieldName)
+	}
+	return agency, nil
+}
+
+// DecodeNoMoreBetsMessage parsea un mensaje de tipo NMB y devuelve el ID de la agencia.
+// Ejemplo de entrada: NMB["agency":"1"]
+func DecodeNoMoreBetsMessage(message string) (string, error) {
+	return decodeAgencyMessage(message, NO_MORE_BETS_MSG_TYPE)
+}
+
+// DecodeAskForWinnersMessage parsea un mensaje de tipo ASK y devuelve el ID de la agencia.
+// Ejemplo de entrada: ASK["agency":"1"]
+func DecodeAskForWinnersMessage(message string) (string, error) {
+	return decodeAgencyMessage(message, ASK_FOR_WINNERS_MSG_TYPE)
+}
+
+// DecodeSubscribeMessage parsea un mensaje de tipo SUB y devuelve el ID de la agencia.
+// Ejemplo de entrada: SUB["agency":"1"]
+func DecodeSubscribeMessage(message string) (string, error) {
+	return decodeAgencyMessage(message, SUBSCRIBE_MSG_TYPE)
+}
+
+// DecodeHelloMessage parsea un mensaje de tipo HLO y devuelve el ID de la agencia y si
+// el cliente soporta el control de flujo por créditos.
+// Ejemplo de entrada: HLO["agency":"1","credits":"true"]
+func DecodeHelloMessage(message string) (string, bool, error) {
+	err := assertMessageFormat(message, HELLO_MSG_TYPE)
+	if err != nil {
+		return "", false, err
+	}
+
+	encodedAgency, encodedCredits, hasCredits := cutString(getMessagePayload(message), BET_FIELDS_SEPARATOR)
+	fieldName, agency, err := decodeField(encodedAgency)
+	if err != nil {
+		return "", false, err
+	}
+	if fieldName != "agency" {
+		return "", false, fmt.Errorf("unexpected field: expected agency but received %s", fieldName)
+	}
+	if !hasCredits {
+		return agency, false, nil
+	}
+
+	fieldName, fieldValue, err := decodeField(encodedCredits)
+	if err != nil {
+		return "", false, err
+	}
+	credits, err := strconv.ParseBool(fieldValue)
+	if fieldName != "credits" || err != nil {
+		return "", false, fmt.Errorf("unexpected field: %s", encodedCredits)
+	}
+	return agency, credits, nil
+}
+
+// DecodeBusyMessage parsea un mensaje de tipo BSY y devuelve cuánto esperar antes de reintentar.
+// Ejemplo de entrada: BSY[250]
+func DecodeBusyMessage(message string) (time.Duration, error) {
+	err := assertMessageFormat(message, BUSY_MSG_TYPE)
+	if err != nil {
+		return 0, err
+	}
+
+	milliseconds, err := strconv.ParseInt(getMessagePayload(message), 10, 64)
+	if err != nil || milliseconds < 0 {
+		return 0, fmt.Errorf("unexpected retry after: %s", getMessagePayload(message))
+	}
+	return time.Duration(milliseconds) * time.Millisecond, nil
+}
+
+// decodeCredits parsea los créditos otorgados en formato batches,bytes.
+// Ejemplo de entrada: 2,16384
+func decodeCredits(encodedCredits string) (Credits, error) {
+	encodedBatches, encodedBytes, found := cutString(encodedCredits, CREDITS_SEPARATOR)
+	if !found {
+		return Credits{}, fmt.Errorf("unexpected credits format: %s", encodedCredits)
+	}
+	batches, batchesErr := strconv.Atoi(encodedBatches)
+	bytes, bytesErr := strconv.Atoi(encodedBytes)
+	if batchesErr != nil || bytesErr != nil || batches < 0 || bytes < 0 {
+		return Credits{}, fmt.Errorf("unexpected credits: %s", encodedCredits)
+	}
+	return Credits{Batches: batches, Bytes: bytes}, nil
+}
+
+// DecodeCreditMessage parsea un mensaje de tipo CRD y devuelve los créditos otorgados.
+// Ejemplo de entrada: CRD[2,16384]
+func DecodeCreditMessage(message string) (Credits, error) {
+	err := assertMessageFormat(message, CREDIT_MSG_TYPE)
+	if err != nil {
+		return Credits{}, err
+	}
+	return decodeCredits(getMessagePayload(message))
+}
+
+// DecodeAckCredits separa los créditos otorgados junto a un ACK. Devuelve el ACK sin
+// ellos, los créditos, y si el ACK los traía. Un ACK sin créditos se devuelve intacto.
+// Ejemplo de entrada: ACK[50;2,16384] -> Salida: ACK[50], {2 16384}, true
+func DecodeAckCredits(message string) (string, Credits, bool, error) {
+	err := assertMessageFormat(message, ACK_MSG_TYPE)
+	if err != nil {
+		return "", Credits{}, false, err
+	}
+
+	payload, encodedCredits, found := cutString(getMessagePayload(message), ACK_CREDITS_SEPARATOR)
+	if !found {
+		return message, Credits{}, false, nil
+	}
+	credits, err := decodeCredits(encodedCredits)
+	if err != nil {
+		return "", Credits{}, false, err
+	}
+	return EncodeAckMessage(payload), credits, true, nil
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestBetBatch(size int) []*Bet {
+	betBatch := make([]*Bet, 0, size)
+	for i := 0; i < size; i++ {
+		betBatch = append(betBatch, NewBet("1", "Santiago Lionel", "Lorca", fmt.Sprintf("%08d", 30904465+i), "1999-03-17", "7574"))
+	}
+	return betBatch
+}
+
+func TestLengthWhenEncoded(t *testing.T) {
+	bet := NewBet("12", "María José", "Fernández", "30904465", "1999-03-17", "7574")
+	if bet.LengthWhenEncoded() != len(EncodeBet(bet)) {
+		t.Fatalf("length mismatch: got %d, want %d", bet.LengthWhenEncoded(), len(EncodeBet(bet)))
+	}
+}
+
+func TestHandshakeMessages(t *testing.T) {
+	if encoded := EncodeHelloMessage("3", false); encoded != `HLO["agency":"3"]` {
+		t.Fatalf("unexpected encoded message: %s", encoded)
+	}
+	if agency, credits, err := DecodeHelloMessage(EncodeHelloMessage("3", false)); err != nil || agency != "3" || credits {
+		t.Fatalf("unexpected decoded agency %q, credits %v, error %v", agency, credits, err)
+	}
+	if encoded := EncodeHelloMessage("3", true); encoded != `HLO["agency":"3","credits":"true"]` {
+		t.Fatalf("unexpected encoded message: %s", encoded)
+	}
+	if agency, credits, err := DecodeHelloMessage(EncodeHelloMessage("3", true)); err != nil || agency != "3" || !credits {
+		t.Fatalf("unexpected decoded agency %q, credits %v, error %v", agency, credits, err)
+	}
+
+	if encoded := EncodeBusyMessage(250 * time.Millisecond); encoded != "BSY[250]" {
+		t.Fatalf("unexpected encoded message: %s", encoded)
+	}
+	if retryAfter, err := DecodeBusyMessage("BSY[250]"); err != nil || retryAfter != 250*time.Millisecond {
+		t.Fatalf("unexpected retry after %v, error %v", retryAfter, err)
+	}
+	for _, message := range []string{"BSY[]", "BSY[-1]", "BSY[soon]", "ACK[250]"} {
+		if _, err := DecodeBusyMessage(message); err == nil {
+			t.Fatalf("expected %s to be rejected", message)
+		}
+	}
+}
+
+func TestWinnersQueryMessages(t *testing.T) {
+	if encoded := EncodeSubscribeMessage("4"); encoded != `SUB["agency":"4"]` {
+		t.Fatalf("unexpected encoded message: %s", encoded)
+	}
+	if agency, err := DecodeSubscribeMessage(EncodeSubscribeMessage("4")); err != nil || agency != "4" {
+		t.Fatalf("unexpected decoded agency %q, error %v", agency, err)
+	}
+	for encoded, expected := range map[string]string{
+		EncodeWaitMessage(): "WIT[]",
+		EncodePingMessage(): "PNG[]",
+		EncodePongMessage(): "PON[]",
+	} {
+		if encoded != expected {
+			t.Fatalf("unexpected encoded message: got %s, want %s", encoded, expected)
+		}
+	}
+}
+
+func TestCreditMessages(t *testing.T) {
+	credits := Credits{Batches: 2, Bytes: 16384}
+	if encoded := EncodeCreditMessage(credits); encoded != "CRD[2,16384]" {
+		t.Fatalf("unexpected encoded message: %s", encoded)
+	}
+	if decoded, err := DecodeCreditMessage("CRD[2,16384]"); err != nil || decoded != credits {
+		t.Fatalf("unexpected decoded credits %v, error %v", decoded, err)
+	}
+	for _, message := range []string{"CRD[]", "CRD[2]", "CRD[-1,0]", "CRD[2,many]", "ACK[2,16384]"} {
+		if _, err := DecodeCreditMessage(message); err == nil {
+			t.Fatalf("expected %s to be rejected", message)
+		}
+	}
+
+	encoded := EncodeAckWithCreditsMessage("50", credits)
+	if encoded != "ACK[50;2,16384]" {
+		t.Fatalf("unexpected encoded message: %s", encoded)
+	}
+	if ack, decoded, granted, err := DecodeAckCredits(encoded); err != nil || ack != "ACK[50]" || decoded != credits || !granted {
+		t.Fatalf("unexpected ack %s with credits %v (%v), error %v", ack, decoded, granted, err)
+	}
+	if ack, _, granted, err := DecodeAckCredits("ACK[NMB]"); err != nil || ack != "ACK[NMB]" || granted {
+		t.Fatalf("expected an ACK without credits to be left as it is, got %s (%v), error %v", ack, granted, err)
+	}
+}
+
+func BenchmarkLengthWhenEncoded(b *testing.B) {
+	bet := newTestBetBatch(1)[0]
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = bet.LengthWhenEncoded()
+	}
+}
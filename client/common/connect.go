@@ -0,0 +1,201 @@
+package common
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	DEFAULT_CONNECT_RETRY_BACKOFF = 100 * time.Millisecond
+
+	// MAX_CONNECT_RETRY_BACKOFF bounds the wait between two attempts to
+	// connect, however many attempts failed
+	MAX_CONNECT_RETRY_BACKOFF = 5 * time.Second
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// ConnectPolicy tells how the client opens its connections to the server
+type ConnectPolicy struct {
+	// Jitter is the longest random wait before the first connection, so
+	// clients started at once do not dial at once. Zero dials right away
+	Jitter time.Duration
+
+	// RetryMaxWait bounds the total time waited between attempts when the
+	// connection is refused or reset, or the server is busy. Zero means the
+	// first failure is final
+	RetryMaxWait time.Duration
+
+	// RetryBackoff is the wait before the second attempt, doubled on every
+	// following one up to MAX_CONNECT_RETRY_BACKOFF. Each wait is randomized
+	// down to half of it. When zero, DEFAULT_CONNECT_RETRY_BACKOFF is used
+	RetryBackoff time.Duration
+
+	// Handshake makes the client send HLO once connected and wait for the
+	// server to admit it with ACK[HLO]. A server answering BSY asks the
+	// client to connect again later. Only servers that support it can be
+	// used with it
+	Handshake bool
+
+	// KeepAlive is the time between the TCP keepalive probes of the
+	// connection. Zero uses the default of net.Dialer and a negative value
+	// disables them. It is ignored when the client is given its own Dial
+	KeepAlive time.Duration
+
+	// Credits advertises support for credit flow control in the HLO, which
+	// it implies. A server that supports it admits the client with a CRD
+	// granting the first credits, and grants more in the ACKs or in CRD
+	// messages. The client never sends a batch beyond its credits: batches
+	// are cut to the bytes left, and it waits up to the AckTimeout for the
+	// batch credits. A server granting fewer bytes than a batch of a single
+	// bet needs fails the run. Servers answering ACK[HLO] do not limit the
+	// client
+	Credits bool
+}
+
+// ============================== PRIVATE - DIAL ============================== //
+
+// dialer Returns the dialer of the connections opened with the policy
+func (policy ConnectPolicy) dialer() *net.Dialer {
+	return &net.Dialer{KeepAlive: policy.KeepAlive}
+}
+
+// ============================== PRIVATE - WAIT ============================== //
+
+// randomDuration Returns a random duration from zero up to max, taken from
+// crypto/rand so clients started at the same time do not share it
+func randomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	random, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return max / 2
+	}
+	return time.Duration(random.Int64())
+}
+
+// sleep Waits for duration, returning ErrInterrupted if the client is
+// stopped first
+func (client *Client) sleep(duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-client.stopped:
+		return ErrInterrupted
+	}
+}
+
+// waitStartupJitter Waits a random time up to the configured Jitter before
+// the first connection of the client. Following connections do not wait
+func (client *Client) waitStartupJitter() error {
+	var err error
+	client.jitterOnce.Do(func() {
+		wait := randomDuration(client.config.Connect.Jitter)
+		if wait <= 0 {
+			return
+		}
+		client.log.Infof("action: connect_jitter | result: in_progress | client_id: %v | wait: %v", client.config.ID, wait)
+		err = client.sleep(wait)
+	})
+	return err
+}
+
+// ============================== PRIVATE - RETRY ============================== //
+
+// isRetryableConnectError Tells whether connecting again may succeed: the
+// server refused or reset the connection, as it does when its listen backlog
+// is full, or asked to retry later
+func isRetryableConnectError(err error) bool {
+	var busy *ServerBusyError
+	return errors.As(err, &busy) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// connectWithRetries Calls connect until it succeeds, fails with an error
+// that is not worth retrying, or the next wait would exceed RetryMaxWait.
+// Busy servers are retried after the time they ask for, and every other
+// failure after an exponential backoff
+func (client *Client) connectWithRetries(connect func() error) error {
+	policy := client.config.Connect
+	backoff := policy.RetryBackoff
+	if backoff <= 0 {
+		backoff = DEFAULT_CONNECT_RETRY_BACKOFF
+	}
+
+	waited := time.Duration(0)
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil || !isRetryableConnectError(err) {
+			return err
+		}
+
+		wait := backoff/2 + randomDuration(backoff/2)
+		var busy *ServerBusyError
+		if errors.As(err, &busy) {
+			wait = busy.RetryAfter
+		}
+		if waited+wait > policy.RetryMaxWait {
+			return err
+		}
+
+		client.log.Warningf("action: connect | result: retry | client_id: %v | attempt: %v | wait: %v | error: %v", client.config.ID, attempt, wait, err)
+		client.config.Observer.ConnectRetried(attempt, wait, err)
+		if err := client.sleep(wait); err != nil {
+			return err
+		}
+		waited += wait
+
+		backoff *= 2
+		if backoff > MAX_CONNECT_RETRY_BACKOFF {
+			backoff = MAX_CONNECT_RETRY_BACKOFF
+		}
+	}
+}
+
+// ============================== PRIVATE - HANDSHAKE ============================== //
+
+// handshake Asks the server to admit the client on the open connection. A
+// BSY reply is returned as a ServerBusyError. When credits were advertised,
+// a CRD reply admits the client and opens its credit window
+func (client *Client) handshake() error {
+	advertiseCredits := client.config.Connect.Credits
+	if err := client.sendMessage(EncodeHelloMessage(client.config.ID, advertiseCredits)); err != nil {
+		return err
+	}
+	receivedMessage, err := client.receiveAckMessage()
+	if err != nil {
+		return err
+	}
+
+	if receivedMessage == EncodeAckMessage(HELLO_MSG_TYPE) {
+		client.log.Debugf("action: handshake | result: success | client_id: %v", client.config.ID)
+		return nil
+	}
+	messageType, _ := DecodeMessageType(receivedMessage)
+	if messageType == CREDIT_MSG_TYPE && advertiseCredits {
+		credits, err := DecodeCreditMessage(receivedMessage)
+		if err != nil {
+			return NewError(ErrProtocol, err)
+		}
+		client.credits.Open(credits)
+		client.log.Debugf("action: handshake | result: success | client_id: %v | credits: %v", client.config.ID, credits)
+		return nil
+	}
+	if messageType == BUSY_MSG_TYPE {
+		retryAfter, err := DecodeBusyMessage(receivedMessage)
+		if err != nil {
+			return NewError(ErrProtocol, err)
+		}
+		return &ServerBusyError{RetryAfter: retryAfter}
+	}
+	return NewError(ErrProtocol, fmt.Errorf("unexpected handshake reply: %s", receivedMessage))
+}
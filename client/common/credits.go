@@ -0,0 +1,125 @@
+package common
+
+import (
+	"fmt"
+	"time"
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// Credits are the batches and bytes a server allows a client to send
+type Credits struct {
+	Batches int
+	Bytes   int
+}
+
+// CreditWindow keeps the credits a server granted on a connection. The
+// server limits the batches, the bytes, or both, by granting a non zero
+// amount of them when it admits the client. Every batch sent takes one
+// batch and its bytes from the window, and every following grant adds to
+// it. The zero CreditWindow limits nothing, as servers without credits do
+type CreditWindow struct {
+	limitsBatches bool
+	limitsBytes   bool
+	available     Credits
+}
+
+// ============================== PUBLIC - CREDIT WINDOW ============================== //
+
+// Open Starts limiting the dimensions granted by initial, with initial as
+// the credits available
+func (window *CreditWindow) Open(initial Credits) {
+	window.limitsBatches = initial.Batches > 0
+	window.limitsBytes = initial.Bytes > 0
+	window.available = initial
+}
+
+// Limited Tells whether the window limits the batches or the bytes sent
+func (window *CreditWindow) Limited() bool {
+	return window.limitsBatches || window.limitsBytes
+}
+
+// Available Returns the credits left
+func (window *CreditWindow) Available() Credits {
+	return window.available
+}
+
+// Grant Adds the granted credits to the dimensions the window limits
+func (window *CreditWindow) Grant(credits Credits) {
+	if window.limitsBatches {
+		window.available.Batches += credits.Batches
+	}
+	if window.limitsBytes {
+		window.available.Bytes += credits.Bytes
+	}
+}
+
+// Allows Tells whether a batch of batchBytes can be sent with the credits left
+func (window *CreditWindow) Allows(batchBytes int) bool {
+	if window.limitsBatches && window.available.Batches < 1 {
+		return false
+	}
+	return !window.limitsBytes || window.available.Bytes >= batchBytes
+}
+
+// Cap Returns batchBytes, lowered to the bytes left when the window limits
+// them, so a batch built within it never waits for credits that would only
+// be granted once it is sent
+func (window *CreditWindow) Cap(batchBytes int) int {
+	if window.limitsBytes && window.available.Bytes < batchBytes {
+		return window.available.Bytes
+	}
+	return batchBytes
+}
+
+// Take Takes the credits of a batch of batchBytes from the window
+func (window *CreditWindow) Take(batchBytes int) {
+	if window.limitsBatches {
+		window.available.Batches--
+	}
+	if window.limitsBytes {
+		window.available.Bytes -= batchBytes
+	}
+}
+
+// ============================== PRIVATE - CLIENT ============================== //
+
+// grantCredits Adds the credits the server granted to the window of the
+// connection
+func (client *Client) grantCredits(credits Credits) {
+	client.credits.Grant(credits)
+	client.log.Debugf("action: grant_credits | result: success | client_id: %v | granted: %v | available: %v", client.config.ID, credits, client.credits.Available())
+}
+
+// waitForCredits Blocks until the server granted enough credits to send a
+// batch of batchBytes, reading CRD messages within the AckTimeout, then
+// takes them from the window
+func (client *Client) waitForCredits(batchBytes int) error {
+	if !client.credits.Allows(batchBytes) {
+		client.log.Infof("action: wait_credits | result: in_progress | client_id: %v | batch_bytes: %v | available: %v", client.config.ID, batchBytes, client.credits.Available())
+
+		waitedSince := time.Now()
+		for !client.credits.Allows(batchBytes) {
+			receivedMessage, err := client.receiveMessageWithinAckTimeout()
+			if err != nil {
+				return err
+			}
+			if messageType, _ := DecodeMessageType(receivedMessage); messageType == PONG_MSG_TYPE {
+				client.pongReceived()
+				continue
+			}
+			credits, err := DecodeCreditMessage(receivedMessage)
+			if err != nil {
+				return NewError(ErrProtocol, fmt.Errorf("unexpected message while waiting for credits: %w", err))
+			}
+			client.grantCredits(credits)
+		}
+
+		waited := time.Since(waitedSince)
+		client.log.Infof("action: wait_credits | result: success | client_id: %v | waited: %v", client.config.ID, waited)
+		client.config.Observer.WaitedForCredits(waited)
+	}
+
+	client.credits.Take(batchBytes)
+	return nil
+}
@@ -0,0 +1,29 @@
+package common
+
+import "testing"
+
+func TestCreditWindow(t *testing.T) {
+	var window CreditWindow
+	if window.Limited() || !window.Allows(1<<20) {
+		t.Fatal("expected the zero window not to limit anything")
+	}
+
+	window.Open(Credits{Batches: 1})
+	if !window.Allows(1 << 20) {
+		t.Fatal("expected a window without bytes to allow any batch size")
+	}
+	window.Take(1 << 20)
+	if window.Allows(1) {
+		t.Fatal("expected the window to be out of batches")
+	}
+	window.Grant(Credits{Batches: 1, Bytes: 100})
+	if window.Available() != (Credits{Batches: 1}) {
+		t.Fatalf("expected only batches to be granted, got %v", window.Available())
+	}
+
+	window.Open(Credits{Bytes: 100})
+	window.Take(60)
+	if window.Allows(60) || !window.Allows(40) {
+		t.Fatalf("unexpected credits left: %v", window.Available())
+	}
+}
@@ -0,0 +1,190 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ============================== CONSTANTS ============================== //
+
+// Kinds of failure of a client. Every error returned by the client matches,
+// with errors.Is, at most one of them
+var (
+	// ErrConfig means the configuration is invalid. Retrying without
+	// fixing it fails again
+	ErrConfig = errors.New("invalid configuration")
+
+	// ErrConnect means the connection to the server could not be opened, was
+	// lost, or the server did not answer in time. Retrying may succeed
+	ErrConnect = errors.New("connection to the server failed")
+
+	// ErrProtocol means the server sent a message that could not be decoded
+	// or verified
+	ErrProtocol = errors.New("protocol error")
+
+	// ErrAckMismatch means the server acknowledged a message with an
+	// unexpected ACK, so it is not known which bets it stored
+	ErrAckMismatch = errors.New("bad ack message")
+
+	// ErrInput means the agency file could not be opened or read
+	ErrInput = errors.New("invalid agency file")
+
+	// ErrInterrupted means the client was stopped, by SIGTERM or by Stop,
+	// before finishing
+	ErrInterrupted = errors.New("interrupted before finishing")
+)
+
+// Exit codes of the client for each kind of failure, so orchestration
+// scripts can decide whether to retry:
+//
+//	0    EXIT_SUCCESS       every bet was sent and the winners were received
+//	1    EXIT_UNKNOWN       failure of an unknown kind
+//	2    EXIT_CONFIG        ErrConfig, do not retry until the config is fixed
+//	3    EXIT_CONNECT       ErrConnect, safe to retry
+//	4    EXIT_PROTOCOL      ErrProtocol
+//	5    EXIT_ACK_MISMATCH  ErrAckMismatch, check what the server stored first
+//	6    EXIT_INPUT         ErrInput, do not retry until the file is fixed
+//	143  EXIT_INTERRUPTED   ErrInterrupted, 128 + SIGTERM as shells report it
+const (
+	EXIT_SUCCESS      = 0
+	EXIT_UNKNOWN      = 1
+	EXIT_CONFIG       = 2
+	EXIT_CONNECT      = 3
+	EXIT_PROTOCOL     = 4
+	EXIT_ACK_MISMATCH = 5
+	EXIT_INPUT        = 6
+	EXIT_INTERRUPTED  = 143
+)
+
+// exitCodes maps each kind of failure to its exit code. ErrInterrupted goes
+// first, since an interrupted step also fails with the error that the
+// interruption caused
+var exitCodes = []struct {
+	kind     error
+	exitCode int
+}{
+	{ErrInterrupted, EXIT_INTERRUPTED},
+	{ErrConfig, EXIT_CONFIG},
+	{ErrConnect, EXIT_CONNECT},
+	{ErrProtocol, EXIT_PROTOCOL},
+	{ErrAckMismatch, EXIT_ACK_MISMATCH},
+	{ErrInput, EXIT_INPUT},
+}
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// Error is a failure of the client tagged with its kind, one of the Err*
+// sentinels. It matches its kind with errors.Is and unwraps to its cause
+type Error struct {
+	Kind error
+	Err  error
+}
+
+// AckMismatchError is the ErrAckMismatch failure, with the expected and
+// received ACK messages
+type AckMismatchError struct {
+	Expected string
+	Received string
+}
+
+// ServerBusyError is the ErrConnect failure of a server that answered the
+// handshake with BUSY, asking to connect again after RetryAfter
+type ServerBusyError struct {
+	RetryAfter time.Duration
+}
+
+// DrawNotReadyError is the ErrConnect failure of a winners query that gave
+// up after waiting for the draw as long as allowed
+type DrawNotReadyError struct {
+	Waited time.Duration
+}
+
+// DeadPeerError is the ErrConnect failure of a connection closed because
+// the server left MissedPongs heartbeats unanswered
+type DeadPeerError struct {
+	MissedPongs int
+}
+
+// ============================== BUILDER ============================== //
+
+// NewError Tags err with the given kind. Errors that already have a kind
+// keep it, and nil is returned for a nil err
+func NewError(kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+	if KindOf(err) != nil {
+		return err
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// ============================== PUBLIC ============================== //
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *AckMismatchError) Error() string {
+	return fmt.Sprintf("%v: expected %s but received %s", ErrAckMismatch, e.Expected, e.Received)
+}
+
+func (e *AckMismatchError) Is(target error) bool {
+	return target == ErrAckMismatch
+}
+
+func (e *ServerBusyError) Error() string {
+	return fmt.Sprintf("%v: server busy, retry after %v", ErrConnect, e.RetryAfter)
+}
+
+func (e *ServerBusyError) Is(target error) bool {
+	return target == ErrConnect
+}
+
+func (e *DrawNotReadyError) Error() string {
+	return fmt.Sprintf("%v: draw not held after waiting %v", ErrConnect, e.Waited)
+}
+
+func (e *DrawNotReadyError) Is(target error) bool {
+	return target == ErrConnect
+}
+
+func (e *DeadPeerError) Error() string {
+	return fmt.Sprintf("%v: dead peer, %d heartbeats unanswered", ErrConnect, e.MissedPongs)
+}
+
+func (e *DeadPeerError) Is(target error) bool {
+	return target == ErrConnect
+}
+
+// KindOf Returns the kind of failure of err, or nil if it has none
+func KindOf(err error) error {
+	for _, candidate := range exitCodes {
+		if errors.Is(err, candidate.kind) {
+			return candidate.kind
+		}
+	}
+	return nil
+}
+
+// ExitCode Returns the exit code the client must finish with after err
+func ExitCode(err error) int {
+	if err == nil {
+		return EXIT_SUCCESS
+	}
+	for _, candidate := range exitCodes {
+		if errors.Is(err, candidate.kind) {
+			return candidate.exitCode
+		}
+	}
+	return EXIT_UNKNOWN
+}
@@ -0,0 +1,46 @@
+package common_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+func TestExitCodeOfEachKind(t *testing.T) {
+	cases := []struct {
+		err      error
+		exitCode int
+	}{
+		{nil, common.EXIT_SUCCESS},
+		{errors.New("boom"), common.EXIT_UNKNOWN},
+		{common.NewError(common.ErrConfig, errors.New("bad key")), common.EXIT_CONFIG},
+		{common.NewError(common.ErrConnect, io.EOF), common.EXIT_CONNECT},
+		{common.NewError(common.ErrProtocol, errors.New("bad frame")), common.EXIT_PROTOCOL},
+		{&common.AckMismatchError{Expected: "ACK[1]", Received: "ACK[2]"}, common.EXIT_ACK_MISMATCH},
+		{fmt.Errorf("reading: %w", common.NewError(common.ErrInput, io.ErrUnexpectedEOF)), common.EXIT_INPUT},
+		{&common.Error{Kind: common.ErrInterrupted, Err: common.NewError(common.ErrConnect, io.EOF)}, common.EXIT_INTERRUPTED},
+	}
+
+	for _, c := range cases {
+		if exitCode := common.ExitCode(c.err); exitCode != c.exitCode {
+			t.Errorf("exit code of %v: got %d, want %d", c.err, exitCode, c.exitCode)
+		}
+	}
+}
+
+func TestNewErrorKeepsTheFirstKind(t *testing.T) {
+	err := common.NewError(common.ErrProtocol, common.NewError(common.ErrConnect, io.EOF))
+
+	if common.KindOf(err) != common.ErrConnect || errors.Is(err, common.ErrProtocol) {
+		t.Fatalf("unexpected kind of %v: %v", err, common.KindOf(err))
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected %v to unwrap to its cause", err)
+	}
+	if common.NewError(common.ErrConfig, nil) != nil {
+		t.Fatal("expected no error for a nil cause")
+	}
+}
@@ -0,0 +1,192 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	DEFAULT_MAX_MISSED_PONGS = 3
+
+	// HEARTBEAT_DRAIN_WAIT is how long the heartbeats wait for more
+	// messages when taking the ones that arrived while the client is idle
+	HEARTBEAT_DRAIN_WAIT = time.Millisecond
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// HeartbeatPolicy tells how the client checks that the server is still
+// there while the connection is idle. Heartbeats are PNG messages, each
+// answered by the server with PON. Only servers that support them can be
+// used with them
+type HeartbeatPolicy struct {
+	// Interval is the time between two PNG messages. Zero disables the
+	// heartbeats, except while subscribed to the draw
+	Interval time.Duration
+
+	// MaxMissedPongs is the amount of PNG messages left unanswered after
+	// which the server is given up for dead, whether the client is waiting
+	// for a reply or idle. When zero, DEFAULT_MAX_MISSED_PONGS is used
+	MaxMissedPongs int
+}
+
+// heartbeats is the goroutine sending the PNG messages of a connection
+type heartbeats struct {
+	conn net.Conn
+	stop chan struct{}
+	done chan struct{}
+}
+
+// receivedMessage is a message, or the error reading it, that the
+// heartbeats read while the client was not reading
+type receivedMessage struct {
+	message string
+	err     error
+}
+
+// ============================== PRIVATE - POLICY ============================== //
+
+func (policy HeartbeatPolicy) maxMissedPongs() int {
+	if policy.MaxMissedPongs <= 0 {
+		return DEFAULT_MAX_MISSED_PONGS
+	}
+	return policy.MaxMissedPongs
+}
+
+// ============================== PRIVATE - HEARTBEATS ============================== //
+
+// startHeartbeats Starts sending a PNG every interval on the current
+// connection, unless it is already done
+func (client *Client) startHeartbeats(interval time.Duration) {
+	if client.heartbeats != nil || interval <= 0 {
+		return
+	}
+	client.heartbeats = &heartbeats{conn: client.conn, stop: make(chan struct{}), done: make(chan struct{})}
+	atomic.StoreInt64(&client.lastPongAt, time.Now().UnixNano())
+	go client.sendHeartbeats(interval, client.heartbeats)
+	client.log.Debugf("action: start_heartbeats | result: success | client_id: %v | interval: %v", client.config.ID, interval)
+}
+
+// stopHeartbeats Stops sending PNG messages and waits for the goroutine
+// sending them to finish, so it never writes to a following connection
+func (client *Client) stopHeartbeats() {
+	if client.heartbeats == nil {
+		return
+	}
+	close(client.heartbeats.stop)
+	<-client.heartbeats.done
+	client.heartbeats = nil
+}
+
+// sendHeartbeats Sends a PNG every interval until stopped, a PNG cannot be
+// sent, or the server is given up for dead. Before each one, the answers to
+// the previous ones are taken if the client is not reading. Writes are
+// serialized with the ones of the goroutine driving the client by sendFrame
+func (client *Client) sendHeartbeats(interval time.Duration, heartbeats *heartbeats) {
+	defer close(heartbeats.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-heartbeats.stop:
+			return
+		}
+
+		client.drainReceivedMessages(heartbeats.conn)
+		if client.missedTooManyPongs() {
+			client.declarePeerDead()
+			return
+		}
+		if err := client.sendMessage(EncodePingMessage()); err != nil {
+			return
+		}
+		atomic.AddInt32(&client.unansweredPings, 1)
+	}
+}
+
+// drainReceivedMessages Reads the messages that already arrived while the
+// client is not reading, so the PON messages are noticed even while it is
+// idle. Other messages are kept for receiveMessage, in the order they
+// arrived. Nothing is done while the client is reading, since it takes the
+// PON messages itself
+func (client *Client) drainReceivedMessages(conn net.Conn) {
+	select {
+	case <-client.readToken:
+	default:
+		return
+	}
+	defer func() { client.readToken <- struct{}{} }()
+
+	for !client.failedReading() {
+		if err := conn.SetReadDeadline(time.Now().Add(HEARTBEAT_DRAIN_WAIT)); err != nil {
+			return
+		}
+		msg, err := client.readMessage()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return
+		}
+		if messageType, _ := DecodeMessageType(msg); err == nil && messageType == PONG_MSG_TYPE {
+			client.pongReceived()
+			continue
+		}
+		client.receivedMessages = append(client.receivedMessages, receivedMessage{message: msg, err: err})
+	}
+}
+
+// failedReading Tells whether the heartbeats already failed reading the
+// connection, so it must not be read again. It must be called holding the
+// readToken
+func (client *Client) failedReading() bool {
+	received := len(client.receivedMessages)
+	return received > 0 && client.receivedMessages[received-1].err != nil
+}
+
+// missedTooManyPongs Tells whether the server left too many PNG messages
+// unanswered
+func (client *Client) missedTooManyPongs() bool {
+	return int(atomic.LoadInt32(&client.unansweredPings)) >= client.config.Heartbeat.maxMissedPongs()
+}
+
+// declarePeerDead Closes the connection of a server that stopped answering
+// the heartbeats, so the step in progress fails with a DeadPeerError
+func (client *Client) declarePeerDead() {
+	atomic.StoreInt32(&client.peerDead, 1)
+	silentFor := time.Since(time.Unix(0, atomic.LoadInt64(&client.lastPongAt))).Round(time.Millisecond)
+	client.log.Errorf("action: heartbeat | result: fail | client_id: %v | missed_pongs: %v | silent_for: %v", client.config.ID, atomic.LoadInt32(&client.unansweredPings), silentFor)
+
+	client.connLock.Lock()
+	defer client.connLock.Unlock()
+	if client.conn != nil {
+		client.conn.Close()
+	}
+}
+
+// pongReceived Records that the server answered the heartbeats. While
+// subscribed to the draw, each answer is logged as the progress of the wait
+func (client *Client) pongReceived() {
+	atomic.StoreInt32(&client.unansweredPings, 0)
+	atomic.StoreInt64(&client.lastPongAt, time.Now().UnixNano())
+
+	waitingWinnersSince := atomic.LoadInt64(&client.waitingWinnersSince)
+	if waitingWinnersSince == 0 {
+		client.log.Debugf("action: heartbeat | result: success | client_id: %v", client.config.ID)
+		return
+	}
+	client.log.Infof("action: wait_winners | result: in_progress | client_id: %v | waited: %v", client.config.ID, time.Since(time.Unix(0, waitingWinnersSince)).Round(time.Millisecond))
+}
+
+// connectionError Tags an error reading or writing the connection, telling
+// apart a connection closed because the server stopped answering heartbeats
+func (client *Client) connectionError(err error) error {
+	if atomic.LoadInt32(&client.peerDead) == 1 {
+		return &DeadPeerError{MissedPongs: int(atomic.LoadInt32(&client.unansweredPings))}
+	}
+	return NewError(ErrConnect, err)
+}
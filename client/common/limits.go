@@ -0,0 +1,48 @@
+package common
+
+import (
+	"time"
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// Limits are the settings of a client that can be changed while it runs.
+// They start as the ones of its ClientConfig
+type Limits struct {
+	MaxAmountOfBetsOnEachBatch int
+	MaxKiBPerBatch             int
+
+	// AckTimeout bounds how long the client waits for the acknowledgement
+	// of each message. Zero means waiting forever
+	AckTimeout time.Duration
+
+	AdaptiveBatching AdaptiveBatching
+}
+
+// ============================== PRIVATE ============================== //
+
+func (client *Client) currentLimits() Limits {
+	return client.limits.Load().(Limits)
+}
+
+// ============================== PUBLIC ============================== //
+
+// Limits Returns the limits the client is currently using
+func (client *Client) Limits() Limits {
+	return client.currentLimits()
+}
+
+// UpdateLimits Replaces the limits of the client. It is safe to call it from
+// any goroutine while the client runs: the batch being built keeps the
+// limits it was started with, and the following ones use the new limits, so
+// no batch ever mixes both. A new AckTimeout applies from the next message
+func (client *Client) UpdateLimits(limits Limits) {
+	client.limits.Store(limits)
+	client.log.Infof("action: update_limits | result: success | client_id: %v | batch_max_amount: %v | batch_max_kib: %v | ack_timeout: %v | batch_target_latency: %v",
+		client.config.ID,
+		limits.MaxAmountOfBetsOnEachBatch,
+		limits.MaxKiBPerBatch,
+		limits.AckTimeout,
+		limits.AdaptiveBatching.TargetLatency,
+	)
+}
@@ -0,0 +1,31 @@
+package common
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// Logger receives the log events of the client. Messages follow the
+// "action: X | result: Y | client_id: Z | k: v" convention
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+
+	// DebugEnabled tells whether debug events are logged, so the client can
+	// skip preparing their arguments on hot paths
+	DebugEnabled() bool
+
+	// InfoEnabled tells whether info events are logged, for the same reason
+	InfoEnabled() bool
+}
+
+// NopLogger discards every event. It is the Logger used when none is set
+type NopLogger struct{}
+
+// ============================== PUBLIC ============================== //
+
+func (NopLogger) Debugf(format string, args ...interface{})   {}
+func (NopLogger) Infof(format string, args ...interface{})    {}
+func (NopLogger) Warningf(format string, args ...interface{}) {}
+func (NopLogger) Errorf(format string, args ...interface{})   {}
+func (NopLogger) DebugEnabled() bool                          { return false }
+func (NopLogger) InfoEnabled() bool                           { return false }
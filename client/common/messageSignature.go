@@ -0,0 +1,250 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	// SIGNATURE_MSG_TYPE prefixes the envelope that signs a message:
+	// SIG{agency,nonce,timestamp,mac}TYPE[payload]
+	SIGNATURE_MSG_TYPE = "SIG"
+
+	START_SIGNATURE_DELIMITER  = "{"
+	END_SIGNATURE_DELIMITER    = "}"
+	SIGNATURE_FIELDS_SEPARATOR = ","
+
+	SIGNATURE_FIELDS = 4
+
+	DEFAULT_MAX_CLOCK_SKEW = 30 * time.Second
+
+	// The direction of a message is part of its MAC. Both peers share the
+	// key and the envelope, so without it a message signed by the agency
+	// could be reflected back to it as if the server had sent it
+	DIRECTION_AGENCY_TO_SERVER byte = 'A'
+	DIRECTION_SERVER_TO_AGENCY byte = 'S'
+)
+
+var (
+	ErrUnsignedMessage  = errors.New("message is not signed")
+	ErrInvalidSignature = errors.New("invalid message signature")
+	ErrReplayedMessage  = errors.New("replayed message")
+	ErrStaleMessage     = errors.New("message timestamp out of the accepted clock skew")
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// SignatureEnvelope holds the fields that precede a signed message
+type SignatureEnvelope struct {
+	Agency    string
+	Nonce     uint64
+	Timestamp int64
+	MAC       string
+}
+
+// MessageSigner signs the messages sent by an agency and verifies the ones
+// it receives, using an HMAC-SHA256 keyed with the secret shared by the
+// agency and the server. The signature covers the message type, the
+// payload, the agency, the direction of the message, a nonce that increases
+// with every message and a timestamp in milliseconds. Received messages
+// with a nonce not greater than the last one accepted, or with a timestamp
+// too far from the local clock, are rejected, so captured messages can not
+// be replayed.
+//
+// A MessageSigner is safe for concurrent use
+type MessageSigner struct {
+	agency           string
+	maxClockSkew     time.Duration
+	now              func() time.Time
+	sendDirection    byte
+	receiveDirection byte
+
+	lock              sync.Mutex
+	mac               hash.Hash
+	scratch           []byte
+	sum               []byte
+	lastSentNonce     uint64
+	lastReceivedNonce uint64
+}
+
+// ============================== BUILDER ============================== //
+
+// NewMessageSigner Creates the signer of the given agency, which signs the
+// messages it sends to the server and verifies the ones the server sends
+// to it. Nonces start at the current time in nanoseconds, so they keep
+// increasing if the agency restarts. A maxClockSkew of zero uses
+// DEFAULT_MAX_CLOCK_SKEW
+func NewMessageSigner(agency string, key []byte, maxClockSkew time.Duration) *MessageSigner {
+	return newMessageSigner(agency, key, maxClockSkew, DIRECTION_AGENCY_TO_SERVER, DIRECTION_SERVER_TO_AGENCY)
+}
+
+// NewServerMessageSigner Creates the signer the server uses with the given
+// agency, which signs the replies sent to it and verifies its messages
+func NewServerMessageSigner(agency string, key []byte, maxClockSkew time.Duration) *MessageSigner {
+	return newMessageSigner(agency, key, maxClockSkew, DIRECTION_SERVER_TO_AGENCY, DIRECTION_AGENCY_TO_SERVER)
+}
+
+func newMessageSigner(agency string, key []byte, maxClockSkew time.Duration, sendDirection byte, receiveDirection byte) *MessageSigner {
+	if maxClockSkew <= 0 {
+		maxClockSkew = DEFAULT_MAX_CLOCK_SKEW
+	}
+	return &MessageSigner{
+		agency:           agency,
+		maxClockSkew:     maxClockSkew,
+		now:              time.Now,
+		sendDirection:    sendDirection,
+		receiveDirection: receiveDirection,
+		mac:              hmac.New(sha256.New, key),
+		lastSentNonce:    uint64(time.Now().UnixNano()),
+	}
+}
+
+// ============================== PRIVATE - MAC ============================== //
+
+// appendMAC appends to dst the hex encoded MAC of the message fields. It
+// must be called with the lock held, since the fields and the sum are
+// gathered in buffers of the signer reused for every message
+func (signer *MessageSigner) appendMAC(dst []byte, direction byte, messageType []byte, payload []byte, agency string, nonce uint64, timestamp int64) []byte {
+	signer.mac.Reset()
+	signer.scratch = append(signer.scratch[:0], direction, '\n')
+	signer.scratch = append(signer.scratch, messageType...)
+	signer.scratch = append(signer.scratch, '\n')
+	signer.mac.Write(signer.scratch)
+	signer.mac.Write(payload)
+
+	signer.scratch = append(signer.scratch[:0], '\n')
+	signer.scratch = append(signer.scratch, agency...)
+	signer.scratch = append(signer.scratch, '\n')
+	signer.scratch = strconv.AppendUint(signer.scratch, nonce, 10)
+	signer.scratch = append(signer.scratch, '\n')
+	signer.scratch = strconv.AppendInt(signer.scratch, timestamp, 10)
+	signer.mac.Write(signer.scratch)
+
+	signer.sum = signer.mac.Sum(signer.sum[:0])
+	start := len(dst)
+	dst = append(dst, make([]byte, hex.EncodedLen(len(signer.sum)))...)
+	hex.Encode(dst[start:], signer.sum)
+	return dst
+}
+
+// splitFrame separates a TYPE[payload] frame in its type and payload
+func splitFrame(frame []byte) ([]byte, []byte, error) {
+	if len(frame) < encodedMessageOverhead {
+		return nil, nil, fmt.Errorf("message too short to be signed")
+	}
+	return frame[:MESSAGE_TYPE_LENGTH], frame[MESSAGE_TYPE_LENGTH+len(START_MSG_DELIMITER) : len(frame)-len(END_MSG_DELIMITER)], nil
+}
+
+// ============================== PUBLIC - SIGN ============================== //
+
+// AppendSigned Appends to dst the signature envelope of frame followed by
+// the frame itself
+func (signer *MessageSigner) AppendSigned(dst []byte, frame []byte) ([]byte, error) {
+	messageType, payload, err := splitFrame(frame)
+	if err != nil {
+		return dst, err
+	}
+
+	signer.lock.Lock()
+	defer signer.lock.Unlock()
+
+	signer.lastSentNonce++
+	nonce := signer.lastSentNonce
+	timestamp := signer.now().UnixNano() / int64(time.Millisecond)
+
+	dst = append(dst, SIGNATURE_MSG_TYPE...)
+	dst = append(dst, START_SIGNATURE_DELIMITER...)
+	dst = append(dst, signer.agency...)
+	dst = append(dst, SIGNATURE_FIELDS_SEPARATOR...)
+	dst = strconv.AppendUint(dst, nonce, 10)
+	dst = append(dst, SIGNATURE_FIELDS_SEPARATOR...)
+	dst = strconv.AppendInt(dst, timestamp, 10)
+	dst = append(dst, SIGNATURE_FIELDS_SEPARATOR...)
+	dst = signer.appendMAC(dst, signer.sendDirection, messageType, payload, signer.agency, nonce, timestamp)
+	dst = append(dst, END_SIGNATURE_DELIMITER...)
+	return append(dst, frame...), nil
+}
+
+// Sign Returns message preceded by its signature envelope
+func (signer *MessageSigner) Sign(message string) (string, error) {
+	signed, err := signer.AppendSigned(make([]byte, 0, len(message)+128), []byte(message))
+	return string(signed), err
+}
+
+// ============================== PUBLIC - VERIFY ============================== //
+
+// DecodeSignatureEnvelope Splits a signed message in its envelope and the
+// TYPE[payload] frame it signs
+func DecodeSignatureEnvelope(message string) (SignatureEnvelope, string, error) {
+	prefix := SIGNATURE_MSG_TYPE + START_SIGNATURE_DELIMITER
+	if !strings.HasPrefix(message, prefix) {
+		return SignatureEnvelope{}, "", ErrUnsignedMessage
+	}
+
+	end := strings.Index(message, END_SIGNATURE_DELIMITER)
+	if end < 0 {
+		return SignatureEnvelope{}, "", fmt.Errorf("%w: unterminated envelope", ErrInvalidSignature)
+	}
+
+	fields := strings.Split(message[len(prefix):end], SIGNATURE_FIELDS_SEPARATOR)
+	if len(fields) != SIGNATURE_FIELDS {
+		return SignatureEnvelope{}, "", fmt.Errorf("%w: expected %d envelope fields but received %d", ErrInvalidSignature, SIGNATURE_FIELDS, len(fields))
+	}
+
+	nonce, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return SignatureEnvelope{}, "", fmt.Errorf("%w: invalid nonce", ErrInvalidSignature)
+	}
+	timestamp, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return SignatureEnvelope{}, "", fmt.Errorf("%w: invalid timestamp", ErrInvalidSignature)
+	}
+
+	envelope := SignatureEnvelope{Agency: fields[0], Nonce: nonce, Timestamp: timestamp, MAC: fields[3]}
+	return envelope, message[end+len(END_SIGNATURE_DELIMITER):], nil
+}
+
+// Verify Checks the signature of a received message and returns the
+// TYPE[payload] frame it signs. The message must be signed for this
+// signer agency, with a nonce greater than the last one accepted and a
+// timestamp within the accepted clock skew
+func (signer *MessageSigner) Verify(message string) (string, error) {
+	envelope, frame, err := DecodeSignatureEnvelope(message)
+	if err != nil {
+		return "", err
+	}
+	messageType, payload, err := splitFrame([]byte(frame))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	signer.lock.Lock()
+	defer signer.lock.Unlock()
+
+	expectedMAC := signer.appendMAC(nil, signer.receiveDirection, messageType, payload, envelope.Agency, envelope.Nonce, envelope.Timestamp)
+	if envelope.Agency != signer.agency || !hmac.Equal(expectedMAC, []byte(envelope.MAC)) {
+		return "", ErrInvalidSignature
+	}
+
+	if envelope.Nonce <= signer.lastReceivedNonce {
+		return "", ErrReplayedMessage
+	}
+
+	skew := signer.now().Sub(time.Unix(0, envelope.Timestamp*int64(time.Millisecond)))
+	if skew > signer.maxClockSkew || skew < -signer.maxClockSkew {
+		return "", ErrStaleMessage
+	}
+
+	signer.lastReceivedNonce = envelope.Nonce
+	return frame, nil
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSignatureKey = []byte("agency-1-secret")
+
+func TestSignedMessageIsVerifiedByThePeer(t *testing.T) {
+	sender := NewMessageSigner("1", testSignatureKey, 0)
+	receiver := NewServerMessageSigner("1", testSignatureKey, 0)
+
+	message := EncodeNoMoreBetsMessage("1")
+	signed, err := sender.Sign(message)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(signed, SIGNATURE_MSG_TYPE+START_SIGNATURE_DELIMITER+"1,") || !strings.HasSuffix(signed, message) {
+		t.Fatalf("unexpected signed message: %s", signed)
+	}
+
+	frame, err := receiver.Verify(signed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if frame != message {
+		t.Fatalf("unexpected frame: got %s, want %s", frame, message)
+	}
+}
+
+func TestTamperedMessagesAreRejected(t *testing.T) {
+	sender := NewMessageSigner("1", testSignatureKey, 0)
+	signed, err := sender.Sign(EncodeAskForWinnersMessage("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := []string{
+		strings.Replace(signed, `"agency":"1"`, `"agency":"2"`, 1),
+		strings.Replace(signed, ASK_FOR_WINNERS_MSG_TYPE, NO_MORE_BETS_MSG_TYPE, 1),
+		strings.Replace(signed, "SIG{1,", "SIG{2,", 1),
+		EncodeAskForWinnersMessage("1"),
+	}
+	for _, message := range tampered {
+		receiver := NewServerMessageSigner("1", testSignatureKey, 0)
+		if _, err := receiver.Verify(message); err == nil {
+			t.Fatalf("expected an error verifying %s", message)
+		}
+	}
+
+	receiver := NewServerMessageSigner("1", []byte("another key"), 0)
+	if _, err := receiver.Verify(signed); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected an invalid signature error, got: %v", err)
+	}
+}
+
+func TestReplayedMessagesAreRejected(t *testing.T) {
+	sender := NewServerMessageSigner("1", testSignatureKey, 0)
+	receiver := NewMessageSigner("1", testSignatureKey, 0)
+
+	first, _ := sender.Sign(EncodeAckMessage("10"))
+	second, _ := sender.Sign(EncodeAckMessage("10"))
+	if _, err := receiver.Verify(first); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := receiver.Verify(second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, message := range []string{first, second} {
+		if _, err := receiver.Verify(message); !errors.Is(err, ErrReplayedMessage) {
+			t.Fatalf("expected a replayed message error, got: %v", err)
+		}
+	}
+}
+
+func TestStaleMessagesAreRejected(t *testing.T) {
+	sender := NewServerMessageSigner("1", testSignatureKey, 0)
+	receiver := NewMessageSigner("1", testSignatureKey, time.Minute)
+
+	sender.now = func() time.Time { return time.Now().Add(-2 * time.Minute) }
+	signed, _ := sender.Sign(EncodeAckMessage("10"))
+	if _, err := receiver.Verify(signed); !errors.Is(err, ErrStaleMessage) {
+		t.Fatalf("expected a stale message error, got: %v", err)
+	}
+}
+
+func TestReflectedMessagesAreRejected(t *testing.T) {
+	agency := NewMessageSigner("1", testSignatureKey, 0)
+
+	signed, _ := agency.Sign(EncodeAckMessage("10"))
+	if _, err := agency.Verify(signed); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected a message signed by the agency to be rejected by it, got: %v", err)
+	}
+
+	server := NewServerMessageSigner("1", testSignatureKey, 0)
+	signed, _ = server.Sign(EncodeAckMessage("10"))
+	if _, err := server.Verify(signed); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected a message signed by the server to be rejected by it, got: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package common
+
+import "time"
+
+// ============================== CONSTANTS ============================== //
+
+// ClientState is the step a Client is going through
+type ClientState string
+
+const (
+	STATE_IDLE            ClientState = "idle"
+	STATE_SENDING         ClientState = "sending"
+	STATE_WAITING_WINNERS ClientState = "waiting_winners"
+)
+
+// CLIENT_STATES are every state a Client can be in
+var CLIENT_STATES = []ClientState{STATE_IDLE, STATE_SENDING, STATE_WAITING_WINNERS}
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// Observer receives the events of interest produced by a Client while it
+// runs, so callers can collect statistics without parsing its logs. Methods
+// are called from the goroutine driving the client and must not block.
+//
+// Implementations should embed NopObserver, so they keep compiling when new
+// events are added
+type Observer interface {
+	// Connected is called every time a connection to the server is opened
+	Connected()
+
+	// ConnectRetried is called before each new attempt to connect, after the
+	// connection was refused or reset or the server was busy, with the
+	// attempt that failed, the wait before the next one and its reason
+	ConnectRetried(attempt int, wait time.Duration, reason error)
+
+	// StateChanged is called when the client starts a new step
+	StateChanged(state ClientState)
+
+	// BetsRead is called with the amount of rows read from the agency file,
+	// valid or not, in the order they are read
+	BetsRead(amount int)
+
+	// BetRejected is called for each row of the agency file that does not
+	// pass Bet.Validate while validating it, with its line number and the
+	// reason
+	BetRejected(line int, reason error)
+
+	// BetBatchAcknowledged is called once the server acknowledged a batch
+	BetBatchAcknowledged(batchSize int, batchBytes int, latency time.Duration)
+
+	// Throttled is called when a batch waited for the RateLimiter before
+	// being sent, with the time it waited
+	Throttled(waited time.Duration)
+
+	// WaitedForCredits is called when a batch waited for the server to grant
+	// the credits to send it, with the time it waited
+	WaitedForCredits(waited time.Duration)
+
+	// AckMismatch is called when the server acknowledges a message with an
+	// unexpected ACK
+	AckMismatch(expected string, received string)
+
+	// WinnersReceived is called once the server answered the winners query
+	WinnersReceived(amountOfWinners int, waited time.Duration)
+
+	// Stopped is called once when the client is asked to stop, by SIGTERM or
+	// by Stop. Unlike the other events, it may be called from any goroutine
+	Stopped()
+}
+
+// NopObserver ignores every event
+type NopObserver struct{}
+
+func (NopObserver) Connected() {}
+
+func (NopObserver) ConnectRetried(attempt int, wait time.Duration, reason error) {}
+
+func (NopObserver) StateChanged(state ClientState) {}
+
+func (NopObserver) BetsRead(amount int) {}
+
+func (NopObserver) BetRejected(line int, reason error) {}
+
+func (NopObserver) BetBatchAcknowledged(batchSize int, batchBytes int, latency time.Duration) {}
+
+func (NopObserver) Throttled(waited time.Duration) {}
+
+func (NopObserver) WaitedForCredits(waited time.Duration) {}
+
+func (NopObserver) AckMismatch(expected string, received string) {}
+
+func (NopObserver) WinnersReceived(amountOfWinners int, waited time.Duration) {}
+
+func (NopObserver) Stopped() {}
+
+// multiObserver forwards every event to each of its observers, in order
+type multiObserver []Observer
+
+// MultiObserver Returns an observer that forwards every event to each of the
+// given observers. Nil observers are skipped
+func MultiObserver(observers ...Observer) Observer {
+	multi := multiObserver{}
+	for _, observer := range observers {
+		if observer != nil {
+			multi = append(multi, observer)
+		}
+	}
+	return multi
+}
+
+func (multi multiObserver) Connected() {
+	for _, observer := range multi {
+		observer.Connected()
+	}
+}
+
+func (multi multiObserver) ConnectRetried(attempt int, wait time.Duration, reason error) {
+	for _, observer := range multi {
+		observer.ConnectRetried(attempt, wait, reason)
+	}
+}
+
+func (multi multiObserver) StateChanged(state ClientState) {
+	for _, observer := range multi {
+		observer.StateChanged(state)
+	}
+}
+
+func (multi multiObserver) BetsRead(amount int) {
+	for _, observer := range multi {
+		observer.BetsRead(amount)
+	}
+}
+
+func (multi multiObserver) BetRejected(line int, reason error) {
+	for _, observer := range multi {
+		observer.BetRejected(line, reason)
+	}
+}
+
+func (multi multiObserver) BetBatchAcknowledged(batchSize int, batchBytes int, latency time.Duration) {
+	for _, observer := range multi {
+		observer.BetBatchAcknowledged(batchSize, batchBytes, latency)
+	}
+}
+
+func (multi multiObserver) Throttled(waited time.Duration) {
+	for _, observer := range multi {
+		observer.Throttled(waited)
+	}
+}
+
+func (multi multiObserver) WaitedForCredits(waited time.Duration) {
+	for _, observer := range multi {
+		observer.WaitedForCredits(waited)
+	}
+}
+
+func (multi multiObserver) AckMismatch(expected string, received string) {
+	for _, observer := range multi {
+		observer.AckMismatch(expected, received)
+	}
+}
+
+func (multi multiObserver) WinnersReceived(amountOfWinners int, waited time.Duration) {
+	for _, observer := range multi {
+		observer.WinnersReceived(amountOfWinners, waited)
+	}
+}
+
+func (multi multiObserver) Stopped() {
+	for _, observer := range multi {
+		observer.Stopped()
+	}
+}
@@ -0,0 +1,193 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	// PII_FULL logs personal data as is. Only meant for local debugging
+	PII_FULL PIIPolicy = "full"
+
+	// PII_MASKED keeps just enough of each value to tell bets apart: the
+	// initial of names, the last digits of documents and the birth year
+	PII_MASKED PIIPolicy = "masked"
+
+	// PII_HASHED replaces each value with a keyed hash, so the same value
+	// can be followed across the logs of a run without being revealed
+	PII_HASHED PIIPolicy = "hashed"
+
+	// PII_NONE replaces each value with PII_REDACTED
+	PII_NONE PIIPolicy = "none"
+
+	DEFAULT_PII_POLICY = PII_MASKED
+
+	PII_REDACTED = "<redacted>"
+
+	// MASKED_DOCUMENT_DIGITS is the amount of trailing document digits kept
+	// by PII_MASKED
+	MASKED_DOCUMENT_DIGITS = 3
+
+	HASHED_PII_LENGTH = 16
+)
+
+// piiFieldPattern matches the personal fields of an encoded bet
+var piiFieldPattern = regexp.MustCompile(`"(first_name|last_name|document|birthdate)":"([^"]*)"`)
+
+// quotedValuePattern matches each document of an encoded winners payload
+var quotedValuePattern = regexp.MustCompile(`"([^"]*)"`)
+
+// piiHashKey keys the hashes of PII_HASHED. It is random on every run, so
+// hashes can not be reversed by hashing every possible document
+var piiHashKey = func() []byte {
+	key := make([]byte, sha256.Size)
+	rand.Read(key)
+	return key
+}()
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// PIIPolicy tells how the personal data of bettors (names, documents and
+// birthdates) is shown in the logs
+type PIIPolicy string
+
+// redactedBet and redactedMessage are only redacted when formatted, so
+// discarded debug logs do not pay for the redaction
+type redactedBet struct {
+	policy PIIPolicy
+	bet    *Bet
+}
+
+type redactedMessage struct {
+	policy  PIIPolicy
+	message []byte
+}
+
+// ============================== BUILDER ============================== //
+
+// ParsePIIPolicy Returns the policy named value. An empty value is the
+// DEFAULT_PII_POLICY
+func ParsePIIPolicy(value string) (PIIPolicy, error) {
+	switch policy := PIIPolicy(strings.ToLower(value)); policy {
+	case "":
+		return DEFAULT_PII_POLICY, nil
+	case PII_FULL, PII_MASKED, PII_HASHED, PII_NONE:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unsupported PII policy %q, expected one of full, masked, hashed or none", value)
+	}
+}
+
+// ============================== PRIVATE - REDACT VALUES ============================== //
+
+func maskName(name string) string {
+	if name == "" {
+		return ""
+	}
+	initial, _ := utf8.DecodeRuneInString(name)
+	return string(initial) + "***"
+}
+
+func maskDocument(document string) string {
+	if len(document) <= MASKED_DOCUMENT_DIGITS {
+		return strings.Repeat("*", len(document))
+	}
+	return strings.Repeat("*", len(document)-MASKED_DOCUMENT_DIGITS) + document[len(document)-MASKED_DOCUMENT_DIGITS:]
+}
+
+func maskBirthdate(birthdate string) string {
+	if len(birthdate) != len(BIRTHDATE_LAYOUT) {
+		return "****-**-**"
+	}
+	return birthdate[:4] + "-**-**"
+}
+
+func hashPII(value string) string {
+	mac := hmac.New(sha256.New, piiHashKey)
+	mac.Write([]byte(value))
+	return "#" + hex.EncodeToString(mac.Sum(nil))[:HASHED_PII_LENGTH]
+}
+
+// redactField Applies the policy to the value of the given bet field
+func (policy PIIPolicy) redactField(fieldName string, value string) string {
+	switch policy {
+	case PII_FULL:
+		return value
+	case PII_HASHED:
+		return hashPII(value)
+	case PII_NONE:
+		return PII_REDACTED
+	}
+
+	switch fieldName {
+	case "first_name", "last_name":
+		return maskName(value)
+	case "document":
+		return maskDocument(value)
+	case "birthdate":
+		return maskBirthdate(value)
+	default:
+		return value
+	}
+}
+
+// redactMessage Applies the policy to the personal fields of the bets and
+// to the documents of the winners in a raw message
+func (policy PIIPolicy) redactMessage(message string) string {
+	if policy == PII_FULL {
+		return message
+	}
+
+	message = piiFieldPattern.ReplaceAllStringFunc(message, func(field string) string {
+		match := piiFieldPattern.FindStringSubmatch(field)
+		return encodeField(match[1], policy.redactField(match[1], match[2]))
+	})
+
+	winnersStart := strings.Index(message, WINNERS_MSG_TYPE+START_MSG_DELIMITER)
+	if winnersStart < 0 {
+		return message
+	}
+	winners := quotedValuePattern.ReplaceAllStringFunc(message[winnersStart:], func(document string) string {
+		return `"` + policy.redactField("document", strings.Trim(document, `"`)) + `"`
+	})
+	return message[:winnersStart] + winners
+}
+
+// ============================== PRIVATE - STRINGERS ============================== //
+
+func (redacted redactedBet) String() string {
+	bet := redacted.bet
+	return fmt.Sprintf("[%s %s %s %s %s]",
+		redacted.policy.redactField("first_name", bet.FirstName),
+		redacted.policy.redactField("last_name", bet.LastName),
+		redacted.policy.redactField("document", bet.Document),
+		redacted.policy.redactField("birthdate", bet.Birthdate),
+		bet.Number,
+	)
+}
+
+func (redacted redactedMessage) String() string {
+	return redacted.policy.redactMessage(string(redacted.message))
+}
+
+// ============================== PUBLIC ============================== //
+
+// Bet Returns bet, to be logged with its personal data redacted
+func (policy PIIPolicy) Bet(bet *Bet) fmt.Stringer {
+	return redactedBet{policy: policy, bet: bet}
+}
+
+// Message Returns a raw protocol message, to be logged with the personal
+// data of its bets and winners redacted. The message must not be modified
+// until it is logged
+func (policy PIIPolicy) Message(message []byte) fmt.Stringer {
+	return redactedMessage{policy: policy, message: message}
+}
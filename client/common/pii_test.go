@@ -0,0 +1,59 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPIIPolicyRedactsBets(t *testing.T) {
+	bet := NewBet("1", "Santiago", "Lorca", "30904465", "1999-03-17", "7574")
+
+	expected := map[PIIPolicy]string{
+		PII_FULL:   "[Santiago Lorca 30904465 1999-03-17 7574]",
+		PII_MASKED: "[S*** L*** *****465 1999-**-** 7574]",
+		PII_NONE:   "[<redacted> <redacted> <redacted> <redacted> 7574]",
+	}
+	for policy, want := range expected {
+		if got := fmt.Sprint(policy.Bet(bet)); got != want {
+			t.Fatalf("unexpected %s bet: got %s, want %s", policy, got, want)
+		}
+	}
+
+	hashed := fmt.Sprint(PII_HASHED.Bet(bet))
+	if strings.Contains(hashed, "30904465") || hashed != fmt.Sprint(PII_HASHED.Bet(bet)) {
+		t.Fatalf("hashed bet must hide the values and be stable: %s", hashed)
+	}
+}
+
+func TestPIIPolicyRedactsMessages(t *testing.T) {
+	bet := NewBet("1", "Santiago", "Lorca", "30904465", "1999-03-17", "7574")
+	message := "BET[" + EncodeBet(bet) + BET_BATCH_SEPARATOR + EncodeBet(bet) + "]"
+
+	redacted := fmt.Sprint(PII_MASKED.Message([]byte(message)))
+	want := `{"agency":"1","first_name":"S***","last_name":"L***","document":"*****465","birthdate":"1999-**-**","number":"7574"}`
+	if redacted != "BET["+want+";"+want+"]" {
+		t.Fatalf("unexpected redacted batch: %s", redacted)
+	}
+
+	winners := fmt.Sprint(PII_MASKED.Message([]byte(EncodeWinnersMessage([]string{"30904465", "12345678"}))))
+	if winners != `WIN["*****465","*****678"]` {
+		t.Fatalf("unexpected redacted winners: %s", winners)
+	}
+
+	if full := fmt.Sprint(PII_FULL.Message([]byte(message))); full != message {
+		t.Fatalf("full policy must not redact: %s", full)
+	}
+}
+
+func TestParsePIIPolicy(t *testing.T) {
+	if policy, err := ParsePIIPolicy(""); err != nil || policy != DEFAULT_PII_POLICY {
+		t.Fatalf("unexpected default policy: %v, %v", policy, err)
+	}
+	if policy, err := ParsePIIPolicy("Hashed"); err != nil || policy != PII_HASHED {
+		t.Fatalf("unexpected policy: %v, %v", policy, err)
+	}
+	if _, err := ParsePIIPolicy("partial"); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+}
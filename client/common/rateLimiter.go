@@ -0,0 +1,143 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// RateLimits bound how fast bets are sent. A zero rate is not limited, and a
+// zero burst allows as many bets or bytes as one second of its rate
+type RateLimits struct {
+	BetsPerSecond  int
+	BetsBurst      int
+	BytesPerSecond int
+	BytesBurst     int
+}
+
+// tokenBucket fills with rate tokens per second up to burst tokens. Taking
+// more tokens than the bucket holds leaves it in debt, which is paid before
+// anyone else can take tokens, so requests bigger than burst are slowed down
+// but never blocked forever
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter throttles the bet batches sent with a token bucket of bets and
+// another of bytes. It is safe for concurrent use, so a single RateLimiter
+// can be shared by every connection that must respect the same limits
+type RateLimiter struct {
+	lock   sync.Mutex
+	limits RateLimits
+	bets   tokenBucket
+	bytes  tokenBucket
+}
+
+// ============================== BUILDER ============================== //
+
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	limiter := &RateLimiter{}
+	limiter.SetRateLimits(limits)
+	return limiter
+}
+
+// ============================== PRIVATE - TOKEN BUCKET ============================== //
+
+// setRate Changes the rate and burst of the bucket. A bucket that was not
+// limiting starts full
+func (bucket *tokenBucket) setRate(rate int, burst int, now time.Time) {
+	wasUnlimited := bucket.rate <= 0
+	bucket.refill(now)
+
+	bucket.rate = float64(rate)
+	bucket.burst = float64(burst)
+	if burst <= 0 {
+		bucket.burst = bucket.rate
+	}
+	if wasUnlimited || bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens += elapsed * bucket.rate
+		if bucket.tokens > bucket.burst {
+			bucket.tokens = bucket.burst
+		}
+	}
+	bucket.last = now
+}
+
+// take Takes amount tokens from the bucket and returns how long the taker
+// must wait before using them
+func (bucket *tokenBucket) take(amount int, now time.Time) time.Duration {
+	if bucket.rate <= 0 {
+		return 0
+	}
+	bucket.refill(now)
+	bucket.tokens -= float64(amount)
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// ============================== PRIVATE - RATE LIMITER ============================== //
+
+// reserve Takes the tokens of a batch from both buckets and returns how long
+// to wait before sending it
+func (limiter *RateLimiter) reserve(bets int, bytes int, now time.Time) time.Duration {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	wait := limiter.bets.take(bets, now)
+	if bytesWait := limiter.bytes.take(bytes, now); bytesWait > wait {
+		wait = bytesWait
+	}
+	return wait
+}
+
+// ============================== PUBLIC ============================== //
+
+// RateLimits Returns the limits the limiter is currently enforcing
+func (limiter *RateLimiter) RateLimits() RateLimits {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	return limiter.limits
+}
+
+// SetRateLimits Replaces the limits of the limiter. Batches already waiting
+// keep the wait they were given, the following ones use the new limits
+func (limiter *RateLimiter) SetRateLimits(limits RateLimits) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := time.Now()
+	limiter.limits = limits
+	limiter.bets.setRate(limits.BetsPerSecond, limits.BetsBurst, now)
+	limiter.bytes.setRate(limits.BytesPerSecond, limits.BytesBurst, now)
+}
+
+// Wait Blocks until a batch of the given amount of bets and bytes can be
+// sent without exceeding the limits, and returns how long it waited. If
+// cancel is closed first, ErrInterrupted is returned
+func (limiter *RateLimiter) Wait(bets int, bytes int, cancel <-chan struct{}) (time.Duration, error) {
+	wait := limiter.reserve(bets, bytes, time.Now())
+	if wait <= 0 {
+		return 0, nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return wait, nil
+	case <-cancel:
+		return 0, ErrInterrupted
+	}
+}
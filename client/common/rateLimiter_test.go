@@ -0,0 +1,52 @@
+package common
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterLetsBurstsThroughThenThrottles(t *testing.T) {
+	limiter := NewRateLimiter(RateLimits{BetsPerSecond: 100, BetsBurst: 50, BytesPerSecond: 1000})
+	now := time.Now()
+
+	if wait := limiter.reserve(50, 100, now); wait != 0 {
+		t.Fatalf("expected the burst to go through, waited %v", wait)
+	}
+	if wait := limiter.reserve(10, 100, now); wait != 100*time.Millisecond {
+		t.Fatalf("expected to wait for 10 bets at 100 bets/s, waited %v", wait)
+	}
+	// The debt of the previous batch is paid before this one can be sent
+	if wait := limiter.reserve(10, 100, now.Add(100*time.Millisecond)); wait != 100*time.Millisecond {
+		t.Fatalf("expected to wait for the debt to be paid, waited %v", wait)
+	}
+	// The bytes bucket started with one second of its rate
+	if wait := limiter.reserve(0, 800, now.Add(100*time.Millisecond)); wait != 100*time.Millisecond {
+		t.Fatalf("expected to wait for 100 bytes at 1000 bytes/s, waited %v", wait)
+	}
+}
+
+func TestRateLimiterWithoutLimitsNeverWaits(t *testing.T) {
+	limiter := NewRateLimiter(RateLimits{})
+	for i := 0; i < 100; i++ {
+		if waited, err := limiter.Wait(1000, 8*KiB, nil); waited != 0 || err != nil {
+			t.Fatalf("unexpected wait %v, error %v", waited, err)
+		}
+	}
+
+	limiter.SetRateLimits(RateLimits{BetsPerSecond: 10})
+	if wait := limiter.reserve(10, 0, time.Now()); wait != 0 {
+		t.Fatalf("expected limits set later to start with a full burst, waited %v", wait)
+	}
+}
+
+func TestRateLimiterWaitCanBeCancelled(t *testing.T) {
+	limiter := NewRateLimiter(RateLimits{BytesPerSecond: 1})
+	limiter.reserve(0, 1, time.Now())
+
+	cancel := make(chan struct{})
+	close(cancel)
+	if _, err := limiter.Wait(0, 3600, cancel); !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("expected ErrInterrupted, got %v", err)
+	}
+}
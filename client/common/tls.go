@@ -0,0 +1,250 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	TLS_CIPHER_POLICY_DEFAULT    = "default"
+	TLS_CIPHER_POLICY_MODERN     = "modern"
+	TLS_CIPHER_POLICY_COMPATIBLE = "compatible"
+
+	// Docker secrets mounted at these paths are used as the client
+	// certificate and key when none is configured
+	DOCKER_SECRETS_DIR        = "/run/secrets"
+	TLS_CERT_SECRET_NAME      = "agency_cert"
+	TLS_KEY_SECRET_NAME       = "agency_key"
+	AGENCY_COMMON_NAME_PREFIX = "agency-"
+
+	// DEFAULT_TLS_HANDSHAKE_TIMEOUT bounds the handshake when no AckTimeout
+	// is set, so a server that never speaks TLS does not hang the client
+	DEFAULT_TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+)
+
+// modernCipherSuites only allows forward secret AEAD suites. They only apply
+// to TLS 1.2, since TLS 1.3 suites are not configurable and are all modern
+var modernCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// TLSOptions describes how the connection to the server is secured
+type TLSOptions struct {
+	// CAFile is a PEM bundle with the certificates trusted to sign the
+	// server certificate. When empty, the system roots are used
+	CAFile string
+
+	// ServerName is the name the server certificate must be valid for.
+	// When empty, the host of the server address is used
+	ServerName string
+
+	// MinVersion is the minimum TLS version accepted: 1.0, 1.1, 1.2 or 1.3.
+	// When empty, 1.2 is used
+	MinVersion string
+
+	// CipherPolicy selects the TLS 1.2 cipher suites offered: default,
+	// modern or compatible, which adds the insecure suites Go implements for
+	// old servers that support nothing else. When empty, default is used
+	CipherPolicy string
+
+	// CertFile and KeyFile are the PEM encoded client certificate and key
+	// presented to the server (mutual TLS). When both are empty, the
+	// agency_cert and agency_key Docker secrets are used if present
+	CertFile string
+	KeyFile  string
+
+	// AgencyID is the id the subject of the client certificate must match
+	AgencyID string
+}
+
+// ============================== BUILDER ============================== //
+
+// NewTLSConfig Builds the TLS configuration used to connect to serverAddress
+func NewTLSConfig(options TLSOptions, serverAddress string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: options.ServerName}
+
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(serverAddress)
+		if err != nil {
+			return nil, fmt.Errorf("tls: server name can not be taken from server address %q: %w", serverAddress, err)
+		}
+		config.ServerName = host
+	}
+
+	minVersion := options.MinVersion
+	if minVersion == "" {
+		minVersion = "1.2"
+	}
+	version, found := tlsVersions[minVersion]
+	if !found {
+		return nil, fmt.Errorf("tls: unsupported minimum version %q, expected one of 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+	config.MinVersion = version
+
+	switch strings.ToLower(options.CipherPolicy) {
+	case "", TLS_CIPHER_POLICY_DEFAULT:
+	case TLS_CIPHER_POLICY_MODERN:
+		config.CipherSuites = modernCipherSuites
+	case TLS_CIPHER_POLICY_COMPATIBLE:
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			config.CipherSuites = append(config.CipherSuites, suite.ID)
+		}
+	default:
+		return nil, fmt.Errorf("tls: unsupported cipher policy %q, expected one of default, modern or compatible", options.CipherPolicy)
+	}
+
+	if options.CAFile != "" {
+		bundle, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: CA bundle can not be read: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("tls: CA bundle %s does not contain any PEM certificate", options.CAFile)
+		}
+	}
+
+	certificate, err := loadClientCertificate(options)
+	if err != nil {
+		return nil, err
+	}
+	if certificate != nil {
+		config.Certificates = []tls.Certificate{*certificate}
+	}
+
+	return config, nil
+}
+
+// ============================== CLIENT CERTIFICATE ============================== //
+
+// CertificateMatchesAgency Tells whether the subject of certificate
+// identifies the given agency. Its common name must be either the agency id
+// or the id prefixed with AGENCY_COMMON_NAME_PREFIX, e.g. "agency-3"
+func CertificateMatchesAgency(certificate *x509.Certificate, agencyID string) bool {
+	commonName := certificate.Subject.CommonName
+	return agencyID != "" && (commonName == agencyID || commonName == AGENCY_COMMON_NAME_PREFIX+agencyID)
+}
+
+func fileExists(fileName string) bool {
+	_, err := os.Stat(fileName)
+	return err == nil
+}
+
+// clientCertificateFiles Returns the configured certificate and key files or,
+// if none is configured, the ones provided as Docker secrets
+func clientCertificateFiles(options TLSOptions) (string, string) {
+	if options.CertFile != "" || options.KeyFile != "" {
+		return options.CertFile, options.KeyFile
+	}
+
+	certSecret := filepath.Join(DOCKER_SECRETS_DIR, TLS_CERT_SECRET_NAME)
+	keySecret := filepath.Join(DOCKER_SECRETS_DIR, TLS_KEY_SECRET_NAME)
+	if fileExists(certSecret) && fileExists(keySecret) {
+		return certSecret, keySecret
+	}
+	return "", ""
+}
+
+// loadClientCertificate Loads the client certificate, if any, and checks it
+// belongs to the configured agency. Nil is returned when no certificate
+// is configured
+func loadClientCertificate(options TLSOptions) (*tls.Certificate, error) {
+	certFile, keyFile := clientCertificateFiles(options)
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls: client certificate and key must be configured together")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: client certificate can not be loaded: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("tls: client certificate can not be parsed: %w", err)
+	}
+
+	if !CertificateMatchesAgency(leaf, options.AgencyID) {
+		return nil, fmt.Errorf("tls: client certificate subject %q does not match agency id %q", leaf.Subject.CommonName, options.AgencyID)
+	}
+	certificate.Leaf = leaf
+	return &certificate, nil
+}
+
+// ============================== PRIVATE - HANDSHAKE ============================== //
+
+// describeTLSError Turns the certificate verification errors into a message
+// that tells which setting must be checked
+func describeTLSError(err error, config *tls.Config) string {
+	var unknownAuthorityError x509.UnknownAuthorityError
+	var hostnameError x509.HostnameError
+	var certificateInvalidError x509.CertificateInvalidError
+	var netError net.Error
+
+	switch {
+	case errors.As(err, &netError) && netError.Timeout():
+		return "server did not complete the handshake in time"
+	case errors.As(err, &unknownAuthorityError):
+		return "server certificate is not signed by a trusted CA (check server.tls.ca)"
+	case errors.As(err, &hostnameError):
+		return fmt.Sprintf("server certificate is not valid for %q (check server.tls.serverName)", config.ServerName)
+	case errors.As(err, &certificateInvalidError) && certificateInvalidError.Reason == x509.Expired:
+		return "server certificate is expired or not yet valid"
+	default:
+		return "handshake failed"
+	}
+}
+
+// tlsHandshakeTimeout Returns the time the handshake may take: the current
+// AckTimeout or, when it is not set, DEFAULT_TLS_HANDSHAKE_TIMEOUT
+func (client *Client) tlsHandshakeTimeout() time.Duration {
+	if ackTimeout := client.currentLimits().AckTimeout; ackTimeout > 0 {
+		return ackTimeout
+	}
+	return DEFAULT_TLS_HANDSHAKE_TIMEOUT
+}
+
+// tlsHandshake Wraps conn with TLS and completes the handshake within
+// timeout, so a bad certificate is reported when connecting instead of on
+// the first message
+func tlsHandshake(conn net.Conn, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	tlsConn := tls.Client(conn, config)
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls: %s: %w", describeTLSError(err, config), err)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,209 @@
+package common_test
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/fakehq"
+)
+
+// startTLSFakeServer serves a fake headquarters over TLS on a local port,
+// with a certificate issued by a new test CA
+func startTLSFakeServer(t *testing.T, requireClientCertificate bool) (*fakehq.Server, *fakehq.CA, string) {
+	t.Helper()
+	ca, err := fakehq.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := ca.ServerTLSConfig(requireClientCertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := fakehq.New(fakehq.Options{Agencies: 1, TLS: tlsConfig})
+	address, err := server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return server, ca, address
+}
+
+func writeCAFile(t *testing.T, ca *fakehq.CA) string {
+	t.Helper()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, ca.CertPEM(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return caFile
+}
+
+func newTLSClient(t *testing.T, address string, options common.TLSOptions) *common.Client {
+	t.Helper()
+	tlsConfig, err := common.NewTLSConfig(options, address)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return common.NewClient(common.ClientConfig{
+		ID:                         "1",
+		ServerAddress:              address,
+		MaxAmountOfBetsOnEachBatch: 20,
+		MaxKiBPerBatch:             8,
+		OpenAgencyFile:             testAgencyFile(t),
+		TLS:                        tlsConfig,
+	})
+}
+
+func TestClientOverTLS(t *testing.T) {
+	_, ca, address := startTLSFakeServer(t, false)
+
+	client := newTLSClient(t, address, common.TLSOptions{CAFile: writeCAFile(t, ca), MinVersion: "1.2", CipherPolicy: "modern"})
+	if err := client.SendAllBetsToNationalLotteryHeadquartersThenAskForWinners(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClientRejectsUntrustedServerCertificate(t *testing.T) {
+	_, _, address := startTLSFakeServer(t, false)
+
+	client := newTLSClient(t, address, common.TLSOptions{})
+	err := client.Connect()
+	if err == nil || !strings.Contains(err.Error(), "not signed by a trusted CA") {
+		t.Fatalf("expected an untrusted certificate error, got: %v", err)
+	}
+}
+
+func TestClientRejectsServerCertificateForAnotherName(t *testing.T) {
+	_, ca, address := startTLSFakeServer(t, false)
+
+	client := newTLSClient(t, address, common.TLSOptions{CAFile: writeCAFile(t, ca), ServerName: "server"})
+	err := client.Connect()
+	if err == nil || !strings.Contains(err.Error(), `not valid for "server"`) {
+		t.Fatalf("expected a server name error, got: %v", err)
+	}
+}
+
+func TestClientOverMutualTLS(t *testing.T) {
+	server, ca, address := startTLSFakeServer(t, true)
+	caFile, certFile, keyFile, err := ca.WriteClientFiles(t.TempDir(), "agency-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTLSClient(t, address, common.TLSOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, AgencyID: "1"})
+	if err := client.SendAllBetsToNationalLotteryHeadquartersThenAskForWinners(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored := len(server.Bets()); stored != testAgencyBets {
+		t.Fatalf("unexpected amount of stored bets: got %d, want %d", stored, testAgencyBets)
+	}
+}
+
+func TestClientWithoutCertificateIsRejectedByMutualTLSServer(t *testing.T) {
+	server, ca, address := startTLSFakeServer(t, true)
+
+	client := newTLSClient(t, address, common.TLSOptions{CAFile: writeCAFile(t, ca)})
+	if err := client.SendAllBetsToNationalLotteryHeadquartersThenAskForWinners(); err == nil {
+		t.Fatal("expected an error when connecting without a client certificate")
+	}
+	if stored := len(server.Bets()); stored != 0 {
+		t.Fatalf("server stored %d bets from an unauthenticated client", stored)
+	}
+}
+
+func TestNewTLSConfigRejectsCertificateOfAnotherAgency(t *testing.T) {
+	ca, err := fakehq.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile, certFile, keyFile, err := ca.WriteClientFiles(t.TempDir(), "agency-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := common.TLSOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, AgencyID: "1"}
+	if _, err := common.NewTLSConfig(options, "server:12345"); err == nil || !strings.Contains(err.Error(), "does not match agency id") {
+		t.Fatalf("expected a subject mismatch error, got: %v", err)
+	}
+}
+
+func TestNewTLSConfigRejectsInvalidOptions(t *testing.T) {
+	invalidOptions := []common.TLSOptions{
+		{MinVersion: "2.0"},
+		{CipherPolicy: "weak"},
+		{CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		{CertFile: filepath.Join(t.TempDir(), "agency-1.crt")},
+	}
+	for _, options := range invalidOptions {
+		if _, err := common.NewTLSConfig(options, "server:12345"); err == nil {
+			t.Fatalf("expected an error for options %+v", options)
+		}
+	}
+}
+
+func TestClientGivesUpOnAServerThatNeverSpeaksTLS(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		silentConns := []net.Conn{}
+		defer func() {
+			for _, conn := range silentConns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			silentConns = append(silentConns, conn)
+		}
+	}()
+
+	tlsConfig, err := common.NewTLSConfig(common.TLSOptions{}, listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := common.NewClient(common.ClientConfig{
+		ID:            "1",
+		ServerAddress: listener.Addr().String(),
+		AckTimeout:    100 * time.Millisecond,
+		TLS:           tlsConfig,
+	})
+
+	startedAt := time.Now()
+	err = client.Connect()
+	if err == nil || !strings.Contains(err.Error(), "did not complete the handshake in time") {
+		t.Fatalf("expected a handshake timeout, got: %v", err)
+	}
+	if waited := time.Since(startedAt); waited > 5*time.Second {
+		t.Fatalf("expected to give up after 100ms, waited %v", waited)
+	}
+}
+
+func TestCompatibleCipherPolicyOffersInsecureSuites(t *testing.T) {
+	tlsConfig, err := common.NewTLSConfig(common.TLSOptions{CipherPolicy: common.TLS_CIPHER_POLICY_COMPATIBLE}, "server:12345")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	offered := map[uint16]bool{}
+	for _, suite := range tlsConfig.CipherSuites {
+		offered[suite] = true
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if !offered[suite.ID] {
+			t.Fatalf("expected the compatible policy to offer %s", suite.Name)
+		}
+	}
+}
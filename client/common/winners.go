@@ -0,0 +1,181 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ============================== CONSTANTS ============================== //
+
+// WinnersMode tells how the client waits for the draw to get its winners
+type WinnersMode string
+
+const (
+	// WINNERS_MODE_ASK sends ASK and waits for the WIN reply. Servers that
+	// reply WIT while the draw is not held are asked again after a backoff
+	WINNERS_MODE_ASK WinnersMode = "ask"
+
+	// WINNERS_MODE_SUBSCRIBE sends SUB and keeps the connection idle, with
+	// heartbeats, until the server pushes WIN once the draw is held
+	WINNERS_MODE_SUBSCRIBE WinnersMode = "subscribe"
+
+	DEFAULT_WINNERS_MODE         = WINNERS_MODE_ASK
+	DEFAULT_WINNERS_POLL_BACKOFF = 100 * time.Millisecond
+	DEFAULT_WINNERS_HEARTBEAT    = 5 * time.Second
+
+	// MAX_WINNERS_POLL_BACKOFF bounds the wait between two winners queries
+	// answered with WIT
+	MAX_WINNERS_POLL_BACKOFF = 5 * time.Second
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// WinnersPolicy tells how the client waits for its winners
+type WinnersPolicy struct {
+	// Mode is how the winners are asked for. When empty, DEFAULT_WINNERS_MODE
+	// is used
+	Mode WinnersMode
+
+	// MaxWait bounds the total time waited for the draw, after which a
+	// DrawNotReadyError is returned. Zero waits forever
+	MaxWait time.Duration
+
+	// PollBackoff is the wait before asking again after the first WIT,
+	// doubled on every following one up to MAX_WINNERS_POLL_BACKOFF. When
+	// zero, DEFAULT_WINNERS_POLL_BACKOFF is used
+	PollBackoff time.Duration
+
+	// Heartbeat is the time between the PNG messages sent while subscribed,
+	// unless the connection already sends them as its HeartbeatPolicy
+	// tells. When zero, DEFAULT_WINNERS_HEARTBEAT is used
+	Heartbeat time.Duration
+}
+
+// ============================== PRIVATE - POLICY ============================== //
+
+func (policy WinnersPolicy) mode() WinnersMode {
+	if policy.Mode == "" {
+		return DEFAULT_WINNERS_MODE
+	}
+	return policy.Mode
+}
+
+func (policy WinnersPolicy) pollBackoff() time.Duration {
+	if policy.PollBackoff <= 0 {
+		return DEFAULT_WINNERS_POLL_BACKOFF
+	}
+	return policy.PollBackoff
+}
+
+func (policy WinnersPolicy) heartbeat() time.Duration {
+	if policy.Heartbeat <= 0 {
+		return DEFAULT_WINNERS_HEARTBEAT
+	}
+	return policy.Heartbeat
+}
+
+// ============================== PRIVATE - WAIT FOR WINNERS ============================== //
+
+// setWinnersDeadline Makes reads on the connection fail once MaxWait passed
+// since startedAt, if it is bounded
+func (client *Client) setWinnersDeadline(startedAt time.Time) {
+	if maxWait := client.config.Winners.MaxWait; maxWait > 0 {
+		client.readDeadline = startedAt.Add(maxWait)
+	}
+}
+
+// decodeWinners Returns the winners of a WIN reply
+func (client *Client) decodeWinners(receivedMessage string) ([]string, error) {
+	winners, err := DecodeWinnersMessage(receivedMessage)
+	return winners, NewError(ErrProtocol, err)
+}
+
+// pollForWinners Asks for the winners until the server answers with WIN
+// instead of WIT, waiting longer after every WIT
+func (client *Client) pollForWinners(startedAt time.Time) ([]string, error) {
+	policy := client.config.Winners
+	backoff := policy.pollBackoff()
+
+	for attempt := 1; ; attempt++ {
+		receivedMessage, err := client.sendAskForWinnersMessage()
+		if err != nil {
+			return nil, err
+		}
+		if messageType, _ := DecodeMessageType(receivedMessage); messageType != WAIT_MSG_TYPE {
+			return client.decodeWinners(receivedMessage)
+		}
+
+		waited := time.Since(startedAt)
+		if policy.MaxWait > 0 && waited+backoff > policy.MaxWait {
+			return nil, &DrawNotReadyError{Waited: waited}
+		}
+		client.log.Infof("action: ask_for_winners | result: in_progress | client_id: %v | attempt: %v | waited: %v | wait: %v", client.config.ID, attempt, waited.Round(time.Millisecond), backoff)
+		if err := client.sleep(backoff); err != nil {
+			return nil, err
+		}
+
+		backoff *= 2
+		if backoff > MAX_WINNERS_POLL_BACKOFF {
+			backoff = MAX_WINNERS_POLL_BACKOFF
+		}
+	}
+}
+
+// subscribeForWinners Subscribes to the draw and waits for the server to
+// push WIN, sending heartbeats while the connection is idle. Each PON is
+// logged as the progress of the wait
+func (client *Client) subscribeForWinners(startedAt time.Time) ([]string, error) {
+	if err := client.sendMessage(EncodeSubscribeMessage(client.config.ID)); err != nil {
+		return nil, err
+	}
+	receivedMessage, err := client.receiveAckMessage()
+	if err != nil {
+		return nil, err
+	}
+	if expectedMessage := EncodeAckMessage(SUBSCRIBE_MSG_TYPE); receivedMessage != expectedMessage {
+		client.config.Observer.AckMismatch(expectedMessage, receivedMessage)
+		return nil, &AckMismatchError{Expected: expectedMessage, Received: receivedMessage}
+	}
+	client.setWinnersDeadline(startedAt)
+
+	if client.heartbeats == nil {
+		client.startHeartbeats(client.config.Winners.heartbeat())
+		defer client.stopHeartbeats()
+	}
+	atomic.StoreInt64(&client.waitingWinnersSince, startedAt.UnixNano())
+	defer atomic.StoreInt64(&client.waitingWinnersSince, 0)
+
+	receivedMessage, err = client.receiveReply(client.receiveMessage)
+	if err != nil {
+		return nil, err
+	}
+	if messageType, _ := DecodeMessageType(receivedMessage); messageType != WINNERS_MSG_TYPE {
+		return nil, NewError(ErrProtocol, fmt.Errorf("unexpected message while subscribed: %s", receivedMessage))
+	}
+	return client.decodeWinners(receivedMessage)
+}
+
+// waitForWinners Gets the winners as the WinnersPolicy tells, failing with
+// a DrawNotReadyError once MaxWait passed
+func (client *Client) waitForWinners() ([]string, error) {
+	startedAt := time.Now()
+	client.setWinnersDeadline(startedAt)
+	defer func() { client.readDeadline = time.Time{} }()
+
+	var winners []string
+	var err error
+	if client.config.Winners.mode() == WINNERS_MODE_SUBSCRIBE {
+		winners, err = client.subscribeForWinners(startedAt)
+	} else {
+		winners, err = client.pollForWinners(startedAt)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && client.config.Winners.MaxWait > 0 && time.Since(startedAt) >= client.config.Winners.MaxWait {
+		return nil, &DrawNotReadyError{Waited: time.Since(startedAt)}
+	}
+	return winners, err
+}
@@ -0,0 +1,403 @@
+// Package config is a thin layer on top of viper that knows every key the
+// client accepts. Besides reading command line flags, the config file and the
+// environment, it reads secrets from the files named by *_FILE environment
+// variables (as Docker secrets are mounted), remembers where each value came
+// from and redacts the sensitive ones whenever the configuration is dumped.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	// SECRET_FILE_ENV_SUFFIX is appended to the environment variable of a
+	// key to name the file its value is read from, e.g. CLI_AUTH_HMAC_KEY_FILE
+	SECRET_FILE_ENV_SUFFIX = "_FILE"
+
+	// REDACTED replaces the value of sensitive keys in every dump
+	REDACTED = "<redacted>"
+
+	SOURCE_DEFAULT     = "default"
+	SOURCE_CONFIG_FILE = "file"
+	SOURCE_ENV         = "env"
+	SOURCE_SECRET_FILE = "secret_file"
+	SOURCE_FLAG        = "flag"
+	SOURCE_UNSET       = "unset"
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// Key describes a configuration key
+type Key struct {
+	// Name is the dotted viper key, e.g. server.tls.ca
+	Name string
+
+	// Default is the value used when the key is not set. Nil means no default
+	Default interface{}
+
+	// Sensitive keys are never shown in dumps
+	Sensitive bool
+
+	// Required keys must be set to a non empty value
+	Required bool
+
+	// Rule checks the value of the key when it is set. Nil accepts anything
+	Rule Rule
+
+	// Flag is the name of the command line flag of the key. Empty uses the
+	// name FlagName gives it
+	Flag string
+
+	// Reloadable keys can be changed while the client runs, see Reload
+	Reloadable bool
+}
+
+// Entry is a configuration value ready to be shown
+type Entry struct {
+	Key    string
+	Value  string
+	Source string
+
+	// File is the config file the value was taken from, if any
+	File string
+}
+
+// configFile is a config file already read
+type configFile struct {
+	name   string
+	values *viper.Viper
+}
+
+// Config holds the configuration of the client. The viper instance the
+// values are read from is kept private, so values are only read through the
+// typed getters and dumped through Entries, which redacts the secrets
+type Config struct {
+	settings *viper.Viper
+
+	envPrefix string
+	keys      []Key
+
+	// files hold the values read from each config file, in the order they
+	// were read, so it can tell which one set a nested key
+	files []configFile
+
+	// fileSettings are the values of every config file merged together
+	fileSettings map[string]interface{}
+
+	// defaultFileName is the config file read when none is named, kept to
+	// read the same files again on Reload
+	defaultFileName string
+
+	// secretFiles maps each key read from a secret file to its path
+	secretFiles map[string]string
+
+	// flags are the command line flags bound to the keys, if any
+	flags *pflag.FlagSet
+}
+
+// ============================== BUILDER ============================== //
+
+// New Creates the configuration of the given keys, bound to the environment
+// variables with the given prefix. A key like server.address is read from
+// PREFIX_SERVER_ADDRESS
+func New(envPrefix string, keys []Key) *Config {
+	v := viper.New()
+
+	v.AutomaticEnv()
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+
+	for _, key := range keys {
+		v.BindEnv(key.Name)
+		if key.Default != nil {
+			v.SetDefault(key.Name, key.Default)
+		}
+	}
+
+	return &Config{
+		settings:     v,
+		envPrefix:    envPrefix,
+		keys:         keys,
+		secretFiles:  map[string]string{},
+		fileSettings: map[string]interface{}{},
+	}
+}
+
+// ============================== PUBLIC - LOAD ============================== //
+
+// BindFlags Adds to flags a flag for every key that is not sensitive, named
+// after the key in kebab case, e.g. --server-address for server.address.
+// Flags take precedence over every other source. Sensitive keys get no flag,
+// since command lines are visible to every user of the host. The flags that
+// locate the config files, see ReadConfigFiles, are added as well
+func (config *Config) BindFlags(flags *pflag.FlagSet) {
+	flags.String(CONFIG_FLAG, "", fmt.Sprintf("config file, in any format viper supports, also read from %s", config.EnvName(CONFIG_FLAG)))
+	flags.String(CONFIG_DIR_FLAG, "", fmt.Sprintf("directory of config files merged over the config file, %s next to it by default, also read from %s", OVERLAY_DIR_NAME, config.EnvName("config_dir")))
+	for _, key := range config.keys {
+		if !key.Sensitive {
+			flags.String(config.flagName(key.Name), "", fmt.Sprintf("sets %s, also read from %s", key.Name, config.EnvName(key.Name)))
+		}
+	}
+	config.bindFlagSet(flags)
+}
+
+// bindFlagSet Binds every key to its flag in flags, which must already
+// have been added
+func (config *Config) bindFlagSet(flags *pflag.FlagSet) {
+	for _, key := range config.keys {
+		if !key.Sensitive {
+			config.settings.BindPFlag(key.Name, flags.Lookup(config.flagName(key.Name)))
+		}
+	}
+	config.flags = flags
+}
+
+// ReadConfigFile Reads the values of the given config file, in any format
+// viper supports, told by its extension. Values of a file take precedence
+// over the ones of the files read before it, and values from the
+// environment keep taking precedence over all of them
+func (config *Config) ReadConfigFile(fileName string) error {
+	file := viper.New()
+	file.SetConfigFile(fileName)
+	if err := file.ReadInConfig(); err != nil {
+		return err
+	}
+
+	values := viper.New()
+	if err := values.MergeConfigMap(flattenBlocks(file.AllSettings()).(map[string]interface{})); err != nil {
+		return err
+	}
+
+	// viper refuses to merge values of different types, as an int read from
+	// YAML and an int64 read from TOML, so files are merged here and the
+	// result is handed to viper as a whole
+	mergeSettings(config.fileSettings, flattenBlocks(file.AllSettings()).(map[string]interface{}))
+	content, err := yaml.Marshal(config.fileSettings)
+	if err != nil {
+		return err
+	}
+	config.settings.SetConfigType("yaml")
+	if err := config.settings.ReadConfig(bytes.NewReader(content)); err != nil {
+		return err
+	}
+
+	config.files = append(config.files, configFile{name: fileName, values: values})
+	return nil
+}
+
+// ReadSecretFiles Sets every key whose *_FILE environment variable is defined
+// to the content of the file it names, without the trailing newline. It is
+// an error to define both the variable of a key and its *_FILE variant.
+// Every problem found is reported in a single ValidationError
+func (config *Config) ReadSecretFiles() error {
+	var problems []string
+
+	for _, key := range config.keys {
+		envName := config.EnvName(key.Name)
+		fileName, found := os.LookupEnv(envName + SECRET_FILE_ENV_SUFFIX)
+		if !found || config.flagChanged(key.Name) {
+			continue
+		}
+		if _, found := os.LookupEnv(envName); found {
+			problems = append(problems, fmt.Sprintf("%s and %s%s are both set", envName, envName, SECRET_FILE_ENV_SUFFIX))
+			continue
+		}
+
+		content, err := os.ReadFile(fileName)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s can not be read from %s: %v", key.Name, fileName, err))
+			continue
+		}
+		config.settings.Set(key.Name, strings.TrimRight(string(content), "\r\n"))
+		config.secretFiles[key.Name] = fileName
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// mergeSettings Merges the nested settings of source into target. Values of
+// source take precedence, whatever their type
+func mergeSettings(target map[string]interface{}, source map[string]interface{}) {
+	for key, value := range source {
+		nestedSource, sourceIsMap := value.(map[string]interface{})
+		nestedTarget, targetIsMap := target[key].(map[string]interface{})
+		if sourceIsMap && targetIsMap {
+			mergeSettings(nestedTarget, nestedSource)
+			continue
+		}
+		target[key] = value
+	}
+}
+
+// flattenBlocks Replaces the single element lists HCL decodes blocks into by
+// their only element, so server { address = "..." } sets server.address as
+// it does in every other format
+func flattenBlocks(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case []map[string]interface{}:
+		if len(typed) == 1 {
+			return flattenBlocks(typed[0])
+		}
+	case map[string]interface{}:
+		for key, nested := range typed {
+			typed[key] = flattenBlocks(nested)
+		}
+	}
+	return value
+}
+
+// ============================== PUBLIC - VALUES ============================== //
+
+// GetString Returns the value of key as a string
+func (config *Config) GetString(key string) string {
+	return config.settings.GetString(key)
+}
+
+// GetInt Returns the value of key as an int
+func (config *Config) GetInt(key string) int {
+	return config.settings.GetInt(key)
+}
+
+// GetBool Returns the value of key as a bool
+func (config *Config) GetBool(key string) bool {
+	return config.settings.GetBool(key)
+}
+
+// GetDuration Returns the value of key as a duration
+func (config *Config) GetDuration(key string) time.Duration {
+	return config.settings.GetDuration(key)
+}
+
+// IsSet Tells whether key has a value, from any source or its default
+func (config *Config) IsSet(key string) bool {
+	return config.settings.IsSet(key)
+}
+
+// ============================== PUBLIC - INSPECT ============================== //
+
+// FlagName Turns a dotted camel case key into the name of its command line
+// flag, without dashes, e.g. server.tls.serverName into server-tls-server-name
+func FlagName(key string) string {
+	var name strings.Builder
+	for _, character := range key {
+		switch {
+		case character == '.':
+			name.WriteRune('-')
+		case unicode.IsUpper(character):
+			name.WriteRune('-')
+			name.WriteRune(unicode.ToLower(character))
+		default:
+			name.WriteRune(character)
+		}
+	}
+	return name.String()
+}
+
+// flagName Returns the command line flag of the given key, without dashes
+func (config *Config) flagName(key string) string {
+	for _, candidate := range config.keys {
+		if candidate.Name == key && candidate.Flag != "" {
+			return candidate.Flag
+		}
+	}
+	return FlagName(key)
+}
+
+// flagChanged Tells whether key was set with its command line flag
+func (config *Config) flagChanged(key string) bool {
+	return config.flags != nil && config.flags.Changed(config.flagName(key))
+}
+
+// EnvName Returns the environment variable the given key is read from
+func (config *Config) EnvName(key string) string {
+	return strings.ToUpper(config.envPrefix + "_" + strings.ReplaceAll(key, ".", "_"))
+}
+
+// Keys Returns the keys of the configuration, in declaration order
+func (config *Config) Keys() []Key {
+	return append([]Key{}, config.keys...)
+}
+
+// IsSensitive Tells whether the value of key must never be shown
+func (config *Config) IsSensitive(key string) bool {
+	for _, candidate := range config.keys {
+		if strings.EqualFold(candidate.Name, key) {
+			return candidate.Sensitive
+		}
+	}
+	return false
+}
+
+// Files Returns the config files read, in the order they were read
+func (config *Config) Files() []string {
+	names := make([]string, 0, len(config.files))
+	for _, file := range config.files {
+		names = append(names, file.name)
+	}
+	return names
+}
+
+// FileOf Returns the config file the value of key is taken from, which is
+// the last one read that sets it, or an empty string if none does
+func (config *Config) FileOf(key string) string {
+	for i := len(config.files) - 1; i >= 0; i-- {
+		if config.files[i].values.IsSet(key) {
+			return config.files[i].name
+		}
+	}
+	return ""
+}
+
+// Source Tells where the value of key comes from: a flag, a secret file,
+// the environment, the config file, its default, or nowhere
+func (config *Config) Source(key string) string {
+	if config.flagChanged(key) {
+		return SOURCE_FLAG
+	}
+	if _, found := config.secretFiles[key]; found {
+		return SOURCE_SECRET_FILE
+	}
+	if _, found := os.LookupEnv(config.EnvName(key)); found {
+		return SOURCE_ENV
+	}
+	if config.FileOf(key) != "" {
+		return SOURCE_CONFIG_FILE
+	}
+	if config.settings.IsSet(key) {
+		return SOURCE_DEFAULT
+	}
+	return SOURCE_UNSET
+}
+
+// Entries Returns the value and source of every key, in declaration order.
+// Values of sensitive keys are replaced by REDACTED unless they are empty,
+// so whether a secret was provided is still visible
+func (config *Config) Entries() []Entry {
+	entries := make([]Entry, 0, len(config.keys))
+	for _, key := range config.keys {
+		value := config.GetString(key.Name)
+		if key.Sensitive && value != "" {
+			value = REDACTED
+		}
+		entry := Entry{Key: key.Name, Value: value, Source: config.Source(key.Name)}
+		if entry.Source == SOURCE_CONFIG_FILE {
+			entry.File = config.FileOf(key.Name)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+var testKeys = []Key{
+	{Name: "server.address"},
+	{Name: "server.ackTimeout", Default: "30s"},
+	{Name: "auth.hmac.key", Sensitive: true},
+	{Name: "log.level"},
+	{Name: "loop.period"},
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fileName, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestSecretsAreReadFromFiles(t *testing.T) {
+	t.Setenv("TEST_AUTH_HMAC_KEY_FILE", writeFile(t, "hmac_key", "s3cr3t\n"))
+
+	config := New("test", testKeys)
+	if err := config.ReadSecretFiles(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key := config.GetString("auth.hmac.key"); key != "s3cr3t" {
+		t.Fatalf("unexpected secret: %q", key)
+	}
+	if source := config.Source("auth.hmac.key"); source != SOURCE_SECRET_FILE {
+		t.Fatalf("unexpected source: %s", source)
+	}
+}
+
+func TestSecretFileAndVariableCanNotBeBothSet(t *testing.T) {
+	t.Setenv("TEST_AUTH_HMAC_KEY", "s3cr3t")
+	t.Setenv("TEST_AUTH_HMAC_KEY_FILE", writeFile(t, "hmac_key", "s3cr3t"))
+	t.Setenv("TEST_LOG_LEVEL_FILE", filepath.Join(t.TempDir(), "missing"))
+
+	err := New("test", testKeys).ReadSecretFiles()
+	if err == nil || !strings.Contains(err.Error(), "both set") || !strings.Contains(err.Error(), "log.level") {
+		t.Fatalf("expected every problem to be reported, got: %v", err)
+	}
+}
+
+func TestEntriesRedactSensitiveValuesAndTellTheirSource(t *testing.T) {
+	t.Setenv("TEST_AUTH_HMAC_KEY", "s3cr3t")
+	t.Setenv("TEST_LOG_LEVEL", "DEBUG")
+
+	config := New("test", testKeys)
+	fileName := writeFile(t, "config.yaml", "server:\n  address: server:12345\nlog:\n  level: INFO\n")
+	if err := config.ReadConfigFile(fileName); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []Entry{
+		{Key: "server.address", Value: "server:12345", Source: SOURCE_CONFIG_FILE, File: fileName},
+		{Key: "server.ackTimeout", Value: "30s", Source: SOURCE_DEFAULT},
+		{Key: "auth.hmac.key", Value: REDACTED, Source: SOURCE_ENV},
+		{Key: "log.level", Value: "DEBUG", Source: SOURCE_ENV},
+		{Key: "loop.period", Value: "", Source: SOURCE_UNSET},
+	}
+	entries := config.Entries()
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Fatalf("unexpected entry: got %+v, want %+v", entries[i], expected[i])
+		}
+	}
+}
+
+func TestFlagsTakePrecedenceOverEnvAndFile(t *testing.T) {
+	t.Setenv("TEST_LOG_LEVEL", "DEBUG")
+	t.Setenv("TEST_SERVER_ADDRESS", "env:12345")
+
+	config := New("test", testKeys)
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	config.BindFlags(flags)
+	if flags.Lookup("auth-hmac-key") != nil {
+		t.Fatal("sensitive keys must not get a flag")
+	}
+	if err := flags.Parse([]string{"--log-level", "ERROR", "--server-ack-timeout=5s"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := config.ReadConfigFile(writeFile(t, "config.yaml", "log:\n  level: INFO\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string][2]string{
+		"log.level":         {"ERROR", SOURCE_FLAG},
+		"server.ackTimeout": {"5s", SOURCE_FLAG},
+		"server.address":    {"env:12345", SOURCE_ENV},
+	}
+	for key, want := range expected {
+		if value, source := config.GetString(key), config.Source(key); value != want[0] || source != want[1] {
+			t.Errorf("%s: got %q from %s, want %q from %s", key, value, source, want[0], want[1])
+		}
+	}
+}
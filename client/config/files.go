@@ -0,0 +1,127 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	// CONFIG_FLAG names the base config file. It can also be set with the
+	// PREFIX_CONFIG environment variable, e.g. CLI_CONFIG
+	CONFIG_FLAG = "config"
+
+	// CONFIG_DIR_FLAG names the overlay directory. It can also be set with
+	// the PREFIX_CONFIG_DIR environment variable, e.g. CLI_CONFIG_DIR
+	CONFIG_DIR_FLAG = "config-dir"
+
+	// OVERLAY_DIR_NAME is the overlay directory used when none is set, next
+	// to the base config file
+	OVERLAY_DIR_NAME = "config.d"
+)
+
+// ============================== PRIVATE - FILES ============================== //
+
+// location Returns the value of the given flag if it was set, or else the
+// value of its environment variable, or else defaultValue. It also tells
+// whether the value was set explicitly
+func (config *Config) location(flagName string, defaultValue string) (string, bool) {
+	if config.flags != nil && config.flags.Changed(flagName) {
+		value, _ := config.flags.GetString(flagName)
+		return value, true
+	}
+	if value, found := os.LookupEnv(config.EnvName(strings.ReplaceAll(flagName, "-", "_"))); found && value != "" {
+		return value, true
+	}
+	return defaultValue, false
+}
+
+// isSupportedFile Tells whether viper can read the given file, by its
+// extension
+func isSupportedFile(fileName string) bool {
+	extension := strings.TrimPrefix(filepath.Ext(fileName), ".")
+	for _, supported := range viper.SupportedExts {
+		if strings.EqualFold(extension, supported) {
+			return true
+		}
+	}
+	return false
+}
+
+// OverlayFiles Returns the config files of dir that viper can read, sorted
+// by name so they are always merged in the same order. Hidden files are
+// skipped, and a missing dir has no files
+func OverlayFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var fileNames []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !isSupportedFile(entry.Name()) {
+			continue
+		}
+		fileNames = append(fileNames, filepath.Join(dir, entry.Name()))
+	}
+	sort.Strings(fileNames)
+	return fileNames, nil
+}
+
+// ============================== PUBLIC - LOAD ============================== //
+
+// ReadConfigFiles Reads the base config file and then its overlays. The base
+// file is the one named by the --config flag or the PREFIX_CONFIG variable,
+// or defaultFileName if neither is set. Overlays are the files of the
+// directory named by --config-dir or PREFIX_CONFIG_DIR, by default config.d
+// next to the base file, read in order of their names, so the values of
+// 20-prod.toml take precedence over the ones of 10-base.yaml. Any format
+// viper supports can be used and mixed.
+//
+// A missing default file or overlay directory is not a problem, since every
+// key can be set through the environment, but missing ones that were named
+// explicitly are. Every problem found is reported in a single
+// ValidationError
+func (config *Config) ReadConfigFiles(defaultFileName string) error {
+	var problems []string
+	config.defaultFileName = defaultFileName
+
+	fileName, explicitFile := config.location(CONFIG_FLAG, defaultFileName)
+	if err := config.ReadConfigFile(fileName); errors.Is(err, fs.ErrNotExist) {
+		if explicitFile {
+			problems = append(problems, fmt.Sprintf("config file %s does not exist", fileName))
+		}
+	} else if err != nil {
+		problems = append(problems, fmt.Sprintf("config file %s can not be read: %v", fileName, err))
+	}
+
+	overlayDir, explicitDir := config.location(CONFIG_DIR_FLAG, filepath.Join(filepath.Dir(fileName), OVERLAY_DIR_NAME))
+	if _, err := os.Stat(overlayDir); explicitDir && err != nil {
+		problems = append(problems, fmt.Sprintf("config directory %s can not be read: %v", overlayDir, err))
+	}
+	overlays, err := OverlayFiles(overlayDir)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("config directory %s can not be read: %v", overlayDir, err))
+	}
+	for _, overlay := range overlays {
+		if err := config.ReadConfigFile(overlay); err != nil {
+			problems = append(problems, fmt.Sprintf("config file %s can not be read: %v", overlay, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func writeConfigDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		fileName := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fileName), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fileName, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestOverlaysAreMergedInOrderOfTheirNames(t *testing.T) {
+	dir := writeConfigDir(t, map[string]string{
+		"client.toml":              "[server]\naddress = \"base:12345\"\nackTimeout = \"30s\"\n\n[log]\nlevel = \"INFO\"\n",
+		"config.d/20-prod.json":    `{"log": {"level": "ERROR"}}`,
+		"config.d/10-staging.yaml": "server:\n  address: staging:12345\nlog:\n  level: DEBUG\n",
+		"config.d/notes.txt":       "not a config file",
+	})
+	t.Setenv("TEST_CONFIG", filepath.Join(dir, "client.toml"))
+
+	config := New("test", testKeys)
+	if err := config.ReadConfigFiles("missing.yaml"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{
+		filepath.Join(dir, "client.toml"),
+		filepath.Join(dir, "config.d", "10-staging.yaml"),
+		filepath.Join(dir, "config.d", "20-prod.json"),
+	}
+	if strings.Join(config.Files(), ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected files: %v", config.Files())
+	}
+	if config.GetString("server.address") != "staging:12345" || config.FileOf("server.address") != expected[1] {
+		t.Fatalf("unexpected server.address: %s from %s", config.GetString("server.address"), config.FileOf("server.address"))
+	}
+	if config.GetString("log.level") != "ERROR" || config.FileOf("log.level") != expected[2] {
+		t.Fatalf("unexpected log.level: %s from %s", config.GetString("log.level"), config.FileOf("log.level"))
+	}
+	if config.GetString("server.ackTimeout") != "30s" {
+		t.Fatalf("unexpected server.ackTimeout: %s", config.GetString("server.ackTimeout"))
+	}
+}
+
+func TestValuesOfDifferentTypesOverrideEachOther(t *testing.T) {
+	dir := writeConfigDir(t, map[string]string{
+		"config.yaml":          "loop:\n  period: 5\n",
+		"config.d/period.toml": "[loop]\nperiod = \"1s\"\n",
+	})
+
+	config := New("test", testKeys)
+	if err := config.ReadConfigFiles(filepath.Join(dir, "config.yaml")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if period := config.GetString("loop.period"); period != "1s" {
+		t.Fatalf("unexpected loop.period: %s", period)
+	}
+}
+
+func TestConfigFilesNamedWithFlags(t *testing.T) {
+	dir := writeConfigDir(t, map[string]string{
+		"base.ini":            "[server]\naddress = ini:12345\n",
+		"overlays/level.yaml": "log:\n  level: WARNING\n",
+	})
+
+	config := New("test", testKeys)
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	config.BindFlags(flags)
+	if err := flags.Parse([]string{"--config", filepath.Join(dir, "base.ini"), "--config-dir", filepath.Join(dir, "overlays")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.ReadConfigFiles("missing.yaml"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.GetString("server.address") != "ini:12345" || config.GetString("log.level") != "WARNING" {
+		t.Fatalf("unexpected values: %v", config.Entries())
+	}
+}
+
+func TestMissingFilesAreOnlyAProblemWhenNamed(t *testing.T) {
+	if err := New("test", testKeys).ReadConfigFiles(filepath.Join(t.TempDir(), "config.yaml")); err != nil {
+		t.Fatalf("unexpected error for a missing default file: %v", err)
+	}
+
+	t.Setenv("TEST_CONFIG", filepath.Join(t.TempDir(), "client.toml"))
+	t.Setenv("TEST_CONFIG_DIR", filepath.Join(t.TempDir(), "overlays"))
+	err := New("test", testKeys).ReadConfigFiles("config.yaml")
+	if err == nil || !strings.Contains(err.Error(), "client.toml does not exist") || !strings.Contains(err.Error(), "overlays can not be read") {
+		t.Fatalf("expected both missing locations to be reported, got: %v", err)
+	}
+}
+
+func TestMarshalWritesTheEffectiveConfig(t *testing.T) {
+	t.Setenv("TEST_AUTH_HMAC_KEY", "s3cr3t")
+	t.Setenv("TEST_LOG_LEVEL", "DEBUG")
+
+	config := New("test", testKeys)
+	content, err := config.Marshal(FORMAT_YAML)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "server:\n  ackTimeout: 30s\nauth:\n  hmac:\n    key: <redacted>\nlog:\n  level: DEBUG\n"
+	if string(content) != expected {
+		t.Fatalf("unexpected yaml:\n%s", content)
+	}
+
+	content, err = config.Marshal(FORMAT_TOML)
+	if err != nil || !strings.Contains(string(content), "level = \"DEBUG\"") {
+		t.Fatalf("unexpected toml: %s (%v)", content, err)
+	}
+	if _, err := config.Marshal("xml"); err == nil {
+		t.Fatal("expected an error for an unsupported format")
+	}
+}
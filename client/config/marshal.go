@@ -0,0 +1,99 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v2"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	FORMAT_YAML = "yaml"
+	FORMAT_JSON = "json"
+	FORMAT_TOML = "toml"
+)
+
+// ============================== PRIVATE - MARSHAL ============================== //
+
+// effectiveValues Returns the value of every key that is set, nested by
+// the parts of its name and in declaration order. Sensitive values are
+// replaced by REDACTED unless they are empty
+func (config *Config) effectiveValues() yaml.MapSlice {
+	root := yaml.MapSlice{}
+	for _, key := range config.keys {
+		if config.Source(key.Name) == SOURCE_UNSET {
+			continue
+		}
+		value := config.settings.Get(key.Name)
+		if key.Sensitive && config.GetString(key.Name) != "" {
+			value = REDACTED
+		}
+		root = setNested(root, strings.Split(key.Name, "."), value)
+	}
+	return root
+}
+
+// setNested Sets the value at the given path of node, creating the nested
+// nodes it goes through
+func setNested(node yaml.MapSlice, path []string, value interface{}) yaml.MapSlice {
+	for i := range node {
+		if node[i].Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			node[i].Value = value
+		} else if nested, ok := node[i].Value.(yaml.MapSlice); ok {
+			node[i].Value = setNested(nested, path[1:], value)
+		}
+		return node
+	}
+
+	if len(path) == 1 {
+		return append(node, yaml.MapItem{Key: path[0], Value: value})
+	}
+	return append(node, yaml.MapItem{Key: path[0], Value: setNested(yaml.MapSlice{}, path[1:], value)})
+}
+
+// toMap Turns a node into nested maps, for the encoders that do not know
+// yaml.MapSlice
+func toMap(node yaml.MapSlice) map[string]interface{} {
+	result := make(map[string]interface{}, len(node))
+	for _, item := range node {
+		if nested, ok := item.Value.(yaml.MapSlice); ok {
+			result[item.Key.(string)] = toMap(nested)
+		} else {
+			result[item.Key.(string)] = item.Value
+		}
+	}
+	return result
+}
+
+// ============================== PUBLIC ============================== //
+
+// Marshal Encodes the effective configuration, merged from every source, as
+// a config file of the given format: yaml, json or toml. Keys that are not
+// set are left out and sensitive values are redacted
+func (config *Config) Marshal(format string) ([]byte, error) {
+	values := config.effectiveValues()
+
+	switch strings.ToLower(format) {
+	case FORMAT_YAML:
+		return yaml.Marshal(values)
+	case FORMAT_JSON:
+		content, err := json.MarshalIndent(toMap(values), "", "  ")
+		return append(content, '\n'), err
+	case FORMAT_TOML:
+		tree, err := toml.TreeFromMap(toMap(values))
+		if err != nil {
+			return nil, err
+		}
+		content, err := tree.ToTomlString()
+		return []byte(content), err
+	default:
+		return nil, fmt.Errorf("unsupported config format %q, expected one of %s, %s or %s", format, FORMAT_YAML, FORMAT_JSON, FORMAT_TOML)
+	}
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// Change is a key whose value differs between two configurations. Values of
+// sensitive keys are redacted
+type Change struct {
+	Key string
+	Old string
+	New string
+}
+
+// ============================== PUBLIC ============================== //
+
+func (change Change) String() string {
+	return fmt.Sprintf("%s: %q -> %q", change.Key, change.Old, change.New)
+}
+
+// IsReloadable Tells whether key can be changed while the client runs
+func (config *Config) IsReloadable(key string) bool {
+	for _, candidate := range config.keys {
+		if strings.EqualFold(candidate.Name, key) {
+			return candidate.Reloadable
+		}
+	}
+	return false
+}
+
+// Reload Reads the configuration again from the same flags, environment,
+// config files and secret files, and validates it. The configuration is
+// not changed: the one read is returned, so the caller can compare them
+// and decide what to apply
+func (config *Config) Reload() (*Config, error) {
+	fresh := New(config.envPrefix, config.keys)
+	if config.flags != nil {
+		fresh.bindFlagSet(config.flags)
+	}
+
+	if err := fresh.ReadConfigFiles(config.defaultFileName); err != nil {
+		return nil, err
+	}
+	if err := fresh.ReadSecretFiles(); err != nil {
+		return nil, err
+	}
+	if err := fresh.Validate(); err != nil {
+		return nil, err
+	}
+	return fresh, nil
+}
+
+// CopyValue Sets key to the value it has in other, so a change that can
+// not be applied is undone in the configuration read again
+func (config *Config) CopyValue(key string, other *Config) {
+	config.settings.Set(key, other.settings.Get(key))
+}
+
+// Changes Returns the keys whose value in other differs from the one in
+// config, in declaration order
+func (config *Config) Changes(other *Config) []Change {
+	var changes []Change
+	otherEntries := other.Entries()
+	for i, entry := range config.Entries() {
+		if entry.Value != otherEntries[i].Value {
+			changes = append(changes, Change{Key: entry.Key, Old: entry.Value, New: otherEntries[i].Value})
+		} else if config.IsSensitive(entry.Key) && config.GetString(entry.Key) != other.GetString(entry.Key) {
+			changes = append(changes, Change{Key: entry.Key, Old: entry.Value, New: otherEntries[i].Value})
+		}
+	}
+	return changes
+}
+
+// Watch Calls onChange with the name of the config file every time one of
+// the config files read is written, and returns the function that stops
+// watching them. Once it returns, onChange is not called anymore. As viper's
+// WatchConfig does, the directory of each file is watched, so files replaced
+// by editors are still followed. Files added to the overlay directory
+// afterwards are not watched, so they are only picked up when the
+// configuration is reloaded for another reason
+func (config *Config) Watch(onChange func(fileName string)) (func(), error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	watchedFiles := map[string]string{}
+	for _, file := range config.files {
+		watchedName, err := filepath.Abs(file.name)
+		if err != nil {
+			watchedName = filepath.Clean(file.name)
+		}
+		watchedFiles[watchedName] = file.name
+		if err := watcher.Add(filepath.Dir(watchedName)); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case event, open := <-watcher.Events:
+				if !open {
+					return
+				}
+				fileName, watched := watchedFiles[filepath.Clean(event.Name)]
+				if watched && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					onChange(fileName)
+				}
+			case _, open := <-watcher.Errors:
+				if !open {
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		watcher.Close()
+		<-stopped
+	}, nil
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var reloadKeys = []Key{
+	{Name: "server.address"},
+	{Name: "auth.hmac.key", Sensitive: true},
+	{Name: "log.level", Rule: OneOf("INFO", "DEBUG"), Reloadable: true},
+}
+
+func TestReloadReadsTheConfigFilesAgain(t *testing.T) {
+	dir := writeConfigDir(t, map[string]string{
+		"client.yaml":          "server:\n  address: server:12345\nlog:\n  level: INFO\n",
+		"config.d/10-key.yaml": "auth:\n  hmac:\n    key: before\n",
+	})
+	fileName := filepath.Join(dir, "client.yaml")
+
+	config := New("test", reloadKeys)
+	if err := config.ReadConfigFiles(fileName); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := os.WriteFile(fileName, []byte("server:\n  address: other:12345\nlog:\n  level: DEBUG\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.d", "10-key.yaml"), []byte("auth:\n  hmac:\n    key: after\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh, err := config.Reload()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.GetString("log.level") != "INFO" {
+		t.Fatalf("expected the configuration to be left as it was, got log.level %q", config.GetString("log.level"))
+	}
+
+	expected := []Change{
+		{Key: "server.address", Old: "server:12345", New: "other:12345"},
+		{Key: "auth.hmac.key", Old: REDACTED, New: REDACTED},
+		{Key: "log.level", Old: "INFO", New: "DEBUG"},
+	}
+	changes := config.Changes(fresh)
+	if len(changes) != len(expected) {
+		t.Fatalf("expected changes %v, got %v", expected, changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("expected change %v, got %v", expected[i], changes[i])
+		}
+	}
+
+	if config.IsReloadable("server.address") || !config.IsReloadable("log.level") {
+		t.Error("expected only log.level to be reloadable")
+	}
+}
+
+func TestReloadRejectsAnInvalidConfiguration(t *testing.T) {
+	fileName := writeFile(t, "client.yaml", "log:\n  level: INFO\n")
+	config := New("test", reloadKeys)
+	if err := config.ReadConfigFiles(fileName); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := os.WriteFile(fileName, []byte("log:\n  level: LOUD\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Reload(); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestWatchTellsWhenAConfigFileIsWritten(t *testing.T) {
+	fileName := writeFile(t, "client.yaml", "log:\n  level: INFO\n")
+	config := New("test", reloadKeys)
+	if err := config.ReadConfigFiles(fileName); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	changed := make(chan string, 1)
+	stopWatching, err := config.Watch(func(name string) {
+		select {
+		case changed <- name:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer stopWatching()
+
+	if err := os.WriteFile(fileName, []byte("log:\n  level: DEBUG\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-changed:
+		if name != fileName {
+			t.Fatalf("expected %s to change, got %s", fileName, name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the change to be noticed")
+	}
+}
+
+func TestWatchStopsTellingOnceStopped(t *testing.T) {
+	fileName := writeFile(t, "client.yaml", "log:\n  level: INFO\n")
+	config := New("test", reloadKeys)
+	if err := config.ReadConfigFiles(fileName); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	changed := make(chan string, 1)
+	stopWatching, err := config.Watch(func(name string) { changed <- name })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stopWatching()
+
+	if err := os.WriteFile(fileName, []byte("log:\n  level: DEBUG\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-changed:
+		t.Fatalf("unexpected change of %s after stopping", name)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,167 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// Rule checks a value of a key. It is only called for values that are set,
+// empty values are checked by Key.Required
+type Rule func(value string) error
+
+// ValidationError lists every problem found in the configuration
+type ValidationError struct {
+	Problems []string
+}
+
+// ============================== PUBLIC - RULES ============================== //
+
+// IntBetween Accepts integers from min to max, both included
+func IntBetween(min int, max int) Rule {
+	return func(value string) error {
+		number, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+		if number < min || number > max {
+			return fmt.Errorf("must be between %d and %d", min, max)
+		}
+		return nil
+	}
+}
+
+// IntAtLeast Accepts integers not lower than min
+func IntAtLeast(min int) Rule {
+	return func(value string) error {
+		number, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+		if number < min {
+			return fmt.Errorf("must be at least %d", min)
+		}
+		return nil
+	}
+}
+
+// DurationAtLeast Accepts durations like 500ms or 1m30s not shorter than min
+func DurationAtLeast(min time.Duration) Rule {
+	return func(value string) error {
+		duration, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("must be a duration such as 500ms or 30s")
+		}
+		if duration < min {
+			return fmt.Errorf("must be at least %v", min)
+		}
+		return nil
+	}
+}
+
+// Bool Accepts the values strconv.ParseBool does, e.g. true or false
+func Bool(value string) error {
+	if _, err := strconv.ParseBool(strings.TrimSpace(value)); err != nil {
+		return fmt.Errorf("must be true or false")
+	}
+	return nil
+}
+
+// OneOf Accepts the given values, ignoring case
+func OneOf(values ...string) Rule {
+	return func(value string) error {
+		for _, candidate := range values {
+			if strings.EqualFold(candidate, strings.TrimSpace(value)) {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(values, ", "))
+	}
+}
+
+// HostPort Accepts host:port addresses to connect to, e.g. server:12345
+func HostPort(value string) error {
+	host, err := splitAddress(value)
+	if err == nil && host == "" {
+		return fmt.Errorf("must be a host:port address, the host is missing")
+	}
+	return err
+}
+
+// ListenAddress Accepts host:port addresses to listen on, where the host
+// can be left out to listen on every interface, e.g. :9100
+func ListenAddress(value string) error {
+	_, err := splitAddress(value)
+	return err
+}
+
+// splitAddress Returns the host of a host:port address, checking the port
+func splitAddress(value string) (string, error) {
+	host, port, err := net.SplitHostPort(strings.TrimSpace(value))
+	if err != nil {
+		return "", fmt.Errorf("must be a host:port address")
+	}
+	if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+		return "", fmt.Errorf("must be a host:port address with a port between 1 and 65535")
+	}
+	return host, nil
+}
+
+// ============================== PUBLIC ============================== //
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// Validate Checks every key against its rules and returns a ValidationError
+// listing all the problems found, or nil if there are none. Each problem
+// tells where the wrong value was taken from, so it can be fixed there
+func (config *Config) Validate() error {
+	var problems []string
+
+	for _, key := range config.keys {
+		value := config.GetString(key.Name)
+		if strings.TrimSpace(value) == "" {
+			if key.Required {
+				problems = append(problems, fmt.Sprintf("%s is required, set it in the config file or with %s", key.Name, config.EnvName(key.Name)))
+			}
+			continue
+		}
+		if key.Rule == nil {
+			continue
+		}
+		if err := key.Rule(value); err != nil {
+			shown := fmt.Sprintf("%q", value)
+			if key.Sensitive {
+				shown = REDACTED
+			}
+			problems = append(problems, fmt.Sprintf("%s %v, got %s from %s", key.Name, err, shown, config.describeSource(key.Name)))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// describeSource Tells where the value of key comes from, naming the
+// variable or file to change
+func (config *Config) describeSource(key string) string {
+	switch source := config.Source(key); source {
+	case SOURCE_FLAG:
+		return "--" + config.flagName(key)
+	case SOURCE_ENV:
+		return config.EnvName(key)
+	case SOURCE_SECRET_FILE:
+		return config.secretFiles[key]
+	case SOURCE_CONFIG_FILE:
+		return config.FileOf(key)
+	default:
+		return source
+	}
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var validatedKeys = []Key{
+	{Name: "id", Required: true, Rule: IntAtLeast(1)},
+	{Name: "server.address", Required: true, Rule: HostPort},
+	{Name: "server.ackTimeout", Rule: DurationAtLeast(0)},
+	{Name: "auth.hmac.key", Sensitive: true, Rule: OneOf("never")},
+	{Name: "log.level", Required: true, Rule: OneOf("INFO", "DEBUG")},
+	{Name: "batch.maxKiB", Default: 8, Rule: IntBetween(1, 8)},
+	{Name: "metrics.address", Rule: ListenAddress},
+}
+
+func TestValidConfigurationPasses(t *testing.T) {
+	t.Setenv("TEST_ID", "3")
+	t.Setenv("TEST_LOG_LEVEL", "debug")
+	t.Setenv("TEST_METRICS_ADDRESS", ":9100")
+
+	config := New("test", validatedKeys)
+	if err := config.ReadConfigFile(writeFile(t, "config.yaml", "server:\n  address: server:12345\n  ackTimeout: 5s\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateReportsEveryProblemWithItsSource(t *testing.T) {
+	t.Setenv("TEST_BATCH_MAXKIB", "0")
+	t.Setenv("TEST_AUTH_HMAC_KEY", "s3cr3t")
+
+	config := New("test", validatedKeys)
+	fileName := writeFile(t, "config.yaml", "server:\n  address: \":12345\"\n  ackTimeout: soon\n")
+	if err := config.ReadConfigFile(fileName); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var validationError *ValidationError
+	if err := config.Validate(); !errors.As(err, &validationError) {
+		t.Fatalf("expected a validation error, got: %v", err)
+	}
+	expected := []string{
+		"id is required, set it in the config file or with TEST_ID",
+		`server.address must be a host:port address, the host is missing, got ":12345" from ` + fileName,
+		`server.ackTimeout must be a duration such as 500ms or 30s, got "soon" from ` + fileName,
+		"auth.hmac.key must be one of never, got <redacted> from TEST_AUTH_HMAC_KEY",
+		"log.level is required, set it in the config file or with TEST_LOG_LEVEL",
+		`batch.maxKiB must be between 1 and 8, got "0" from TEST_BATCH_MAXKIB`,
+	}
+	if strings.Join(validationError.Problems, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected problems:\n%s", strings.Join(validationError.Problems, "\n"))
+	}
+}
+
+func TestRules(t *testing.T) {
+	cases := []struct {
+		rule  Rule
+		value string
+		valid bool
+	}{
+		{IntAtLeast(1), "1", true},
+		{IntAtLeast(1), "0", false},
+		{IntAtLeast(1), "one", false},
+		{IntBetween(1, 8), "8", true},
+		{IntBetween(1, 8), "9", false},
+		{DurationAtLeast(time.Second), "1m", true},
+		{DurationAtLeast(time.Second), "10ms", false},
+		{Bool, "false", true},
+		{Bool, "nope", false},
+		{OneOf("text", "json"), "JSON", true},
+		{OneOf("text", "json"), "xml", false},
+		{HostPort, "server:12345", true},
+		{HostPort, "server", false},
+		{HostPort, "server:123456", false},
+		{ListenAddress, ":9100", true},
+		{ListenAddress, "9100", false},
+	}
+
+	for _, c := range cases {
+		if err := c.rule(c.value); (err == nil) != c.valid {
+			t.Errorf("unexpected result for %q: %v", c.value, err)
+		}
+	}
+}
@@ -0,0 +1,623 @@
+// Package fakehq is an in-process stand-in for the national lottery
+// headquarters server, meant for testing the client without Docker. It
+// speaks the same BET/ACK/NMB/ASK/WIN protocol as the Python server, keeps
+// the bets in memory and holds the draw once every agency asked for the
+// winners, either with ASK or subscribing with SUB. It also answers the
+// optional HLO admission handshake, granting credits to the clients that
+// support them when asked to, and the PNG heartbeats. How it behaves can be
+// scripted with a Behaviour, to reproduce faulty or overloaded servers.
+package fakehq
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// ============================== CONSTANTS ============================== //
+
+// DEFAULT_WINNER_NUMBER is the number drawn by the Python server
+const DEFAULT_WINNER_NUMBER = "7574"
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// Behaviour scripts how the server deviates from the protocol
+type Behaviour struct {
+	// AckDelay is waited before acknowledging each message
+	AckDelay time.Duration
+
+	// AckCountOffset is added to the amount of bets acknowledged for each batch
+	AckCountOffset int
+
+	// DropConnectionAfterBatches closes the connection instead of
+	// acknowledging the batch with that number, counting from 1. Zero
+	// means never
+	DropConnectionAfterBatches int
+
+	// NeverReleaseBarrier makes every winners query wait forever
+	NeverReleaseBarrier bool
+
+	// PollWinners answers every ASK received before the draw with WIT, as
+	// the server of exercise 7 did, instead of blocking until the draw
+	PollWinners bool
+
+	// IgnorePings leaves every PNG unanswered, as a dead peer would
+	IgnorePings bool
+
+	// BusyHandshakes is the amount of HLO handshakes answered with BSY,
+	// asking to retry after BusyRetryAfter, before admitting any client.
+	// The connection is closed after each BSY
+	BusyHandshakes int
+	BusyRetryAfter time.Duration
+
+	// Credits are granted in reply to the HLO of clients that advertise
+	// support for credits, which must then never send beyond them or the
+	// connection is dropped. When zero, they are admitted with ACK[HLO], as
+	// a server without credits would. Clients that do not advertise it are
+	// never limited
+	Credits common.Credits
+
+	// CreditsPerBatch are granted in the ACK of each batch or, when
+	// CreditsInSeparateMessage is set, in a CRD sent after it
+	CreditsPerBatch          common.Credits
+	CreditsInSeparateMessage bool
+}
+
+// Options configures a Server
+type Options struct {
+	// Agencies is the amount of agencies that must ask for the winners
+	// before the draw is held
+	Agencies int
+
+	// WinnerNumber is the number of the winner bets. Defaults to
+	// DEFAULT_WINNER_NUMBER
+	WinnerNumber string
+
+	Behaviour Behaviour
+
+	// TLS secures the listener created by Start. When it requires client
+	// certificates, every message must belong to the agency named in the
+	// certificate of the connection, or the connection is dropped
+	TLS *tls.Config
+
+	// HMACKeys maps each agency to the key its messages are signed with.
+	// When set, unsigned messages, messages with an invalid signature and
+	// replayed messages drop the connection, and replies are signed
+	HMACKeys map[string][]byte
+
+	// MaxClockSkew is the clock skew accepted on signed messages. Defaults
+	// to common.DEFAULT_MAX_CLOCK_SKEW
+	MaxClockSkew time.Duration
+}
+
+// Server is a fake headquarters server. It is safe for concurrent use
+type Server struct {
+	options Options
+
+	lock        sync.Mutex
+	bets        []*common.Bet
+	connections map[net.Conn]struct{}
+	signers     map[string]*common.MessageSigner
+	listeners   []net.Listener
+	closed      bool
+	busyReplies int
+	pings       int
+	ignorePings bool
+
+	barrierLock   sync.Mutex
+	askedAgencies map[string]struct{}
+	drawHeld      chan struct{}
+	shutdown      chan struct{}
+	wg            sync.WaitGroup
+}
+
+// ============================== BUILDER ============================== //
+
+func New(options Options) *Server {
+	if options.Agencies <= 0 {
+		options.Agencies = 1
+	}
+	if options.WinnerNumber == "" {
+		options.WinnerNumber = DEFAULT_WINNER_NUMBER
+	}
+	return &Server{
+		options:       options,
+		connections:   map[net.Conn]struct{}{},
+		signers:       map[string]*common.MessageSigner{},
+		askedAgencies: map[string]struct{}{},
+		drawHeld:      make(chan struct{}),
+		shutdown:      make(chan struct{}),
+	}
+}
+
+// ============================== PRIVATE - SESSION ============================== //
+
+// session holds what the server knows about the agency on a connection
+type session struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	certificate *x509.Certificate
+
+	// signer verifies the messages of signedAgency and signs the replies.
+	// Both are set by the first signed message of the connection
+	signer       *common.MessageSigner
+	signedAgency string
+
+	// credits are the credits granted to the client, if it supports them
+	credits common.CreditWindow
+
+	// writeLock keeps the WIN pushed once the draw is held from being
+	// interleaved with the replies to the heartbeats
+	writeLock sync.Mutex
+}
+
+// clientCertificate Completes the TLS handshake of conn, if any, and
+// returns the certificate presented by the client. Nil is returned for
+// connections without client certificates
+func clientCertificate(conn net.Conn) (*x509.Certificate, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	peerCertificates := tlsConn.ConnectionState().PeerCertificates
+	if len(peerCertificates) == 0 {
+		return nil, nil
+	}
+	return peerCertificates[0], nil
+}
+
+// signerFor Returns the signer shared by every connection of agency, so
+// replayed nonces are detected even across connections
+func (server *Server) signerFor(agency string) (*common.MessageSigner, error) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if signer, found := server.signers[agency]; found {
+		return signer, nil
+	}
+	key, found := server.options.HMACKeys[agency]
+	if !found {
+		return nil, fmt.Errorf("no key for agency %s", agency)
+	}
+	signer := common.NewServerMessageSigner(agency, key, server.options.MaxClockSkew)
+	server.signers[agency] = signer
+	return signer, nil
+}
+
+// assertAgency Checks that the agency a message belongs to is the one
+// authenticated by the client certificate and the message signature
+func (session *session) assertAgency(agency string) error {
+	if session.certificate != nil && !common.CertificateMatchesAgency(session.certificate, agency) {
+		return fmt.Errorf("agency %s does not match client certificate %s", agency, session.certificate.Subject.CommonName)
+	}
+	if session.signer != nil && agency != session.signedAgency {
+		return fmt.Errorf("agency %s does not match message signature of agency %s", agency, session.signedAgency)
+	}
+	return nil
+}
+
+// ============================== PRIVATE - SEND/RECEIVE MESSAGES ============================== //
+
+func (server *Server) receiveMessage(session *session) (string, error) {
+	message, err := session.reader.ReadString(common.END_MSG_DELIMITER[0])
+	if err != nil || server.options.HMACKeys == nil {
+		return message, err
+	}
+
+	envelope, _, err := common.DecodeSignatureEnvelope(message)
+	if err != nil {
+		return "", err
+	}
+	signer, err := server.signerFor(envelope.Agency)
+	if err != nil {
+		return "", err
+	}
+	if session.signer != nil && session.signer != signer {
+		return "", fmt.Errorf("agency changed from %s to %s on the same connection", session.signedAgency, envelope.Agency)
+	}
+	session.signer = signer
+	session.signedAgency = envelope.Agency
+
+	return signer.Verify(message)
+}
+
+// sendMessage Sends messages with a single write, so connections made with
+// net.Pipe, whose writes block until read, do not deadlock when the client
+// sends its next message before reading the last of them
+func (server *Server) sendMessage(session *session, messages ...string) error {
+	session.writeLock.Lock()
+	defer session.writeLock.Unlock()
+
+	frame := []byte{}
+	for _, message := range messages {
+		if session.signer != nil {
+			signedMessage, err := session.signer.Sign(message)
+			if err != nil {
+				return err
+			}
+			message = signedMessage
+		}
+		frame = append(frame, message...)
+	}
+	_, err := session.conn.Write(frame)
+	return err
+}
+
+// sendReplyMessage Sends the reply to a message after the AckDelay
+func (server *Server) sendReplyMessage(session *session, messages ...string) error {
+	if server.options.Behaviour.AckDelay > 0 {
+		select {
+		case <-time.After(server.options.Behaviour.AckDelay):
+		case <-server.shutdown:
+			return net.ErrClosed
+		}
+	}
+	return server.sendMessage(session, messages...)
+}
+
+func (server *Server) sendAckMessage(session *session, payload string) error {
+	return server.sendReplyMessage(session, common.EncodeAckMessage(payload))
+}
+
+// sendBetBatchAckMessage Acknowledges a batch, granting the CreditsPerBatch
+// to clients limited by credits
+func (server *Server) sendBetBatchAckMessage(session *session, payload string) error {
+	behaviour := server.options.Behaviour
+	if !session.credits.Limited() || behaviour.CreditsPerBatch == (common.Credits{}) {
+		return server.sendAckMessage(session, payload)
+	}
+
+	session.credits.Grant(behaviour.CreditsPerBatch)
+	if !behaviour.CreditsInSeparateMessage {
+		return server.sendReplyMessage(session, common.EncodeAckWithCreditsMessage(payload, behaviour.CreditsPerBatch))
+	}
+	return server.sendReplyMessage(session, common.EncodeAckMessage(payload), common.EncodeCreditMessage(behaviour.CreditsPerBatch))
+}
+
+// ============================== PRIVATE - HANDLE MESSAGES ============================== //
+
+func (server *Server) handleBetBatchMessage(session *session, message string) error {
+	betBatch, err := common.DecodeBetBatchMessage(message)
+	if err != nil || len(betBatch) == 0 {
+		server.sendAckMessage(session, "0")
+		return fmt.Errorf("invalid bet batch: %v", err)
+	}
+	for _, bet := range betBatch {
+		if err := session.assertAgency(bet.Agency); err != nil {
+			return err
+		}
+	}
+	if !session.credits.Allows(len(message)) {
+		return fmt.Errorf("bet batch beyond the credits granted: %v", session.credits.Available())
+	}
+	session.credits.Take(len(message))
+
+	server.lock.Lock()
+	server.bets = append(server.bets, betBatch...)
+	server.lock.Unlock()
+
+	return server.sendBetBatchAckMessage(session, strconv.Itoa(len(betBatch)+server.options.Behaviour.AckCountOffset))
+}
+
+func (server *Server) handleNoMoreBetsMessage(session *session, message string) error {
+	agency, err := common.DecodeNoMoreBetsMessage(message)
+	if err != nil {
+		return err
+	}
+	if err := session.assertAgency(agency); err != nil {
+		return err
+	}
+	return server.sendAckMessage(session, common.NO_MORE_BETS_MSG_TYPE)
+}
+
+// admit Tells whether a handshake is admitted, or must be answered with BSY
+// as the Behaviour asks
+func (server *Server) admit() bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if server.busyReplies < server.options.Behaviour.BusyHandshakes {
+		server.busyReplies++
+		return false
+	}
+	return true
+}
+
+func (server *Server) handleHelloMessage(session *session, message string) error {
+	agency, credits, err := common.DecodeHelloMessage(message)
+	if err != nil {
+		return err
+	}
+	if err := session.assertAgency(agency); err != nil {
+		return err
+	}
+
+	if !server.admit() {
+		server.sendMessage(session, common.EncodeBusyMessage(server.options.Behaviour.BusyRetryAfter))
+		return fmt.Errorf("agency %s not admitted, server busy", agency)
+	}
+	if initialCredits := server.options.Behaviour.Credits; credits && initialCredits != (common.Credits{}) {
+		session.credits.Open(initialCredits)
+		return server.sendReplyMessage(session, common.EncodeCreditMessage(initialCredits))
+	}
+	return server.sendAckMessage(session, common.HELLO_MSG_TYPE)
+}
+
+// arriveAtBarrier Counts agency as waiting for the draw, holding it once
+// every agency did, and tells whether the draw was held
+func (server *Server) arriveAtBarrier(agency string) bool {
+	server.barrierLock.Lock()
+	defer server.barrierLock.Unlock()
+
+	server.askedAgencies[agency] = struct{}{}
+	if len(server.askedAgencies) == server.options.Agencies && !server.options.Behaviour.NeverReleaseBarrier {
+		select {
+		case <-server.drawHeld:
+		default:
+			close(server.drawHeld)
+		}
+	}
+
+	select {
+	case <-server.drawHeld:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitForDraw blocks until every agency asked for the winners, as the
+// barrier of the Python server does
+func (server *Server) waitForDraw() error {
+	select {
+	case <-server.drawHeld:
+		return nil
+	case <-server.shutdown:
+		return net.ErrClosed
+	}
+}
+
+func (server *Server) handleAskForWinnersMessage(session *session, message string) error {
+	agency, err := common.DecodeAskForWinnersMessage(message)
+	if err != nil {
+		return err
+	}
+	if err := session.assertAgency(agency); err != nil {
+		return err
+	}
+
+	if drawHeld := server.arriveAtBarrier(agency); !drawHeld && server.options.Behaviour.PollWinners {
+		return server.sendMessage(session, common.EncodeWaitMessage())
+	}
+	server.pushWinnersOnDraw(session, agency)
+	return nil
+}
+
+// pushWinnersOnDraw Sends the WIN of agency once the draw is held, from
+// another goroutine, so the connection keeps answering heartbeats meanwhile
+func (server *Server) pushWinnersOnDraw(session *session, agency string) {
+	server.wg.Add(1)
+	go func() {
+		defer server.wg.Done()
+		if err := server.waitForDraw(); err == nil {
+			server.sendMessage(session, common.EncodeWinnersMessage(server.Winners(agency)))
+		}
+	}()
+}
+
+// handlePingMessage Answers a heartbeat, unless the Behaviour asks to
+// ignore them
+func (server *Server) handlePingMessage(session *session) error {
+	server.lock.Lock()
+	server.pings++
+	ignorePings := server.ignorePings || server.options.Behaviour.IgnorePings
+	server.lock.Unlock()
+
+	if ignorePings {
+		return nil
+	}
+	return server.sendMessage(session, common.EncodePongMessage())
+}
+
+// handleSubscribeMessage Acknowledges the subscription and pushes the WIN
+// once the draw is held, while the connection keeps answering heartbeats
+func (server *Server) handleSubscribeMessage(session *session, message string) error {
+	agency, err := common.DecodeSubscribeMessage(message)
+	if err != nil {
+		return err
+	}
+	if err := session.assertAgency(agency); err != nil {
+		return err
+	}
+
+	server.arriveAtBarrier(agency)
+	if err := server.sendAckMessage(session, common.SUBSCRIBE_MSG_TYPE); err != nil {
+		return err
+	}
+
+	server.pushWinnersOnDraw(session, agency)
+	return nil
+}
+
+func (server *Server) handleConnection(conn net.Conn) {
+	defer server.wg.Done()
+	defer server.forgetConnection(conn)
+
+	certificate, err := clientCertificate(conn)
+	if err != nil {
+		return
+	}
+
+	session := &session{conn: conn, reader: bufio.NewReader(conn), certificate: certificate}
+	receivedBatches := 0
+	for {
+		message, err := server.receiveMessage(session)
+		if err != nil {
+			return
+		}
+
+		messageType, err := common.DecodeMessageType(message)
+		if err != nil {
+			return
+		}
+
+		switch messageType {
+		case common.HELLO_MSG_TYPE:
+			err = server.handleHelloMessage(session, message)
+		case common.BET_MSG_TYPE:
+			receivedBatches++
+			if receivedBatches == server.options.Behaviour.DropConnectionAfterBatches {
+				return
+			}
+			err = server.handleBetBatchMessage(session, message)
+		case common.NO_MORE_BETS_MSG_TYPE:
+			err = server.handleNoMoreBetsMessage(session, message)
+		case common.ASK_FOR_WINNERS_MSG_TYPE:
+			err = server.handleAskForWinnersMessage(session, message)
+		case common.SUBSCRIBE_MSG_TYPE:
+			err = server.handleSubscribeMessage(session, message)
+		case common.PING_MSG_TYPE:
+			err = server.handlePingMessage(session)
+		default:
+			err = fmt.Errorf("invalid message type received: %s", messageType)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ============================== PRIVATE - CONNECTIONS ============================== //
+
+func (server *Server) trackConnection(conn net.Conn) bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if server.closed {
+		return false
+	}
+	server.connections[conn] = struct{}{}
+	server.wg.Add(1)
+	return true
+}
+
+func (server *Server) forgetConnection(conn net.Conn) {
+	conn.Close()
+
+	server.lock.Lock()
+	delete(server.connections, conn)
+	server.lock.Unlock()
+}
+
+// ============================== PUBLIC ============================== //
+
+// Serve Accepts connections from listener until it is closed, handling
+// each one on its own goroutine
+func (server *Server) Serve(listener net.Listener) error {
+	server.lock.Lock()
+	server.listeners = append(server.listeners, listener)
+	server.lock.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if !server.trackConnection(conn) {
+			conn.Close()
+			return net.ErrClosed
+		}
+		go server.handleConnection(conn)
+	}
+}
+
+// Start Serves on a new TCP listener bound to a random local port and
+// returns its address. The listener is secured with Options.TLS, if set
+func (server *Server) Start() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	if server.options.TLS != nil {
+		listener = tls.NewListener(listener, server.options.TLS)
+	}
+	go server.Serve(listener)
+	return listener.Addr().String(), nil
+}
+
+// Close Stops every listener, drops every connection and waits for their
+// handlers to finish
+func (server *Server) Close() {
+	server.lock.Lock()
+	if server.closed {
+		server.lock.Unlock()
+		return
+	}
+	server.closed = true
+	close(server.shutdown)
+	for _, listener := range server.listeners {
+		listener.Close()
+	}
+	for conn := range server.connections {
+		conn.Close()
+	}
+	server.lock.Unlock()
+
+	server.wg.Wait()
+}
+
+// Bets Returns a copy of every bet stored so far
+func (server *Server) Bets() []*common.Bet {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	return append([]*common.Bet{}, server.bets...)
+}
+
+// BusyReplies Returns the amount of handshakes answered with BSY so far
+func (server *Server) BusyReplies() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.busyReplies
+}
+
+// StopAnsweringPings Leaves every following PNG unanswered, as a peer that
+// died while the client was connected would
+func (server *Server) StopAnsweringPings() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.ignorePings = true
+}
+
+// Pings Returns the amount of heartbeats received so far
+func (server *Server) Pings() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.pings
+}
+
+// Winners Returns the documents of the winner bets of the given agency
+func (server *Server) Winners(agency string) []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	winners := []string{}
+	for _, bet := range server.bets {
+		if bet.Agency == agency && bet.Number == server.options.WinnerNumber {
+			winners = append(winners, bet.Document)
+		}
+	}
+	return winners
+}
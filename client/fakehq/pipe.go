@@ -0,0 +1,58 @@
+package fakehq
+
+import (
+	"net"
+	"sync"
+)
+
+// pipeAddr is the address reported by the ends of a PipeListener connection
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "fakehq" }
+
+// PipeListener is an in-memory net.Listener whose connections are created
+// with net.Pipe, so tests do not need to bind any port. Its Dial method can
+// be used as the Dial function of a common.ClientConfig
+type PipeListener struct {
+	connections chan net.Conn
+	closeOnce   sync.Once
+	closed      chan struct{}
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		connections: make(chan net.Conn),
+		closed:      make(chan struct{}),
+	}
+}
+
+// Dial Returns the client end of a new connection, whose server end is
+// handed to Accept. Network and address are ignored
+func (listener *PipeListener) Dial(network string, address string) (net.Conn, error) {
+	serverConn, clientConn := net.Pipe()
+	select {
+	case listener.connections <- serverConn:
+		return clientConn, nil
+	case <-listener.closed:
+		return nil, &net.OpError{Op: "dial", Net: "pipe", Err: net.ErrClosed}
+	}
+}
+
+func (listener *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.connections:
+		return conn, nil
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (listener *PipeListener) Close() error {
+	listener.closeOnce.Do(func() { close(listener.closed) })
+	return nil
+}
+
+func (listener *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
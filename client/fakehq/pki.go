@@ -0,0 +1,181 @@
+package fakehq
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const CERTIFICATE_VALIDITY = 24 * time.Hour
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// CA is a throwaway certificate authority that issues the certificates of
+// the fake server and of the agencies. It only lives in memory and must
+// never be used outside tests
+type CA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPEM     []byte
+
+	serialLock sync.Mutex
+	serial     int64
+}
+
+// ============================== BUILDER ============================== //
+
+func NewCA() (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fakehq test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(CERTIFICATE_VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{
+		certificate: certificate,
+		key:         key,
+		certPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		serial:      1,
+	}, nil
+}
+
+// ============================== PRIVATE - ISSUE ============================== //
+
+func (ca *CA) nextSerial() *big.Int {
+	ca.serialLock.Lock()
+	defer ca.serialLock.Unlock()
+
+	ca.serial++
+	return big.NewInt(ca.serial)
+}
+
+func (ca *CA) issue(template *x509.Certificate) (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template.SerialNumber = ca.nextSerial()
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(CERTIFICATE_VALIDITY)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		nil
+}
+
+// ============================== PUBLIC ============================== //
+
+// CertPEM Returns the PEM encoded certificate of the CA, to be used as the
+// CA bundle of clients and servers
+func (ca *CA) CertPEM() []byte {
+	return ca.certPEM
+}
+
+// CertPool Returns a pool that only trusts this CA
+func (ca *CA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+	return pool
+}
+
+// IssueServerCertificate Issues a server certificate valid for localhost,
+// 127.0.0.1 and the given extra host names
+func (ca *CA) IssueServerCertificate(hosts ...string) (tls.Certificate, error) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "fakehq"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    append([]string{"localhost"}, hosts...),
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certPEM, keyPEM, err := ca.issue(template)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// IssueClientCertificate Issues a client certificate whose subject common
+// name is commonName, returning it and its key PEM encoded
+func (ca *CA) IssueClientCertificate(commonName string) (certPEM []byte, keyPEM []byte, err error) {
+	return ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+// WriteClientFiles Writes the CA bundle and a client certificate for
+// commonName into dir, returning the paths of the CA, certificate and key
+func (ca *CA) WriteClientFiles(dir string, commonName string) (caFile string, certFile string, keyFile string, err error) {
+	certPEM, keyPEM, err := ca.IssueClientCertificate(commonName)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	caFile = filepath.Join(dir, "ca.pem")
+	certFile = filepath.Join(dir, commonName+".crt")
+	keyFile = filepath.Join(dir, commonName+".key")
+	files := map[string][]byte{caFile: ca.certPEM, certFile: certPEM, keyFile: keyPEM}
+	for fileName, content := range files {
+		if err := os.WriteFile(fileName, content, 0o600); err != nil {
+			return "", "", "", err
+		}
+	}
+	return caFile, certFile, keyFile, nil
+}
+
+// ServerTLSConfig Returns the TLS configuration of a server using a
+// certificate issued by this CA. When requireClientCertificate is true,
+// clients must present a certificate issued by this CA too
+func (ca *CA) ServerTLSConfig(requireClientCertificate bool) (*tls.Config, error) {
+	certificate, err := ca.IssueServerCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	if requireClientCertificate {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = ca.CertPool()
+	}
+	return config, nil
+}
@@ -0,0 +1,33 @@
+// Package gologging adapts go-logging to the common.Logger interface, so
+// the common package, and so any program embedding the client, does not
+// depend on go-logging. The client and loadgen binaries log through it.
+package gologging
+
+import (
+	"github.com/op/go-logging"
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// Logger adapts a go-logging logger to the common.Logger interface
+type Logger struct {
+	*logging.Logger
+}
+
+// ============================== BUILDER ============================== //
+
+// New Returns a Logger that logs through the go-logging logger of the given
+// module, using the backend set with logging.SetBackend
+func New(module string) *Logger {
+	return &Logger{Logger: logging.MustGetLogger(module)}
+}
+
+// ============================== PUBLIC ============================== //
+
+func (logger *Logger) DebugEnabled() bool {
+	return logger.IsEnabledFor(logging.DEBUG)
+}
+
+func (logger *Logger) InfoEnabled() bool {
+	return logger.IsEnabledFor(logging.INFO)
+}
@@ -0,0 +1,32 @@
+package gologging
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/logformat"
+)
+
+func TestLoggerFollowsTheLevelOfItsBackend(t *testing.T) {
+	var output bytes.Buffer
+	backend := logformat.NewLevelBackend(logformat.NewJSONBackend(&output), logging.WARNING)
+	logging.SetBackend(backend)
+	logger := New("gologging_test")
+
+	if logger.DebugEnabled() || logger.InfoEnabled() {
+		t.Fatal("expected debug and info to be disabled at warning")
+	}
+	logger.Infof("action: hidden | result: success")
+
+	backend.SetLevel(logging.INFO, "")
+	if logger.DebugEnabled() || !logger.InfoEnabled() {
+		t.Fatal("expected only info to be enabled at info")
+	}
+	logger.Infof("action: shown | result: success")
+
+	if bytes.Contains(output.Bytes(), []byte("hidden")) || !bytes.Contains(output.Bytes(), []byte("shown")) {
+		t.Fatalf("unexpected output: %s", output.String())
+	}
+}
@@ -0,0 +1,219 @@
+// Package logformat renders the client logs. Log messages follow the
+// "action: X | result: Y | k: v" convention; the text format prints them as
+// they are, while the JSON format parses them into one object per event so
+// log pipelines do not need to regex-parse each line. Field names, and so the
+// action/result vocabulary, are the same in both formats.
+package logformat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/op/go-logging"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+
+	TEXT_LAYOUT = `%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`
+	TIME_LAYOUT = "2006-01-02T15:04:05.000Z07:00"
+
+	FIELDS_SEPARATOR    = " | "
+	KEY_VALUE_SEPARATOR = ": "
+
+	// MESSAGE_FIELD holds the parts of a message that are not key/value pairs
+	MESSAGE_FIELD = "msg"
+)
+
+// stringFields, and fields ending with one of stringFieldSuffixes, are never
+// converted to numbers or booleans, so their type does not depend on their
+// value
+var stringFieldSuffixes = []string{"_id", "_version"}
+
+var stringFields = map[string]bool{
+	"action":    true,
+	"result":    true,
+	"client_id": true,
+	"error":     true,
+	"msg":       true,
+}
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// Field is a key/value pair of a log message
+type Field struct {
+	Key   string
+	Value string
+}
+
+// JSONBackend is a go-logging backend that writes each record as a JSON
+// object in a single line
+type JSONBackend struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+// LevelBackend is a logging.LeveledBackend with a single level for every
+// module that can be changed while other goroutines log, which the backend
+// of logging.AddModuleLevel does not allow
+type LevelBackend struct {
+	backend logging.Backend
+	level   int32
+}
+
+// ============================== BUILDER ============================== //
+
+// NewLevelBackend Returns a backend that only passes to backend the records
+// of the given level or a more severe one
+func NewLevelBackend(backend logging.Backend, level logging.Level) *LevelBackend {
+	return &LevelBackend{backend: backend, level: int32(level)}
+}
+
+func NewJSONBackend(writer io.Writer) *JSONBackend {
+	return &JSONBackend{writer: writer}
+}
+
+// NewBackend Returns the backend that writes records to writer in the given
+// format: text or json
+func NewBackend(format string, writer io.Writer) (logging.Backend, error) {
+	switch strings.ToLower(format) {
+	case "", FORMAT_TEXT:
+		return logging.NewBackendFormatter(logging.NewLogBackend(writer, "", 0), logging.MustStringFormatter(TEXT_LAYOUT)), nil
+	case FORMAT_JSON:
+		return NewJSONBackend(writer), nil
+	default:
+		return nil, fmt.Errorf("unsupported log format %q, expected one of text or json", format)
+	}
+}
+
+// ============================== PUBLIC - PARSE ============================== //
+
+// ParseFields Splits a "action: X | result: Y | k: v" message in its fields.
+// A part without a key is appended to the value of the previous field, so
+// values containing the separator are kept whole. Leading text without a
+// key is returned as a MESSAGE_FIELD
+func ParseFields(message string) []Field {
+	var fields []Field
+	for _, part := range strings.Split(message, FIELDS_SEPARATOR) {
+		key, value, found := cutKeyValue(part)
+		if found {
+			fields = append(fields, Field{Key: key, Value: value})
+			continue
+		}
+		if len(fields) == 0 {
+			fields = append(fields, Field{Key: MESSAGE_FIELD, Value: part})
+			continue
+		}
+		fields[len(fields)-1].Value += FIELDS_SEPARATOR + part
+	}
+	return fields
+}
+
+// cutKeyValue Splits "key: value". Keys can not contain spaces, so free text
+// with a colon is not mistaken for a field
+func cutKeyValue(part string) (string, string, bool) {
+	index := strings.Index(part, KEY_VALUE_SEPARATOR)
+	if index <= 0 || strings.ContainsAny(part[:index], " \t") {
+		return "", "", false
+	}
+	return part[:index], part[index+len(KEY_VALUE_SEPARATOR):], true
+}
+
+// typedValue Returns value as a number or a boolean when it is one, so it is
+// encoded as such
+func typedValue(key string, value string) interface{} {
+	if isStringField(key) {
+		return value
+	}
+	if number, err := strconv.ParseInt(value, 10, 64); err == nil && (value == "0" || value[0] != '0') {
+		return number
+	}
+	if number, err := strconv.ParseFloat(value, 64); err == nil && !strings.ContainsAny(value, "xXnN") {
+		return number
+	}
+	if value == "true" || value == "false" {
+		return value == "true"
+	}
+	return value
+}
+
+func isStringField(key string) bool {
+	if stringFields[key] {
+		return true
+	}
+	for _, suffix := range stringFieldSuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================== PUBLIC - LOG ============================== //
+
+// Log Implements logging.Backend. The object holds the time, the level and
+// the fields of the message, in the same order they were logged
+func (backend *JSONBackend) Log(level logging.Level, calldepth int, record *logging.Record) error {
+	var line bytes.Buffer
+	line.WriteString(`{"time":`)
+	writeJSON(&line, record.Time.Format(TIME_LAYOUT))
+	line.WriteString(`,"level":`)
+	writeJSON(&line, level.String())
+
+	seen := map[string]bool{"time": true, "level": true}
+	for _, field := range ParseFields(record.Message()) {
+		if seen[field.Key] {
+			continue
+		}
+		seen[field.Key] = true
+
+		line.WriteByte(',')
+		writeJSON(&line, field.Key)
+		line.WriteByte(':')
+		writeJSON(&line, typedValue(field.Key, field.Value))
+	}
+	line.WriteString("}\n")
+
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	_, err := backend.writer.Write(line.Bytes())
+	return err
+}
+
+func (backend *LevelBackend) Log(level logging.Level, calldepth int, record *logging.Record) error {
+	if !backend.IsEnabledFor(level, record.Module) {
+		return nil
+	}
+	return backend.backend.Log(level, calldepth+1, record)
+}
+
+// GetLevel Returns the level of every module
+func (backend *LevelBackend) GetLevel(module string) logging.Level {
+	return logging.Level(atomic.LoadInt32(&backend.level))
+}
+
+// SetLevel Sets the level of every module, whatever module is given
+func (backend *LevelBackend) SetLevel(level logging.Level, module string) {
+	atomic.StoreInt32(&backend.level, int32(level))
+}
+
+func (backend *LevelBackend) IsEnabledFor(level logging.Level, module string) bool {
+	return level <= backend.GetLevel(module)
+}
+
+func writeJSON(buffer *bytes.Buffer, value interface{}) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buffer.Write(encoded)
+}
@@ -0,0 +1,83 @@
+package logformat
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestParseFields(t *testing.T) {
+	fields := ParseFields("action: send_message | result: fail | client_id: 1 | error: read: connection reset | by peer")
+	expected := []Field{
+		{Key: "action", Value: "send_message"},
+		{Key: "result", Value: "fail"},
+		{Key: "client_id", Value: "1"},
+		{Key: "error", Value: "read: connection reset | by peer"},
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("unexpected fields: got %+v, want %+v", fields, expected)
+	}
+
+	if fields := ParseFields("plain text: not a field"); fields[0] != (Field{Key: MESSAGE_FIELD, Value: "plain text: not a field"}) {
+		t.Fatalf("unexpected fields: %+v", fields)
+	}
+}
+
+func TestJSONBackendWritesTypedFields(t *testing.T) {
+	var output bytes.Buffer
+	backend := logging.AddModuleLevel(NewJSONBackend(&output))
+	backend.SetLevel(logging.INFO, "")
+	logger := logging.MustGetLogger("logformat_test")
+	logger.SetBackend(backend)
+
+	logger.Infof("action: send_bet_batch | result: success | client_id: %v | bet_batch_size: %v | ack_latency_ms: %v | retried: %v | tls_min_version: %v",
+		"007", 20, 1.5, false, "1.2")
+	logger.Debugf("action: discarded | result: success")
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(output.Bytes(), &event); err != nil {
+		t.Fatalf("invalid JSON %q: %v", output.String(), err)
+	}
+	expected := map[string]interface{}{
+		"action":          "send_bet_batch",
+		"result":          "success",
+		"client_id":       "007",
+		"bet_batch_size":  float64(20),
+		"ack_latency_ms":  1.5,
+		"retried":         false,
+		"tls_min_version": "1.2",
+		"level":           "INFO",
+	}
+	for key, value := range expected {
+		if event[key] != value {
+			t.Fatalf("unexpected %s: got %#v, want %#v", key, event[key], value)
+		}
+	}
+}
+
+func TestNewBackendRejectsUnknownFormats(t *testing.T) {
+	if _, err := NewBackend("xml", &bytes.Buffer{}); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
+
+func TestLevelBackendCanChangeItsLevel(t *testing.T) {
+	var output bytes.Buffer
+	backend := NewLevelBackend(NewJSONBackend(&output), logging.INFO)
+	logger := logging.MustGetLogger("logformat_level_test")
+	logger.SetBackend(backend)
+
+	logger.Debugf("action: hidden | result: success")
+	backend.SetLevel(logging.DEBUG, "")
+	logger.Debugf("action: shown | result: success")
+
+	if bytes.Contains(output.Bytes(), []byte("hidden")) || !bytes.Contains(output.Bytes(), []byte("shown")) {
+		t.Fatalf("unexpected output: %s", output.String())
+	}
+	if !logger.IsEnabledFor(logging.DEBUG) {
+		t.Fatal("expected debug to be enabled")
+	}
+}
@@ -1,115 +1,351 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"unicode"
 
 	"github.com/op/go-logging"
-	"github.com/spf13/viper"
+	"github.com/spf13/pflag"
 
 	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/config"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/logformat"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/metrics"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/report"
 )
 
 var log = logging.MustGetLogger("log")
 
+// logBackend is the backend InitLogger sets, kept to change the log level
+// when the configuration is reloaded
+var logBackend *logformat.LevelBackend
+
+// DEFAULT_CONFIG_FILE is read when no other config file is named
+const DEFAULT_CONFIG_FILE = "./config.yaml"
+
+// logLevels are the levels go-logging accepts, from the least to the most
+// verbose
+var logLevels = []string{"CRITICAL", "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG"}
+
+// configKeys are the configuration parameters of the client, along with the
+// rules their values must follow. Sensitive ones are never printed
+var configKeys = []config.Key{
+	{Name: "id", Required: true, Rule: config.IntAtLeast(1)},
+	{Name: "server.address", Required: true, Rule: config.HostPort},
+	{Name: "server.ackTimeout", Rule: config.DurationAtLeast(0), Reloadable: true},
+	{Name: "server.tls.enabled", Rule: config.Bool},
+	{Name: "server.tls.ca"},
+	{Name: "server.tls.serverName"},
+	{Name: "server.tls.minVersion", Rule: config.OneOf("1.0", "1.1", "1.2", "1.3")},
+	{Name: "server.tls.ciphers", Rule: config.OneOf(common.TLS_CIPHER_POLICY_DEFAULT, common.TLS_CIPHER_POLICY_MODERN, common.TLS_CIPHER_POLICY_COMPATIBLE)},
+	{Name: "server.tls.cert"},
+	{Name: "server.tls.key"},
+	{Name: "connect.jitter", Rule: config.DurationAtLeast(0)},
+	{Name: "connect.retry.maxWait", Rule: config.DurationAtLeast(0)},
+	{Name: "connect.retry.backoff", Rule: config.DurationAtLeast(0)},
+	{Name: "connect.handshake", Rule: config.Bool},
+	{Name: "connect.credits", Rule: config.Bool},
+	{Name: "connect.keepAlive.enabled", Default: true, Rule: config.Bool},
+	{Name: "connect.keepAlive.period", Rule: config.DurationAtLeast(0)},
+	{Name: "heartbeat.interval", Rule: config.DurationAtLeast(0)},
+	{Name: "heartbeat.maxMissedPongs", Default: common.DEFAULT_MAX_MISSED_PONGS, Rule: config.IntAtLeast(1)},
+	{Name: "auth.hmac.key", Sensitive: true},
+	{Name: "auth.hmac.maxClockSkew", Rule: config.DurationAtLeast(0)},
+	{Name: "log.level", Required: true, Rule: config.OneOf(logLevels...), Reloadable: true},
+	{Name: "log.format", Default: logformat.FORMAT_TEXT, Rule: config.OneOf(logformat.FORMAT_TEXT, logformat.FORMAT_JSON)},
+	{Name: "log.pii", Default: string(common.DEFAULT_PII_POLICY), Rule: config.OneOf(string(common.PII_FULL), string(common.PII_MASKED), string(common.PII_HASHED), string(common.PII_NONE))},
+	{Name: "batch.maxAmount", Required: true, Rule: config.IntAtLeast(1), Reloadable: true},
+	{Name: "batch.maxKiB", Flag: "batch-max-kib", Default: common.MAX_KIB_PER_BATCH, Rule: config.IntBetween(1, common.MAX_KIB_PER_BATCH), Reloadable: true},
+	{Name: "batch.adaptive.targetLatency", Rule: config.DurationAtLeast(0), Reloadable: true},
+	{Name: "batch.adaptive.minAmount", Default: common.DEFAULT_ADAPTIVE_BATCH_MIN_AMOUNT, Rule: config.IntAtLeast(1), Reloadable: true},
+	{Name: "batch.adaptive.step", Default: common.DEFAULT_ADAPTIVE_BATCH_STEP, Rule: config.IntAtLeast(1), Reloadable: true},
+	{Name: "rate.betsPerSecond", Rule: config.IntAtLeast(0), Reloadable: true},
+	{Name: "rate.betsBurst", Rule: config.IntAtLeast(0), Reloadable: true},
+	{Name: "rate.bytesPerSecond", Rule: config.IntAtLeast(0), Reloadable: true},
+	{Name: "rate.bytesBurst", Rule: config.IntAtLeast(0), Reloadable: true},
+	{Name: "winners.mode", Default: string(common.DEFAULT_WINNERS_MODE), Rule: config.OneOf(string(common.WINNERS_MODE_ASK), string(common.WINNERS_MODE_SUBSCRIBE))},
+	{Name: "winners.maxWait", Rule: config.DurationAtLeast(0)},
+	{Name: "winners.poll.backoff", Rule: config.DurationAtLeast(0)},
+	{Name: "winners.heartbeat", Rule: config.DurationAtLeast(0)},
+	{Name: "loop.period", Rule: config.DurationAtLeast(0)},
+	{Name: "metrics.address", Rule: config.ListenAddress},
+	{Name: "report.output"},
+	{Name: "pipeline.workers", Default: common.DEFAULT_PIPELINE_WORKERS, Rule: config.IntAtLeast(1)},
+	{Name: "pipeline.queueSize", Default: common.DEFAULT_PIPELINE_QUEUE_SIZE, Rule: config.IntAtLeast(1)},
+}
+
+// NewConfig Creates the configuration of the client and binds its keys to
+// the given command line flags
+func NewConfig(flags *pflag.FlagSet) *config.Config {
+	// Configure viper to read env variables with the CLI_ prefix. Nested
+	// keys are read from env variables with underscores instead of points,
+	// e.g. server.address from CLI_SERVER_ADDRESS
+	v := config.New("cli", configKeys)
+	v.BindFlags(flags)
+	return v
+}
+
 // InitConfig Function that uses viper library to parse configuration parameters.
-// Viper is configured to read variables from both environment variables and the
-// config file ./config.yaml. Environment variables takes precedence over parameters
-// defined in the configuration file. If some of the variables cannot be parsed,
-// an error is returned
-func InitConfig() (*viper.Viper, error) {
-	v := viper.New()
-
-	// Configure viper to read env variables with the CLI_ prefix
-	v.AutomaticEnv()
-	v.SetEnvPrefix("cli")
-	// Use a replacer to replace env variables underscores with points. This let us
-	// use nested configurations in the config file and at the same time define
-	// env variables for the nested configurations
-	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-
-	// Add env variables supported
-	v.BindEnv("id")
-	v.BindEnv("server", "address")
-	v.BindEnv("log", "level")
-	v.BindEnv("batch", "maxAmount")
-	v.BindEnv("batch", "maxKiB")
-	v.BindEnv("loop", "period")
-
-	v.SetDefault("batch.maxKiB", 8)
-
-	// Try to read configuration from config file. If config file
-	// does not exists then ReadInConfig will fail but configuration
-	// can be loaded from the environment variables so we shouldn't
-	// return an error in that case
-	v.SetConfigFile("./config.yaml")
-	if err := v.ReadInConfig(); err != nil {
-		fmt.Printf("Configuration could not be read from config file. Using env variables instead")
-	}
-
-	return v, nil
-}
-
-// InitLogger Receives the log level to be set in go-logging as a string. This method
-// parses the string and set the level to the logger. If the level string is not
-// valid an error is returned
-func InitLogger(logLevel string) error {
-	baseBackend := logging.NewLogBackend(os.Stdout, "", 0)
-	format := logging.MustStringFormatter(
-		`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
-	)
-	backendFormatter := logging.NewBackendFormatter(baseBackend, format)
-
-	backendLeveled := logging.AddModuleLevel(backendFormatter)
-	logLevelCode, err := logging.LogLevel(logLevel)
+// Viper is configured to read variables from command line flags, environment
+// variables and the config files. Flags take precedence over environment
+// variables, which take precedence over parameters defined in the configuration
+// files. The config file is ./config.yaml unless --config or CLI_CONFIG name
+// another one, in any format viper supports, and the files of the config.d
+// directory next to it, or of --config-dir or CLI_CONFIG_DIR, are merged over
+// it in order of their names. Every parameter can also be read from the
+// file named by its environment variable followed by _FILE, e.g.
+// CLI_AUTH_HMAC_KEY_FILE=/run/secrets/hmac_key. Every value is then checked
+// against the rules of its key. If the config file can not be parsed or some
+// of the values are not valid, an ErrConfig error listing every problem found
+// is returned
+func InitConfig(v *config.Config) error {
+	// Try to read configuration from config files. If the default config
+	// file does not exists configuration can be loaded from the environment
+	// variables so we shouldn't return an error in that case. Config files
+	// that can not be parsed are a problem, though
+	problems := configProblems(v.ReadConfigFiles(DEFAULT_CONFIG_FILE))
+	if len(v.Files()) == 0 && len(problems) == 0 {
+		fmt.Fprintln(os.Stderr, "Configuration could not be read from config file. Using env variables instead")
+	}
+
+	problems = append(problems, configProblems(v.ReadSecretFiles())...)
+	problems = append(problems, configProblems(v.Validate())...)
+	if len(problems) > 0 {
+		return common.NewError(common.ErrConfig, &config.ValidationError{Problems: problems})
+	}
+	return nil
+}
+
+// configProblems Returns the problems listed by a config.ValidationError
+func configProblems(err error) []string {
+	var validationError *config.ValidationError
+	if errors.As(err, &validationError) {
+		return validationError.Problems
+	}
 	if err != nil {
-		return err
+		return []string{err.Error()}
+	}
+	return nil
+}
+
+// CheckConfig Reads and validates the configuration without connecting to
+// the server, logging every problem found on its own line
+func CheckConfig(v *config.Config) error {
+	if err := InitConfig(v); err != nil {
+		problems := configProblems(errors.Unwrap(err))
+		for _, problem := range problems {
+			log.Errorf("action: config_check | result: fail | problem: %s", problem)
+		}
+		return common.NewError(common.ErrConfig, fmt.Errorf("problems found: %d", len(problems)))
 	}
-	backendLeveled.SetLevel(logLevelCode, "")
 
-	// Set the backends to be used.
-	logging.SetBackend(backendLeveled)
+	log.Infof("action: config_check | result: success")
 	return nil
 }
 
-// PrintConfig Print all the configuration parameters of the program.
-// For debugging purposes only
-func PrintConfig(v *viper.Viper) {
-	log.Infof("action: config | result: success | client_id: %s | server_address: %s | log_level: %s | batch_max_amount: %d | batch_max_kib: %d",
-		v.GetString("id"),
-		v.GetString("server.address"),
-		v.GetString("log.level"),
-		v.GetInt("batch.maxAmount"),
-		v.GetInt("batch.maxKiB"),
-	)
+// InitTLSConfig Builds the TLS configuration of the connection to the server
+// from the server.tls.* parameters. If TLS is not enabled, nil is returned.
+// An error is returned if the client certificate does not belong to the
+// configured agency id
+func InitTLSConfig(v *config.Config) (*tls.Config, error) {
+	if !v.GetBool("server.tls.enabled") {
+		return nil, nil
+	}
+
+	tlsConfig, err := common.NewTLSConfig(common.TLSOptions{
+		CAFile:       v.GetString("server.tls.ca"),
+		ServerName:   v.GetString("server.tls.serverName"),
+		MinVersion:   v.GetString("server.tls.minVersion"),
+		CipherPolicy: v.GetString("server.tls.ciphers"),
+		CertFile:     v.GetString("server.tls.cert"),
+		KeyFile:      v.GetString("server.tls.key"),
+		AgencyID:     v.GetString("id"),
+	}, v.GetString("server.address"))
+	return tlsConfig, common.NewError(common.ErrConfig, err)
+}
+
+// InitMessageSigner Builds the signer of the messages exchanged with the
+// server from the auth.hmac.* parameters. If no key is configured, messages
+// are not signed and nil is returned
+func InitMessageSigner(v *config.Config) *common.MessageSigner {
+	key := v.GetString("auth.hmac.key")
+	if key == "" {
+		return nil
+	}
+	return common.NewMessageSigner(v.GetString("id"), []byte(key), v.GetDuration("auth.hmac.maxClockSkew"))
+}
+
+// ConnectPolicy Returns how to connect to the server from the connect.*
+// parameters. By default, the client dials at once and does not retry
+func ConnectPolicy(v *config.Config) common.ConnectPolicy {
+	keepAlive := v.GetDuration("connect.keepAlive.period")
+	if !v.GetBool("connect.keepAlive.enabled") {
+		keepAlive = -1
+	}
+	return common.ConnectPolicy{
+		Jitter:       v.GetDuration("connect.jitter"),
+		RetryMaxWait: v.GetDuration("connect.retry.maxWait"),
+		RetryBackoff: v.GetDuration("connect.retry.backoff"),
+		Handshake:    v.GetBool("connect.handshake"),
+		Credits:      v.GetBool("connect.credits"),
+		KeepAlive:    keepAlive,
+	}
+}
+
+// HeartbeatPolicy Returns how to check that the server is still there from
+// the heartbeat.* parameters. Heartbeats are disabled unless an interval is
+// set
+func HeartbeatPolicy(v *config.Config) common.HeartbeatPolicy {
+	return common.HeartbeatPolicy{
+		Interval:       v.GetDuration("heartbeat.interval"),
+		MaxMissedPongs: v.GetInt("heartbeat.maxMissedPongs"),
+	}
 }
 
-func main() {
-	v, err := InitConfig()
+// AdaptiveBatching Returns the adaptive batching set by the batch.adaptive.*
+// parameters. It is disabled unless a target latency is set
+func AdaptiveBatching(v *config.Config) common.AdaptiveBatching {
+	return common.AdaptiveBatching{
+		TargetLatency: v.GetDuration("batch.adaptive.targetLatency"),
+		MinAmount:     v.GetInt("batch.adaptive.minAmount"),
+		Step:          v.GetInt("batch.adaptive.step"),
+	}
+}
+
+// WinnersPolicy Returns how to wait for the winners from the winners.*
+// parameters. By default, the client asks once and waits for the draw
+// as long as it takes
+func WinnersPolicy(v *config.Config) common.WinnersPolicy {
+	return common.WinnersPolicy{
+		Mode:        common.WinnersMode(v.GetString("winners.mode")),
+		MaxWait:     v.GetDuration("winners.maxWait"),
+		PollBackoff: v.GetDuration("winners.poll.backoff"),
+		Heartbeat:   v.GetDuration("winners.heartbeat"),
+	}
+}
+
+// RateLimits Returns the limits set by the rate.* parameters. Unset
+// parameters do not limit anything
+func RateLimits(v *config.Config) common.RateLimits {
+	return common.RateLimits{
+		BetsPerSecond:  v.GetInt("rate.betsPerSecond"),
+		BetsBurst:      v.GetInt("rate.betsBurst"),
+		BytesPerSecond: v.GetInt("rate.bytesPerSecond"),
+		BytesBurst:     v.GetInt("rate.bytesBurst"),
+	}
+}
+
+// InitMetrics Serves the metrics of the client on metrics.address and
+// returns the observer that keeps them, along with the function that stops
+// serving them. If no address is configured, metrics are not kept
+func InitMetrics(v *config.Config) (common.Observer, func(), error) {
+	address := v.GetString("metrics.address")
+	if address == "" {
+		return nil, func() {}, nil
+	}
+
+	registry := metrics.NewRegistry()
+	clientMetrics := metrics.NewClientMetrics(registry)
+	stop, err := metrics.Serve(address, registry)
 	if err != nil {
-		log.Fatalf("%s", err)
+		return nil, nil, common.NewError(common.ErrConfig, err)
 	}
+	log.Infof("action: serve_metrics | result: success | client_id: %v | address: %v%v", v.GetString("id"), address, metrics.METRICS_PATH)
+	return clientMetrics, stop, nil
+}
 
-	if err := InitLogger(v.GetString("log.level")); err != nil {
-		log.Fatalf("%s", err)
+// InitReport Starts recording the report of the run if report.output is
+// configured. Otherwise, nil is returned
+func InitReport(v *config.Config) *report.Recorder {
+	if v.GetString("report.output") == "" {
+		return nil
 	}
+	return report.NewRecorder(v.GetString("id"), report.Limits{
+		BatchMaxAmount: v.GetInt("batch.maxAmount"),
+		BatchMaxKiB:    v.GetInt("batch.maxKiB"),
+		AckTimeout:     v.GetDuration("server.ackTimeout").String(),
+	})
+}
 
-	PrintConfig(v)
+// WriteReport Closes the report of the run with the error it ended with and
+// writes it to report.output. Failing to write it is logged but does not
+// change the outcome of the run
+func WriteReport(v *config.Config, recorder *report.Recorder, runError error) {
+	if recorder == nil {
+		return
+	}
 
-	clientConfig := common.ClientConfig{
-		ServerAddress:              v.GetString("server.address"),
-		ID:                         v.GetString("id"),
-		MaxAmountOfBetsOnEachBatch: v.GetInt("batch.maxAmount"),
-		MaxKiBPerBatch:             v.GetInt("batch.maxKiB"),
-		AgencyFileName:             fmt.Sprintf("agency-%s.csv", v.GetString("id")),
+	runReport := recorder.Finish(runError)
+	if err := runReport.WriteFile(v.GetString("report.output")); err != nil {
+		log.Errorf("action: write_report | result: fail | client_id: %v | error: %v", v.GetString("id"), err)
+		return
 	}
+	log.Infof("action: write_report | result: success | client_id: %v | output: %v | outcome: %v", v.GetString("id"), v.GetString("report.output"), runReport.Outcome)
+}
 
-	client := common.NewClient(clientConfig)
-	err = client.SendAllBetsToNationalLotteryHeadquartersThenAskForWinners()
+// InitLogger Receives the log level to be set in go-logging as a string and
+// the format of the log lines, text or json. This method parses both strings
+// and set them to the logger. If any of them is not valid an error is returned
+func InitLogger(logLevel string, logFormat string) error {
+	backend, err := logformat.NewBackend(logFormat, os.Stdout)
 	if err != nil {
-		log.Fatalf("action: unexpected_error | result: fail | error: %s", err)
+		return common.NewError(common.ErrConfig, err)
 	}
 
-	log.Infof("action: exit | result: success | client_id: %v", v.GetString("id"))
+	logLevelCode, err := logging.LogLevel(logLevel)
+	if err != nil {
+		return common.NewError(common.ErrConfig, err)
+	}
+	logBackend = logformat.NewLevelBackend(backend, logLevelCode)
+
+	// Set the backends to be used.
+	logging.SetBackend(logBackend)
+	return nil
+}
+
+// PrintConfig Print all the configuration parameters of the program and,
+// on a second line with the same fields, where each one was taken from.
+// Sensitive parameters are redacted. For debugging purposes only
+func PrintConfig(v *config.Config) {
+	var values, sources strings.Builder
+	for _, entry := range v.Entries() {
+		fmt.Fprintf(&values, " | %s: %s", configFieldName(entry.Key), entry.Value)
+		fmt.Fprintf(&sources, " | %s: %s", configFieldName(entry.Key), entry.Source)
+	}
+	log.Infof("action: config | result: success%s", values.String())
+	log.Infof("action: config_sources | result: success%s", sources.String())
+	log.Infof("action: config_files | result: success | files: %s", strings.Join(v.Files(), ","))
+}
+
+// configFieldNames are the log names of the keys that do not follow the
+// general rule of configFieldName
+var configFieldNames = map[string]string{
+	"id":           "client_id",
+	"batch.maxKiB": "batch_max_kib",
+}
+
+// configFieldName Turns a dotted camel case key into the snake case name
+// used in the logs, e.g. server.tls.serverName into server_tls_server_name
+func configFieldName(key string) string {
+	if name, found := configFieldNames[key]; found {
+		return name
+	}
+
+	var name strings.Builder
+	for _, character := range key {
+		switch {
+		case character == '.':
+			name.WriteRune('_')
+		case unicode.IsUpper(character):
+			name.WriteRune('_')
+			name.WriteRune(unicode.ToLower(character))
+		default:
+			name.WriteRune(character)
+		}
+	}
+	return name.String()
 }
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const METRICS_NAMESPACE = "lottery_client_"
+
+var (
+	BATCH_SIZE_BUCKETS  = []float64{1, 5, 10, 25, 50, 100, 250, 500}
+	ACK_LATENCY_BUCKETS = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	THROTTLE_BUCKETS    = []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// ClientMetrics is a common.Observer that keeps the metrics of a client
+type ClientMetrics struct {
+	common.NopObserver
+
+	betsRead      *Counter
+	betsRejected  *Counter
+	batchesSent   *Counter
+	bytesSent     *Counter
+	ackMismatches *Counter
+	reconnects    *Counter
+	batchSize     *Histogram
+	ackLatency    *Histogram
+	throttled     *Histogram
+	creditWait    *Histogram
+	winnersAmount *Gauge
+	state         *StateGauge
+}
+
+// ============================== BUILDER ============================== //
+
+// NewClientMetrics Creates the metrics of a client in registry
+func NewClientMetrics(registry *Registry) *ClientMetrics {
+	states := make([]string, 0, len(common.CLIENT_STATES))
+	for _, state := range common.CLIENT_STATES {
+		states = append(states, string(state))
+	}
+
+	return &ClientMetrics{
+		betsRead:      registry.NewCounter(METRICS_NAMESPACE+"bets_read_total", "Rows read from the agency file, valid or not."),
+		betsRejected:  registry.NewCounter(METRICS_NAMESPACE+"bets_rejected_total", "Rows of the agency file rejected by the validation."),
+		batchesSent:   registry.NewCounter(METRICS_NAMESPACE+"batches_sent_total", "Bet batches acknowledged by the server."),
+		bytesSent:     registry.NewCounter(METRICS_NAMESPACE+"bytes_sent_total", "Bytes of the bet batches acknowledged by the server."),
+		ackMismatches: registry.NewCounter(METRICS_NAMESPACE+"ack_mismatches_total", "Messages acknowledged with an unexpected ACK."),
+		reconnects:    registry.NewCounter(METRICS_NAMESPACE+"reconnects_total", "Attempts to connect to the server retried after being refused, reset or found busy."),
+		batchSize:     registry.NewHistogram(METRICS_NAMESPACE+"batch_size_bets", "Amount of bets on each batch sent.", BATCH_SIZE_BUCKETS),
+		ackLatency:    registry.NewHistogram(METRICS_NAMESPACE+"ack_latency_seconds", "Time from sending a batch to receiving its ACK.", ACK_LATENCY_BUCKETS),
+		throttled:     registry.NewHistogram(METRICS_NAMESPACE+"throttled_seconds", "Time each batch waited for the rate limiter, its sum is the time spent throttled.", THROTTLE_BUCKETS),
+		creditWait:    registry.NewHistogram(METRICS_NAMESPACE+"credit_wait_seconds", "Time each batch waited for the server to grant credits to send it.", THROTTLE_BUCKETS),
+		winnersAmount: registry.NewGauge(METRICS_NAMESPACE+"winners", "Amount of winners received from the server."),
+		state:         registry.NewStateGauge(METRICS_NAMESPACE+"state", "Step the client is going through.", "state", states...),
+	}
+}
+
+// ============================== PUBLIC - OBSERVER ============================== //
+
+func (metrics *ClientMetrics) ConnectRetried(attempt int, wait time.Duration, reason error) {
+	metrics.reconnects.Inc()
+}
+
+func (metrics *ClientMetrics) StateChanged(state common.ClientState) {
+	metrics.state.Set(string(state))
+}
+
+func (metrics *ClientMetrics) BetsRead(amount int) {
+	metrics.betsRead.Add(uint64(amount))
+}
+
+func (metrics *ClientMetrics) BetRejected(line int, reason error) {
+	metrics.betsRejected.Inc()
+}
+
+func (metrics *ClientMetrics) BetBatchAcknowledged(batchSize int, batchBytes int, latency time.Duration) {
+	metrics.batchesSent.Inc()
+	metrics.bytesSent.Add(uint64(batchBytes))
+	metrics.batchSize.Observe(float64(batchSize))
+	metrics.ackLatency.Observe(latency.Seconds())
+}
+
+func (metrics *ClientMetrics) Throttled(waited time.Duration) {
+	metrics.throttled.Observe(waited.Seconds())
+}
+
+func (metrics *ClientMetrics) WaitedForCredits(waited time.Duration) {
+	metrics.creditWait.Observe(waited.Seconds())
+}
+
+func (metrics *ClientMetrics) AckMismatch(expected string, received string) {
+	metrics.ackMismatches.Inc()
+}
+
+func (metrics *ClientMetrics) WinnersReceived(amountOfWinners int, waited time.Duration) {
+	metrics.winnersAmount.Set(float64(amountOfWinners))
+}
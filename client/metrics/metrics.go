@@ -0,0 +1,288 @@
+// Package metrics keeps counters, gauges and histograms in memory and serves
+// them over HTTP in the Prometheus text exposition format. It only depends on
+// the standard library, so the client does not need a metrics SDK.
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	METRICS_PATH = "/metrics"
+
+	// CONTENT_TYPE is the content type of the text exposition format
+	CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+	SHUTDOWN_TIMEOUT = 5 * time.Second
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// metric is anything that can write its samples in the exposition format
+type metric interface {
+	write(writer *bufio.Writer)
+}
+
+// Registry holds every metric served. It is safe for concurrent use
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	name string
+	help string
+	bits uint64
+}
+
+// StateGauge is a gauge with a label that tells the current state. The
+// sample of the current state is 1 and the samples of every other state are 0
+type StateGauge struct {
+	name   string
+	help   string
+	label  string
+	states []string
+
+	lock    sync.Mutex
+	current string
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	lock   sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// ============================== BUILDER ============================== //
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (registry *Registry) register(metric metric) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.metrics = append(registry.metrics, metric)
+}
+
+// NewCounter Creates a counter served by the registry
+func (registry *Registry) NewCounter(name string, help string) *Counter {
+	counter := &Counter{name: name, help: help}
+	registry.register(counter)
+	return counter
+}
+
+// NewGauge Creates a gauge served by the registry
+func (registry *Registry) NewGauge(name string, help string) *Gauge {
+	gauge := &Gauge{name: name, help: help}
+	registry.register(gauge)
+	return gauge
+}
+
+// NewStateGauge Creates a state gauge served by the registry, starting at
+// the first of the given states
+func (registry *Registry) NewStateGauge(name string, help string, label string, states ...string) *StateGauge {
+	gauge := &StateGauge{name: name, help: help, label: label, states: states}
+	if len(states) > 0 {
+		gauge.current = states[0]
+	}
+	registry.register(gauge)
+	return gauge
+}
+
+// NewHistogram Creates a histogram served by the registry with the given
+// bucket upper bounds. The +Inf bucket is always added
+func (registry *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	histogram := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	registry.register(histogram)
+	return histogram
+}
+
+// ============================== PRIVATE - EXPOSITION ============================== //
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+func writeHeader(writer *bufio.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (counter *Counter) write(writer *bufio.Writer) {
+	writeHeader(writer, counter.name, counter.help, "counter")
+	fmt.Fprintf(writer, "%s %d\n", counter.name, counter.Value())
+}
+
+func (gauge *Gauge) write(writer *bufio.Writer) {
+	writeHeader(writer, gauge.name, gauge.help, "gauge")
+	fmt.Fprintf(writer, "%s %s\n", gauge.name, formatFloat(gauge.Value()))
+}
+
+func (gauge *StateGauge) write(writer *bufio.Writer) {
+	current := gauge.Current()
+
+	writeHeader(writer, gauge.name, gauge.help, "gauge")
+	for _, state := range gauge.states {
+		value := 0
+		if state == current {
+			value = 1
+		}
+		fmt.Fprintf(writer, "%s{%s=%q} %d\n", gauge.name, gauge.label, state, value)
+	}
+}
+
+func (histogram *Histogram) write(writer *bufio.Writer) {
+	histogram.lock.Lock()
+	counts := append([]uint64{}, histogram.counts...)
+	count, sum := histogram.count, histogram.sum
+	histogram.lock.Unlock()
+
+	writeHeader(writer, histogram.name, histogram.help, "histogram")
+	cumulative := uint64(0)
+	for i, bound := range histogram.buckets {
+		cumulative += counts[i]
+		fmt.Fprintf(writer, "%s_bucket{le=%q} %d\n", histogram.name, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(writer, "%s_bucket{le=\"+Inf\"} %d\n", histogram.name, count)
+	fmt.Fprintf(writer, "%s_sum %s\n", histogram.name, formatFloat(sum))
+	fmt.Fprintf(writer, "%s_count %d\n", histogram.name, count)
+}
+
+// ============================== PUBLIC - METRICS ============================== //
+
+func (counter *Counter) Add(amount uint64) {
+	atomic.AddUint64(&counter.value, amount)
+}
+
+func (counter *Counter) Inc() {
+	counter.Add(1)
+}
+
+func (counter *Counter) Value() uint64 {
+	return atomic.LoadUint64(&counter.value)
+}
+
+func (gauge *Gauge) Set(value float64) {
+	atomic.StoreUint64(&gauge.bits, math.Float64bits(value))
+}
+
+func (gauge *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&gauge.bits))
+}
+
+func (gauge *StateGauge) Set(state string) {
+	gauge.lock.Lock()
+	defer gauge.lock.Unlock()
+	gauge.current = state
+}
+
+func (gauge *StateGauge) Current() string {
+	gauge.lock.Lock()
+	defer gauge.lock.Unlock()
+	return gauge.current
+}
+
+// Observe Adds value to the first bucket whose upper bound is not lower
+// than it, or only to +Inf if there is none
+func (histogram *Histogram) Observe(value float64) {
+	index := sort.SearchFloat64s(histogram.buckets, value)
+
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+	if index < len(histogram.counts) {
+		histogram.counts[index]++
+	}
+	histogram.count++
+	histogram.sum += value
+}
+
+// ============================== PUBLIC - SERVE ============================== //
+
+// WriteTo Writes every metric of the registry in the text exposition format
+func (registry *Registry) WriteTo(writer io.Writer) (int64, error) {
+	registry.lock.Lock()
+	metrics := append([]metric{}, registry.metrics...)
+	registry.lock.Unlock()
+
+	counter := &countingWriter{writer: writer}
+	buffered := bufio.NewWriter(counter)
+	for _, metric := range metrics {
+		metric.write(buffered)
+	}
+	err := buffered.Flush()
+	return counter.written, err
+}
+
+// ServeHTTP Serves the metrics of the registry
+func (registry *Registry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", CONTENT_TYPE)
+	registry.WriteTo(writer)
+}
+
+// Serve Listens on address and serves the registry on METRICS_PATH until
+// the returned stop function is called. Listen errors are returned right
+// away, so a wrong address is reported before the client starts
+func Serve(address string, registry *Registry) (stop func(), err error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, registry)
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
+
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (writer *countingWriter) Write(bytes []byte) (int, error) {
+	written, err := writer.writer.Write(bytes)
+	writer.written += int64(written)
+	return written, err
+}
@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+func scrape(t *testing.T, registry *Registry) string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", METRICS_PATH, nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != CONTENT_TYPE {
+		t.Fatalf("unexpected content type: %s", contentType)
+	}
+	return recorder.Body.String()
+}
+
+func assertContains(t *testing.T, exposition string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(exposition, line+"\n") {
+			t.Fatalf("line %q not found in:\n%s", line, exposition)
+		}
+	}
+}
+
+func TestRegistryWritesTheTextExpositionFormat(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("test_events_total", "Events.")
+	histogram := registry.NewHistogram("test_latency_seconds", "Latency.", []float64{0.5, 0.1})
+	state := registry.NewStateGauge("test_state", "State.", "state", "idle", "busy")
+
+	counter.Add(3)
+	histogram.Observe(0.05)
+	histogram.Observe(0.3)
+	histogram.Observe(7)
+	state.Set("busy")
+
+	assertContains(t, scrape(t, registry),
+		"# HELP test_events_total Events.",
+		"# TYPE test_events_total counter",
+		"test_events_total 3",
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{le="0.1"} 1`,
+		`test_latency_seconds_bucket{le="0.5"} 2`,
+		`test_latency_seconds_bucket{le="+Inf"} 3`,
+		"test_latency_seconds_sum 7.35",
+		"test_latency_seconds_count 3",
+		`test_state{state="idle"} 0`,
+		`test_state{state="busy"} 1`,
+	)
+}
+
+func TestClientMetricsFollowTheClientEvents(t *testing.T) {
+	registry := NewRegistry()
+	clientMetrics := NewClientMetrics(registry)
+
+	var observer common.Observer = clientMetrics
+	observer.Connected()
+	observer.StateChanged(common.STATE_SENDING)
+	observer.BetsRead(12)
+	observer.BetRejected(4, errors.New("invalid document"))
+	observer.BetBatchAcknowledged(11, 1500, 20*time.Millisecond)
+	observer.Throttled(300 * time.Millisecond)
+	observer.WaitedForCredits(2 * time.Second)
+	observer.AckMismatch("ACK[11]", "ACK[10]")
+	observer.ConnectRetried(1, 100*time.Millisecond, errors.New("connection refused"))
+	observer.ConnectRetried(2, 200*time.Millisecond, errors.New("connection refused"))
+	observer.Connected()
+	observer.StateChanged(common.STATE_WAITING_WINNERS)
+
+	assertContains(t, scrape(t, registry),
+		"lottery_client_bets_read_total 12",
+		"lottery_client_bets_rejected_total 1",
+		"lottery_client_batches_sent_total 1",
+		"lottery_client_bytes_sent_total 1500",
+		"lottery_client_ack_mismatches_total 1",
+		"lottery_client_reconnects_total 2",
+		`lottery_client_batch_size_bets_bucket{le="25"} 1`,
+		`lottery_client_ack_latency_seconds_bucket{le="0.025"} 1`,
+		`lottery_client_throttled_seconds_bucket{le="0.5"} 1`,
+		"lottery_client_throttled_seconds_sum 0.3",
+		`lottery_client_credit_wait_seconds_bucket{le="2.5"} 1`,
+		`lottery_client_state{state="sending"} 0`,
+		`lottery_client_state{state="waiting_winners"} 1`,
+	)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/config"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	RELOAD_TRIGGER_SIGNAL = "sighup"
+	RELOAD_TRIGGER_FILE   = "file"
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// reloader applies the reloadable keys of the configuration to a running
+// client whenever it receives SIGHUP or a config file is written
+type reloader struct {
+	client      *common.Client
+	rateLimiter *common.RateLimiter
+
+	// current is the configuration the client is running with. The one it
+	// starts with is shared, so it is never changed: since viper is not safe
+	// for concurrent use, every reload replaces it with the one read. Rejected
+	// changes are never recorded on it, so they are reported on every reload
+	// until the client is restarted
+	current *config.Config
+
+	triggers chan string
+	done     chan struct{}
+}
+
+// ============================== PRIVATE - RELOAD ============================== //
+
+// trigger Asks for a reload without blocking. Triggers that arrive while one
+// is pending are merged into it, since a single reload reads every change
+func (reloader *reloader) trigger(trigger string) {
+	select {
+	case reloader.triggers <- trigger:
+	default:
+	}
+}
+
+func (reloader *reloader) run(signals chan os.Signal) {
+	for {
+		select {
+		case <-reloader.done:
+			return
+		case <-signals:
+			reloader.reload(RELOAD_TRIGGER_SIGNAL)
+		case trigger := <-reloader.triggers:
+			reloader.reload(trigger)
+		}
+	}
+}
+
+// reload Reads the configuration again and applies the changes of its
+// reloadable keys. Changes of other keys are rejected with a warning, and an
+// invalid configuration is not applied at all
+func (reloader *reloader) reload(trigger string) {
+	id := reloader.current.GetString("id")
+	fresh, err := reloader.current.Reload()
+	if err != nil {
+		log.Warningf("action: config_reload | result: fail | client_id: %v | trigger: %v | error: %v", id, trigger, err)
+		return
+	}
+
+	var applied []string
+	for _, change := range reloader.current.Changes(fresh) {
+		if !reloader.current.IsReloadable(change.Key) {
+			log.Warningf("action: config_reload | result: rejected | client_id: %v | key: %v | error: can not change while the client runs, restart it to apply it", id, change.Key)
+			fresh.CopyValue(change.Key, reloader.current)
+			continue
+		}
+		applied = append(applied, change.String())
+	}
+	reloader.current = fresh
+
+	if len(applied) == 0 {
+		log.Infof("action: config_reload | result: success | client_id: %v | trigger: %v | changes: none", id, trigger)
+		return
+	}
+
+	reloader.apply()
+	log.Infof("action: config_reload | result: success | client_id: %v | trigger: %v | changes: %v", id, trigger, strings.Join(applied, ", "))
+}
+
+// apply Sets the reloadable keys of the current configuration to the client,
+// its rate limiter and the logger
+func (reloader *reloader) apply() {
+	reloader.client.UpdateLimits(common.Limits{
+		MaxAmountOfBetsOnEachBatch: reloader.current.GetInt("batch.maxAmount"),
+		MaxKiBPerBatch:             reloader.current.GetInt("batch.maxKiB"),
+		AckTimeout:                 reloader.current.GetDuration("server.ackTimeout"),
+		AdaptiveBatching:           AdaptiveBatching(reloader.current),
+	})
+	reloader.rateLimiter.SetRateLimits(RateLimits(reloader.current))
+
+	if level, err := logging.LogLevel(reloader.current.GetString("log.level")); err == nil && logBackend != nil {
+		logBackend.SetLevel(level, "")
+	}
+}
+
+// ============================== PUBLIC ============================== //
+
+// InitReloader Reloads the configuration of client whenever the process
+// receives SIGHUP or one of the config files read is written, and returns
+// the function that stops doing it. Only the reloadable keys are applied,
+// see config.Key, so the batch limits and their adaptive sizing, the ack
+// timeout, the rate limits and the log level can be tuned without restarting
+// the client. v itself is never changed. If the config files can not be
+// watched, the client is still reloaded on SIGHUP
+func InitReloader(v *config.Config, client *common.Client, rateLimiter *common.RateLimiter) func() {
+	reloader := &reloader{
+		client:      client,
+		rateLimiter: rateLimiter,
+		current:     v,
+		triggers:    make(chan string, 1),
+		done:        make(chan struct{}),
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	stopWatching, err := v.Watch(func(fileName string) { reloader.trigger(RELOAD_TRIGGER_FILE) })
+	if err != nil {
+		log.Warningf("action: config_watch | result: fail | client_id: %v | error: %v", v.GetString("id"), err)
+		stopWatching = func() {}
+	}
+	go reloader.run(signals)
+
+	return func() {
+		stopWatching()
+		signal.Stop(signals)
+		close(reloader.done)
+	}
+}
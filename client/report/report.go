@@ -0,0 +1,281 @@
+// Package report builds the summary of a client run, written as JSON when
+// the client exits so operators can reconcile what each agency submitted
+// without going through its logs.
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// ============================== CONSTANTS ============================== //
+
+const (
+	OUTCOME_SUCCESS     = "success"
+	OUTCOME_FAILURE     = "failure"
+	OUTCOME_INTERRUPTED = "interrupted"
+
+	ERROR_CLASS_CONFIG       = "config"
+	ERROR_CLASS_CONNECT      = "connect"
+	ERROR_CLASS_PROTOCOL     = "protocol"
+	ERROR_CLASS_ACK_MISMATCH = "ack_mismatch"
+	ERROR_CLASS_INPUT        = "input"
+	ERROR_CLASS_INTERRUPTED  = "interrupted"
+	ERROR_CLASS_UNKNOWN      = "unknown"
+
+	// MAX_REJECTION_DETAILS bounds the rejected rows listed one by one. Every
+	// rejection is still counted by reason
+	MAX_REJECTION_DETAILS = 1000
+)
+
+// ============================== STRUCT DEFINITION ============================== //
+
+// Limits are the configured limits the run was made with
+type Limits struct {
+	BatchMaxAmount int    `json:"batch_max_amount"`
+	BatchMaxKiB    int    `json:"batch_max_kib"`
+	AckTimeout     string `json:"ack_timeout"`
+}
+
+// Rejection is a row of the agency file that was not sent
+type Rejection struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+// Batches describes the batches acknowledged by the server
+type Batches struct {
+	Count    int     `json:"count"`
+	Bytes    int     `json:"bytes"`
+	MinSize  int     `json:"min_size"`
+	MaxSize  int     `json:"max_size"`
+	MeanSize float64 `json:"mean_size"`
+
+	// SizeDistribution maps each batch size to the amount of batches of
+	// that size
+	SizeDistribution map[int]int `json:"size_distribution"`
+}
+
+// Report is the summary of a client run
+type Report struct {
+	ClientID   string    `json:"client_id"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Limits     Limits    `json:"limits"`
+
+	RowsRead         int            `json:"rows_read"`
+	BetsSent         int            `json:"bets_sent"`
+	BetsRejected     int            `json:"bets_rejected"`
+	RejectionReasons map[string]int `json:"rejection_reasons"`
+	Rejections       []Rejection    `json:"rejections"`
+	Batches          Batches        `json:"batches"`
+	AckMismatches    int            `json:"ack_mismatches"`
+	Reconnects       int            `json:"reconnects"`
+
+	WinnersWaitMs int64 `json:"winners_wait_ms"`
+	Winners       *int  `json:"winners"`
+
+	Outcome    string `json:"outcome"`
+	Error      string `json:"error,omitempty"`
+	ErrorClass string `json:"error_class,omitempty"`
+}
+
+// Recorder is a common.Observer that builds the report of a run. It is safe
+// for concurrent use
+type Recorder struct {
+	common.NopObserver
+
+	lock    sync.Mutex
+	report  Report
+	stopped bool
+
+	// waitingSince is when the client started waiting for the winners, so
+	// the wait is reported even if they never arrive
+	waitingSince time.Time
+}
+
+// ============================== BUILDER ============================== //
+
+// NewRecorder Starts the report of the run of the given client
+func NewRecorder(clientID string, limits Limits) *Recorder {
+	return &Recorder{report: Report{
+		ClientID:         clientID,
+		StartedAt:        time.Now(),
+		Limits:           limits,
+		RejectionReasons: map[string]int{},
+		Rejections:       []Rejection{},
+		Batches:          Batches{SizeDistribution: map[int]int{}},
+	}}
+}
+
+// ============================== PRIVATE - CLASSIFY ============================== //
+
+// rejectionReason Describes why a row was rejected, without the parts that
+// change from row to row, so rejections can be grouped by reason
+func rejectionReason(err error) string {
+	var parseError *csv.ParseError
+	if errors.As(err, &parseError) {
+		return parseError.Err.Error()
+	}
+	return err.Error()
+}
+
+// errorClasses maps each kind of failure of the client to its class
+var errorClasses = map[error]string{
+	common.ErrConfig:      ERROR_CLASS_CONFIG,
+	common.ErrConnect:     ERROR_CLASS_CONNECT,
+	common.ErrProtocol:    ERROR_CLASS_PROTOCOL,
+	common.ErrAckMismatch: ERROR_CLASS_ACK_MISMATCH,
+	common.ErrInput:       ERROR_CLASS_INPUT,
+	common.ErrInterrupted: ERROR_CLASS_INTERRUPTED,
+}
+
+// ClassifyError Tells which kind of failure err is, from the kind the
+// client tagged it with
+func ClassifyError(err error) string {
+	if class, found := errorClasses[common.KindOf(err)]; found {
+		return class
+	}
+	return ERROR_CLASS_UNKNOWN
+}
+
+// ============================== PUBLIC - OBSERVER ============================== //
+
+func (recorder *Recorder) ConnectRetried(attempt int, wait time.Duration, reason error) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	recorder.report.Reconnects++
+}
+
+func (recorder *Recorder) StateChanged(state common.ClientState) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	if state == common.STATE_WAITING_WINNERS {
+		recorder.waitingSince = time.Now()
+	} else if !recorder.waitingSince.IsZero() {
+		recorder.report.WinnersWaitMs = time.Since(recorder.waitingSince).Milliseconds()
+		recorder.waitingSince = time.Time{}
+	}
+}
+
+func (recorder *Recorder) BetsRead(amount int) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	recorder.report.RowsRead += amount
+}
+
+func (recorder *Recorder) BetRejected(line int, reason error) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	description := rejectionReason(reason)
+	recorder.report.BetsRejected++
+	recorder.report.RejectionReasons[description]++
+	if len(recorder.report.Rejections) < MAX_REJECTION_DETAILS {
+		recorder.report.Rejections = append(recorder.report.Rejections, Rejection{Line: line, Reason: description})
+	}
+}
+
+func (recorder *Recorder) BetBatchAcknowledged(batchSize int, batchBytes int, latency time.Duration) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	batches := &recorder.report.Batches
+	if batches.Count == 0 || batchSize < batches.MinSize {
+		batches.MinSize = batchSize
+	}
+	if batchSize > batches.MaxSize {
+		batches.MaxSize = batchSize
+	}
+	batches.Count++
+	batches.Bytes += batchBytes
+	batches.SizeDistribution[batchSize]++
+	recorder.report.BetsSent += batchSize
+	batches.MeanSize = float64(recorder.report.BetsSent) / float64(batches.Count)
+}
+
+func (recorder *Recorder) AckMismatch(expected string, received string) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	recorder.report.AckMismatches++
+}
+
+func (recorder *Recorder) WinnersReceived(amountOfWinners int, waited time.Duration) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	recorder.report.Winners = &amountOfWinners
+	recorder.report.WinnersWaitMs = waited.Milliseconds()
+}
+
+func (recorder *Recorder) Stopped() {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	recorder.stopped = true
+}
+
+// ============================== PUBLIC ============================== //
+
+// Finish Closes the report with the error the run ended with, if any, and
+// returns it. A run that failed with ErrInterrupted, or was stopped before
+// getting the winners, is interrupted
+func (recorder *Recorder) Finish(err error) Report {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	report := &recorder.report
+	report.FinishedAt = time.Now()
+	if !recorder.waitingSince.IsZero() {
+		report.WinnersWaitMs = report.FinishedAt.Sub(recorder.waitingSince).Milliseconds()
+	}
+	switch {
+	case errors.Is(err, common.ErrInterrupted):
+		report.Outcome = OUTCOME_INTERRUPTED
+		report.Error = err.Error()
+		report.ErrorClass = ERROR_CLASS_INTERRUPTED
+	case err != nil:
+		report.Outcome = OUTCOME_FAILURE
+		report.Error = err.Error()
+		report.ErrorClass = ClassifyError(err)
+	case recorder.stopped && report.Winners == nil:
+		report.Outcome = OUTCOME_INTERRUPTED
+		report.ErrorClass = ERROR_CLASS_INTERRUPTED
+	default:
+		report.Outcome = OUTCOME_SUCCESS
+	}
+	return *report
+}
+
+// WriteFile Writes report as indented JSON to fileName. The report is
+// written to a temporary file first and then renamed, so readers never see
+// a partial report
+func (report Report) WriteFile(fileName string) error {
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temporaryFile, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporaryFile.Name())
+
+	if _, err := temporaryFile.Write(append(content, '\n')); err != nil {
+		temporaryFile.Close()
+		return err
+	}
+	if err := temporaryFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temporaryFile.Name(), fileName)
+}
@@ -0,0 +1,121 @@
+package report_test
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/fakehq"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/report"
+)
+
+const testAgencyFile = "Santiago,Lorca,30904465,1999-03-17,7574\n" +
+	"Ana,Perez,not-a-document,1990-01-01,1234\n" +
+	"Maria,Diaz,23456789,1985-12-31,4321\n" +
+	"Pedro,Ruiz,34567890,1970-06-15,7574\n"
+
+func runClient(t *testing.T, behaviour fakehq.Behaviour) report.Report {
+	t.Helper()
+	recorder, client := newRecordedClient(t, behaviour)
+	return recorder.Finish(client.SendAllBetsToNationalLotteryHeadquartersThenAskForWinners())
+}
+
+func newRecordedClient(t *testing.T, behaviour fakehq.Behaviour) (*report.Recorder, *common.Client) {
+	t.Helper()
+	server := fakehq.New(fakehq.Options{Agencies: 1, Behaviour: behaviour})
+	listener := fakehq.NewPipeListener()
+	go server.Serve(listener)
+	t.Cleanup(server.Close)
+
+	recorder := report.NewRecorder("1", report.Limits{BatchMaxAmount: 2, BatchMaxKiB: 8, AckTimeout: "1s"})
+	client := common.NewClient(common.ClientConfig{
+		ID:                         "1",
+		ServerAddress:              "fakehq",
+		MaxAmountOfBetsOnEachBatch: 2,
+		MaxKiBPerBatch:             8,
+		Dial:                       listener.Dial,
+		Connect:                    common.ConnectPolicy{RetryMaxWait: time.Second, Handshake: true},
+		OpenAgencyFile:             func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(testAgencyFile)), nil },
+		Observer:                   recorder,
+	})
+	return recorder, client
+}
+
+func TestReportCountsTheConnectionRetries(t *testing.T) {
+	runReport := runClient(t, fakehq.Behaviour{BusyHandshakes: 2, BusyRetryAfter: 20 * time.Millisecond})
+
+	if runReport.Outcome != report.OUTCOME_SUCCESS || runReport.Reconnects != 2 {
+		t.Fatalf("expected a successful run after 2 retries, got %+v", runReport)
+	}
+}
+
+func TestReportOfASuccessfulRun(t *testing.T) {
+	runReport := runClient(t, fakehq.Behaviour{})
+
+	if runReport.Outcome != report.OUTCOME_SUCCESS || runReport.ErrorClass != "" {
+		t.Fatalf("unexpected outcome: %s (%s)", runReport.Outcome, runReport.ErrorClass)
+	}
+	if runReport.RowsRead != 4 || runReport.BetsSent != 4 || runReport.BetsRejected != 0 {
+		t.Fatalf("unexpected counts: read %d, sent %d, rejected %d", runReport.RowsRead, runReport.BetsSent, runReport.BetsRejected)
+	}
+	if runReport.Batches.Count != 2 || runReport.Batches.SizeDistribution[2] != 2 {
+		t.Fatalf("unexpected batches: %+v", runReport.Batches)
+	}
+	if runReport.Winners == nil || *runReport.Winners != 2 {
+		t.Fatalf("unexpected winners: %v", runReport.Winners)
+	}
+}
+
+func TestReportListsTheBetsTheValidationRejects(t *testing.T) {
+	recorder, client := newRecordedClient(t, fakehq.Behaviour{})
+	validBets, err := client.ValidateBets()
+	runReport := recorder.Finish(err)
+
+	if runReport.Outcome != report.OUTCOME_SUCCESS || validBets != 3 {
+		t.Fatalf("unexpected outcome: %s (%s) with %d valid bets", runReport.Outcome, runReport.ErrorClass, validBets)
+	}
+	if runReport.RowsRead != 4 || runReport.BetsRejected != 1 {
+		t.Fatalf("unexpected counts: read %d, rejected %d", runReport.RowsRead, runReport.BetsRejected)
+	}
+	if runReport.RejectionReasons["invalid document: must be numeric"] != 1 || runReport.Rejections[0].Line != 2 {
+		t.Fatalf("unexpected rejections: %+v %+v", runReport.RejectionReasons, runReport.Rejections)
+	}
+}
+
+func TestReportClassifiesAckMismatches(t *testing.T) {
+	runReport := runClient(t, fakehq.Behaviour{AckCountOffset: -1})
+
+	if runReport.Outcome != report.OUTCOME_FAILURE || runReport.ErrorClass != report.ERROR_CLASS_ACK_MISMATCH {
+		t.Fatalf("unexpected outcome: %s (%s)", runReport.Outcome, runReport.ErrorClass)
+	}
+	if runReport.AckMismatches != 1 || runReport.Winners != nil {
+		t.Fatalf("unexpected report: %+v", runReport)
+	}
+}
+
+func TestReportIsWrittenAsJSON(t *testing.T) {
+	runReport := runClient(t, fakehq.Behaviour{})
+	fileName := filepath.Join(t.TempDir(), "report.json")
+	if err := runReport.WriteFile(fileName); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(content, &fields); err != nil {
+		t.Fatalf("invalid report: %v", err)
+	}
+	for _, field := range []string{"started_at", "finished_at", "limits", "rows_read", "bets_sent", "rejection_reasons", "batches", "reconnects", "winners_wait_ms", "winners", "outcome"} {
+		if _, found := fields[field]; !found {
+			t.Fatalf("field %s missing from report:\n%s", field, content)
+		}
+	}
+}